@@ -4,7 +4,13 @@
 
 package gerrit
 
-import "net/http"
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
 
 // Auth is a Gerrit authentication mode.
 // The most common ones are NoAuth or BasicAuth.
@@ -17,8 +23,53 @@ func BasicAuth(username, password string) Auth {
 	return basicAuth{username, password}
 }
 
-// TODO(bradfitz): add a GitCookies auth mode, where it's automatic
-// from the url string given to the client.
+// HostAuth returns the authentication configured for the Gerrit server host
+// in the files where Gerrit tells users to store it for command-line git:
+// the file named by Git's http.cookiefile setting (usually $HOME/.gitcookies)
+// and then $HOME/.netrc. If neither file has credentials for host,
+// HostAuth returns NoAuth.
+func HostAuth(host string) Auth {
+	// First look in Git's http.cookiefile, which is where Gerrit
+	// now tells users to store this information.
+	out, _ := exec.Command("git", "config", "http.cookiefile").Output()
+	if cookieFile := strings.TrimSpace(string(out)); cookieFile != "" {
+		data, _ := ioutil.ReadFile(cookieFile)
+		maxMatch := -1
+		var cookieName, cookieValue string
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Split(line, "\t")
+			if len(f) >= 7 && (f[0] == host || strings.HasPrefix(f[0], ".") && strings.HasSuffix(host, f[0])) {
+				if len(f[0]) > maxMatch {
+					cookieName = f[5]
+					cookieValue = f[6]
+					maxMatch = len(f[0])
+				}
+			}
+		}
+		if maxMatch > 0 && cookieName == "o" {
+			i := strings.Index(cookieValue, "=")
+			if i >= 0 {
+				return BasicAuth(cookieValue[:i], cookieValue[i+1:])
+			}
+		}
+	}
+
+	// If not there, then look in $HOME/.netrc, which is where Gerrit
+	// used to tell users to store the information, until the passwords
+	// got so long that old versions of curl couldn't handle them.
+	data, _ := ioutil.ReadFile(os.Getenv("HOME") + "/.netrc")
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) >= 6 && f[0] == "machine" && f[1] == host && f[2] == "login" && f[4] == "password" {
+			return BasicAuth(f[3], f[5])
+		}
+	}
+
+	return NoAuth
+}
 
 type basicAuth struct {
 	username, password string
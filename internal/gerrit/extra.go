@@ -0,0 +1,176 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gerrit
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The Gerrit structs with an Extra field implement
+// UnmarshalJSON and MarshalJSON using a plain copy of the type
+// (without the methods) to do the work for the known fields,
+// and unmarshalExtra and marshalExtra to handle the rest.
+
+func (ch *ChangeInfo) UnmarshalJSON(data []byte) error {
+	type plain ChangeInfo
+	extra, err := unmarshalExtra(data, (*plain)(ch))
+	ch.Extra = extra
+	return err
+}
+
+func (ch ChangeInfo) MarshalJSON() ([]byte, error) {
+	type plain ChangeInfo
+	p := plain(ch)
+	return marshalExtra(&p, ch.Extra)
+}
+
+func (rev *RevisionInfo) UnmarshalJSON(data []byte) error {
+	type plain RevisionInfo
+	extra, err := unmarshalExtra(data, (*plain)(rev))
+	rev.Extra = extra
+	return err
+}
+
+func (rev RevisionInfo) MarshalJSON() ([]byte, error) {
+	type plain RevisionInfo
+	p := plain(rev)
+	return marshalExtra(&p, rev.Extra)
+}
+
+func (c *CommentInfo) UnmarshalJSON(data []byte) error {
+	type plain CommentInfo
+	extra, err := unmarshalExtra(data, (*plain)(c))
+	c.Extra = extra
+	return err
+}
+
+func (c CommentInfo) MarshalJSON() ([]byte, error) {
+	type plain CommentInfo
+	p := plain(c)
+	return marshalExtra(&p, c.Extra)
+}
+
+// commentPlain is CommentInfo without its methods.
+type commentPlain CommentInfo
+
+// robotCommentPlain is RobotCommentInfo without the methods
+// promoted from its embedded CommentInfo, which would otherwise
+// handle the whole JSON object and drop the robot's own fields.
+// Its fields must match RobotCommentInfo's.
+type robotCommentPlain struct {
+	commentPlain
+	RobotID        string               `json:"robot_id"`
+	RobotRunID     string               `json:"robot_run_id"`
+	URL            string               `json:"url,omitempty"`
+	Properties     map[string]string    `json:"properties,omitempty"`
+	FixSuggestions []*FixSuggestionInfo `json:"fix_suggestions,omitempty"`
+}
+
+func (c *RobotCommentInfo) UnmarshalJSON(data []byte) error {
+	var p robotCommentPlain
+	extra, err := unmarshalExtra(data, &p)
+	*c = RobotCommentInfo{CommentInfo(p.commentPlain), p.RobotID, p.RobotRunID, p.URL, p.Properties, p.FixSuggestions}
+	c.Extra = extra
+	return err
+}
+
+func (c RobotCommentInfo) MarshalJSON() ([]byte, error) {
+	p := robotCommentPlain{commentPlain(c.CommentInfo), c.RobotID, c.RobotRunID, c.URL, c.Properties, c.FixSuggestions}
+	return marshalExtra(&p, c.Extra)
+}
+
+// unmarshalExtra unmarshals data into the struct pointed at by v
+// and returns the fields in data that v has no field for,
+// or nil if there are none.
+func unmarshalExtra(data []byte, v interface{}) (map[string]json.RawMessage, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	known := jsonFields(reflect.TypeOf(v).Elem())
+	var extra map[string]json.RawMessage
+	for k, raw := range all {
+		// Like encoding/json, match field names without regard to case.
+		if known[strings.ToLower(k)] {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]json.RawMessage)
+		}
+		extra[k] = raw
+	}
+	return extra, nil
+}
+
+// marshalExtra marshals the struct pointed at by v,
+// adding the fields in extra that v does not set itself.
+func marshalExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for k, raw := range extra {
+		if _, ok := all[k]; !ok {
+			all[k] = raw
+		}
+	}
+	return json.Marshal(all)
+}
+
+var jsonFieldCache struct {
+	sync.Mutex
+	m map[reflect.Type]map[string]bool
+}
+
+// jsonFields returns the set of lower-cased JSON names
+// of the fields in the struct type t,
+// including those of untagged embedded structs.
+func jsonFields(t reflect.Type) map[string]bool {
+	jsonFieldCache.Lock()
+	defer jsonFieldCache.Unlock()
+	if f, ok := jsonFieldCache.m[t]; ok {
+		return f
+	}
+	f := make(map[string]bool)
+	addJSONFields(f, t)
+	if jsonFieldCache.m == nil {
+		jsonFieldCache.m = make(map[reflect.Type]map[string]bool)
+	}
+	jsonFieldCache.m[t] = f
+	return f
+}
+
+// addJSONFields adds the lower-cased JSON names of the fields in t to f.
+func addJSONFields(f map[string]bool, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if j := strings.Index(tag, ","); j >= 0 {
+			tag = tag[:j]
+		}
+		if tag == "" && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addJSONFields(f, field.Type)
+			continue
+		}
+		if tag != "" {
+			name = tag
+		}
+		f[strings.ToLower(name)] = true
+	}
+}
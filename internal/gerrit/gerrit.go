@@ -8,16 +8,20 @@ package gerrit
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -29,23 +33,120 @@ type Client struct {
 	// HTTPClient optionally specifies an HTTP client to use
 	// instead of http.DefaultClient.
 	HTTPClient *http.Client
+
+	// UserAgent optionally specifies the User-Agent header
+	// to send with each request. If empty, DefaultUserAgent is used.
+	UserAgent string
+
+	// MaxBody optionally limits the size of successful response bodies.
+	// Reading past the limit fails with ErrBodyTooLarge.
+	// If zero, DefaultMaxBody is used; if negative, there is no limit.
+	MaxBody int64
+
+	// MaxRetries optionally specifies how many times to retry
+	// a GET request that fails with a transient error:
+	// a timeout, a reset or refused connection, a truncated response body,
+	// or a 502, 503, or 504 status from an overloaded server.
+	// Other errors, including 4xx statuses such as 429 Too Many Requests
+	// (see IsTooManyRequests), are not retried, and neither are
+	// requests with other methods, which may not be safe to repeat.
+	// If zero, requests are not retried.
+	MaxRetries int
+
+	// MaxErrorBody optionally limits how much of an error response body
+	// is kept in the HTTPError. If zero, 4 kB is kept.
+	MaxErrorBody int
+
+	// Header optionally specifies additional headers
+	// to send with each request.
+	Header http.Header
+
+	// OnRequest optionally specifies a function to call
+	// with the method and URL of each request before it is sent,
+	// for logging.
+	OnRequest func(method, url string)
+
+	// DryRun optionally turns the client into a dry run
+	// for previewing changes: if DryRun is non-nil, the client sends
+	// only GET requests, which do not change anything on the server.
+	// Instead of sending any other request, the client calls DryRun
+	// with its method, URL, and JSON body (nil if none)
+	// and then acts as if the server replied 204 No Content,
+	// so that the API call succeeds with a zero result.
+	DryRun func(method, url string, body []byte)
+
+	// Logf optionally specifies a function for logging
+	// the result and duration of each request, as well as retries,
+	// for diagnosing slow or failing requests. log.Printf works well.
+	// If nil, the client logs nothing.
+	Logf func(format string, args ...interface{})
+
+	// OnProgress optionally specifies a function to call
+	// after each page of a multi-page operation such as QueryChangesAll,
+	// with the number of results fetched so far (done) and the total.
+	// Gerrit does not report totals in advance, so total is -1
+	// until the last page arrives, when it equals done.
+	OnProgress func(done, total int)
+
+	// AccountCacheSize optionally enables a cache of the accounts
+	// returned by GetAccountInfo and LookupAccounts,
+	// holding at most that many accounts.
+	// If zero, accounts are not cached.
+	AccountCacheSize int
+
+	mu       sync.Mutex
+	version  string                  // cached result of ServerVersion
+	accounts map[string]*AccountInfo // account cache, keyed by ID, email, and username
+	accountQ []*AccountInfo          // cached accounts, oldest first, for eviction
 }
 
+// DefaultUserAgent is the User-Agent header sent by a Client
+// with an empty UserAgent field.
+const DefaultUserAgent = "rsc.io/gerrit"
+
+// DefaultMaxBody is the limit on response bodies
+// used by a Client with a zero MaxBody field.
+const DefaultMaxBody = 256 << 20
+
+// ErrBodyTooLarge is the error reported when reading
+// a response body longer than the client's MaxBody.
+var ErrBodyTooLarge = errors.New("gerrit: response body too large")
+
 // NewClient returns a new Gerrit client with the given URL prefix
 // and authentication mode.
-// The url should be just the scheme and hostname.
+// The prefix is the scheme and hostname, followed by the path
+// at which the server is hosted, if it is not the host root,
+// as in "https://gerrit.example.com/gerrit".
+// Authenticated requests insert "/a" after the whole prefix,
+// as in "https://gerrit.example.com/gerrit/a/changes/".
 // If auth is nil, a default is used, or requests are made unauthenticated.
-func NewClient(url string, auth Auth) *Client {
+func NewClient(prefix string, auth Auth) *Client {
 	if auth == nil {
 		// TODO(bradfitz): use GitCookies auth, once that exists
 		auth = NoAuth
 	}
+	// Drop any query or fragment, which would end up
+	// in the middle of the request URLs, and trailing slashes,
+	// which would double up with the leading slash of the API paths.
+	if u, err := url.Parse(prefix); err == nil && u.Host != "" {
+		u.RawQuery = ""
+		u.ForceQuery = false
+		u.Fragment = ""
+		prefix = u.String()
+	}
 	return &Client{
-		url:  strings.TrimSuffix(url, "/"),
+		url:  strings.TrimRight(prefix, "/"),
 		auth: auth,
 	}
 }
 
+// logf calls c.Logf, if set.
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
 func (c *Client) httpClient() *http.Client {
 	if c.HTTPClient != nil {
 		return c.HTTPClient
@@ -54,73 +155,293 @@ func (c *Client) httpClient() *http.Client {
 }
 
 func (c *Client) do(dst interface{}, method, path string, arg url.Values, body interface{}) error {
+	return c.doAuth(c.auth, dst, method, path, arg, body)
+}
+
+// doAuth is like do but authenticates the request using auth
+// instead of c.auth. Passing NoAuth makes an anonymous request,
+// without the "/a" prefix, even when c has credentials.
+func (c *Client) doAuth(auth Auth, dst interface{}, method, path string, arg url.Values, body interface{}) error {
+	return c.retry(method, func() error {
+		return c.doAuth1(auth, dst, method, path, arg, body)
+	})
+}
+
+// doAuth1 is like doAuth but makes only a single attempt.
+func (c *Client) doAuth1(auth Auth, dst interface{}, method, path string, arg url.Values, body interface{}) error {
+	res, err := c.sendAuth(auth, method, path, arg, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if dst == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	// The JSON response begins with an XSRF-defeating header
+	// like ")]}\n". Read that and skip it.
+	br := bufio.NewReader(res.Body)
+	if _, err := br.ReadSlice('\n'); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, dst)
+	if err != nil {
+		return fmt.Errorf("%s: %v", res.Request.URL, err)
+	}
+	return nil
+}
+
+// doRaw is like do but returns the response body as is,
+// for the few API calls that do not return JSON.
+func (c *Client) doRaw(method, path string, arg url.Values, body interface{}) ([]byte, error) {
+	var data []byte
+	err := c.retry(method, func() error {
+		res, err := c.send(method, path, arg, body)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		data, err = ioutil.ReadAll(res.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// retryDelay is the delay before the first retry of a request
+// (see Client.MaxRetries). Each later retry waits twice as long.
+const retryDelay = 500 * time.Millisecond
+
+// retry calls f, which makes a request with the given method,
+// and then calls it again, up to c.MaxRetries more times,
+// as long as the method is GET and f fails with a transient error.
+func (c *Client) retry(method string, f func() error) error {
+	for try := 0; ; try++ {
+		err := f()
+		if err == nil || method != "GET" || try >= c.MaxRetries || !isTransient(err) {
+			return err
+		}
+		c.logf("retrying after %v: %v", retryDelay<<uint(try), err)
+		time.Sleep(retryDelay << uint(try))
+	}
+}
+
+// isTransient reports whether err is likely to go away
+// if the request is retried: a timeout, a reset or refused
+// connection, a truncated response body, or a status reporting
+// an overloaded server. Other network errors, such as failed
+// DNS lookups or TLS handshakes, are not retried.
+func isTransient(err error) bool {
+	if he, ok := err.(*HTTPError); ok {
+		switch he.Res.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// DoJSON makes an arbitrary Gerrit REST API call,
+// for API calls that have no dedicated method.
+// The path must begin with "/" and is relative to the server URL,
+// as in "/projects/" or "/changes/123/revisions/current/review";
+// like the other methods, DoJSON adds the "/a" prefix
+// for authenticated clients. If body is non-nil, it is sent as JSON.
+// If dst is non-nil, DoJSON strips the XSRF-defeating prefix
+// from the response and decodes the JSON result into dst;
+// passing a *json.RawMessage returns the JSON unparsed.
+// If dst is nil, DoJSON discards the response body.
+func (c *Client) DoJSON(method, path string, query url.Values, body, dst interface{}) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid API path %q: must begin with /", path)
+	}
+	return c.do(dst, method, path, query, body)
+}
+
+// GetJSON is shorthand for c.DoJSON("GET", path, arg, nil, dst).
+func (c *Client) GetJSON(dst interface{}, path string, arg url.Values) error {
+	return c.DoJSON("GET", path, arg, nil, dst)
+}
+
+// send sends the request and checks the response status.
+// If send returns a nil error, the caller must close the response body.
+func (c *Client) send(method, path string, arg url.Values, body interface{}) (*http.Response, error) {
+	return c.sendAuth(c.auth, method, path, arg, body)
+}
+
+// sendAuth is like send but authenticates the request using auth
+// instead of c.auth.
+func (c *Client) sendAuth(auth Auth, method, path string, arg url.Values, body interface{}) (*http.Response, error) {
 	var bodyr io.Reader
+	var bodyJSON []byte
 	var contentType string
 	if body != nil {
 		v, err := json.MarshalIndent(body, "", "  ")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		bodyr = bytes.NewReader(v)
+		bodyJSON = v
 		contentType = "application/json"
 	}
 	// slashA is either "/a" (for authenticated requests) or "" for unauthenticated.
 	// See https://gerrit-review.googlesource.com/Documentation/rest-api.html#authentication
 	slashA := "/a"
-	if _, ok := c.auth.(noAuth); ok {
+	if _, ok := auth.(noAuth); ok {
 		slashA = ""
 	}
 	var err error
+	// c.url includes any path at which the server is hosted,
+	// so that "/a" lands after it, as in "/gerrit/a/changes/".
 	u := c.url + slashA + path
 	if arg != nil {
 		u += "?" + arg.Encode()
 	}
 	req, err := http.NewRequest(method, u, bodyr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
 	}
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
-	c.auth.setAuth(c, req)
+	auth.setAuth(c, req)
+	if c.DryRun != nil && method != "GET" {
+		c.DryRun(method, u, bodyJSON)
+		return &http.Response{
+			Status:     "204 No Content",
+			StatusCode: http.StatusNoContent,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	if c.OnRequest != nil {
+		c.OnRequest(method, u)
+	}
+	start := time.Now()
 	res, err := c.httpClient().Do(req)
 	if err != nil {
-		return err
+		c.logf("%s %s: %v (%.3fs)", method, u, err, time.Since(start).Seconds())
+		return nil, err
 	}
-	defer res.Body.Close()
+	c.logf("%s %s: %s (%.3fs)", method, u, res.Status, time.Since(start).Seconds())
 
 	if res.StatusCode/10 != http.StatusOK/10 {
-		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
-		fmt.Fprintf(os.Stderr, "%s ==> %v\n", u, res.Status)
-		return fmt.Errorf("HTTP status %s; %s", res.Status, body)
+		max := c.MaxErrorBody
+		if max == 0 {
+			max = 4 << 10
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, int64(max)))
+		res.Body.Close()
+		return nil, &HTTPError{Res: res, Body: body}
 	}
-
-	if dst == nil {
-		return nil
+	max := c.MaxBody
+	if max == 0 {
+		max = DefaultMaxBody
+	}
+	if max > 0 {
+		res.Body = &limitedBody{res.Body, max}
 	}
+	return res, nil
+}
 
-	// The JSON response begins with an XSRF-defeating header
-	// like ")]}\n". Read that and skip it.
-	br := bufio.NewReader(res.Body)
-	if _, err := br.ReadSlice('\n'); err != nil {
-		return err
+// A limitedBody is a response body that fails with ErrBodyTooLarge
+// after n more bytes.
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		// Distinguish a body of exactly the limit from a longer one.
+		var buf [1]byte
+		n, err := b.ReadCloser.Read(buf[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
 	}
-	data, err := ioutil.ReadAll(br)
-	if err != nil {
-		return err
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
 	}
-	/*
-		if strings.HasSuffix(path, "/diff") {
-			fmt.Printf("%s ==>\n%s\n", u, data)
-		}
-	*/
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	return n, err
+}
 
-	err = json.Unmarshal(data, dst)
-	if err != nil {
-		fmt.Printf("%s ==> [%v]\n%s\n", u, err, data)
-		return fmt.Errorf("%s: %v", u, err)
-	}
-	return nil
+// An HTTPError is the error returned when a Gerrit API call
+// fails with an HTTP error status.
+type HTTPError struct {
+	Res  *http.Response
+	Body []byte // prefix of the response body (see Client.MaxErrorBody)
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s: HTTP status %s; %s", e.Res.Request.Method, e.Res.Request.URL, e.Res.Status, bytes.TrimSpace(e.Body))
+}
+
+// IsConflict reports whether err is an HTTPError with status 409 Conflict,
+// which Gerrit uses to report that a change is not in a state that
+// permits the requested operation, such as restoring a change that
+// is not abandoned.
+func IsConflict(err error) bool {
+	he, ok := err.(*HTTPError)
+	return ok && he.Res.StatusCode == http.StatusConflict
+}
+
+// IsNotFound reports whether err is an HTTPError with status 404 Not Found.
+func IsNotFound(err error) bool {
+	he, ok := err.(*HTTPError)
+	return ok && he.Res.StatusCode == http.StatusNotFound
+}
+
+// IsForbidden reports whether err is an HTTPError with status 403 Forbidden,
+// which Gerrit uses to report that the caller lacks permission
+// for the requested operation.
+func IsForbidden(err error) bool {
+	he, ok := err.(*HTTPError)
+	return ok && he.Res.StatusCode == http.StatusForbidden
+}
+
+// IsUnauthorized reports whether err is an HTTPError
+// with status 401 Unauthorized, which Gerrit uses to report
+// that it rejected the client's credentials.
+func IsUnauthorized(err error) bool {
+	he, ok := err.(*HTTPError)
+	return ok && he.Res.StatusCode == http.StatusUnauthorized
+}
+
+// IsTooManyRequests reports whether err is an HTTPError
+// with status 429 Too Many Requests, which Gerrit uses
+// to ask clients to slow down.
+func IsTooManyRequests(err error) bool {
+	he, ok := err.(*HTTPError)
+	return ok && he.Res.StatusCode == http.StatusTooManyRequests
 }
 
 // ChangeInfo is a Gerrit data structure.
@@ -170,6 +491,21 @@ type ChangeInfo struct {
 	// Whether the change can be merged.
 	Mergeable bool `json:"mergeable"`
 
+	// Whether the change is marked as work in progress.
+	WorkInProgress bool `json:"work_in_progress"`
+
+	// Whether the change has been approved by the project submit rules.
+	// Only set if SUBMITTABLE is requested.
+	Submittable bool `json:"submittable"`
+
+	// The results of evaluating the change's submit requirements.
+	// Only set if SUBMIT_REQUIREMENTS is requested
+	// (supported by Gerrit 3.5 and later).
+	SubmitRequirements []*SubmitRequirementResultInfo `json:"submit_requirements,omitempty"`
+
+	// The legacy submit requirements, set by Gerrit 2.16 through 3.x.
+	Requirements []*Requirement `json:"requirements,omitempty"`
+
 	// Number of inserted lines.
 	Insertions int `json:"insertions"`
 
@@ -179,6 +515,10 @@ type ChangeInfo struct {
 	// The owner of the change.
 	Owner *AccountInfo `json:"owner"`
 
+	// The assignee of the change.
+	// Not set if the change has no assignee.
+	Assignee *AccountInfo `json:"assignee"`
+
 	// Actions the caller might be able to perform on this revision,
 	// keyed by "view name" (TODO what is that?).
 	Actions map[string]*ActionInfo `json:"actions"`
@@ -191,6 +531,17 @@ type ChangeInfo struct {
 	// Only set if DETAILED_LABELS are requested.
 	PermittedLabels map[string][]string `json:"permitted_labels"`
 
+	// The reviewers of the change, as a map from reviewer state
+	// (REVIEWER, CC, or REMOVED) to the accounts in that state.
+	// Only set if DETAILED_LABELS are requested.
+	Reviewers map[string][]*AccountInfo `json:"reviewers"`
+
+	// The accounts in the attention set, the users expected
+	// to act on the change next, keyed by numeric account ID.
+	// Not set if the attention set is empty
+	// or the server predates attention sets (Gerrit 3.3).
+	AttentionSet map[string]*AttentionSetInfo `json:"attention_set,omitempty"`
+
 	// Reviewers that can be removed by the calling user.
 	// Only set if DETAILED_LABELS are requested.
 	RemovableReviewers []*AccountInfo `json:"removable_reviewers"`
@@ -206,6 +557,16 @@ type ChangeInfo struct {
 	// Revisions indexed by patch set commit ID.
 	// Only set if CURRENT_REVISION or ALL_REVISIONS are requested.
 	Revisions map[string]*RevisionInfo `json:"revisions"`
+
+	// Whether the query would deliver more results if not limited.
+	// Only set on the last change that is returned by a query.
+	MoreChanges bool `json:"_more_changes"`
+
+	// Extra holds the fields Gerrit sent that have no field
+	// in this struct, keyed by JSON name, and they are sent back
+	// when the struct is marshaled. It lets callers use fields
+	// that this package does not yet know about.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // ActionInfo describes a REST API call the client can make to manipulate a resource.
@@ -232,6 +593,62 @@ type ActionInfo struct {
 	Enabled bool `json:"enabled"`
 }
 
+// The status of a submit requirement,
+// in a SubmitRequirementResultInfo or SubmitRequirementExpressionInfo.
+type SubmitRequirementStatus string
+
+const (
+	SubmitRequirementSatisfied     SubmitRequirementStatus = "SATISFIED"
+	SubmitRequirementUnsatisfied   SubmitRequirementStatus = "UNSATISFIED"
+	SubmitRequirementOverridden    SubmitRequirementStatus = "OVERRIDDEN"
+	SubmitRequirementNotApplicable SubmitRequirementStatus = "NOT_APPLICABLE"
+	SubmitRequirementError         SubmitRequirementStatus = "ERROR"
+	SubmitRequirementForced        SubmitRequirementStatus = "FORCED"
+)
+
+// Blocking reports whether a requirement with status s
+// prevents the change from being submitted.
+func (s SubmitRequirementStatus) Blocking() bool {
+	switch s {
+	case SubmitRequirementSatisfied, SubmitRequirementOverridden, SubmitRequirementNotApplicable, SubmitRequirementForced:
+		return false
+	}
+	return true
+}
+
+// SubmitRequirementResultInfo describes the result of evaluating
+// a submit requirement on a change.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#submit-requirement-result-info
+type SubmitRequirementResultInfo struct {
+	Name                           string                           `json:"name"`
+	Description                    string                           `json:"description,omitempty"`
+	Status                         SubmitRequirementStatus          `json:"status"`
+	IsLegacy                       bool                             `json:"is_legacy,omitempty"`
+	ApplicabilityExpressionResult  *SubmitRequirementExpressionInfo `json:"applicability_expression_result,omitempty"`
+	SubmittabilityExpressionResult *SubmitRequirementExpressionInfo `json:"submittability_expression_result,omitempty"`
+	OverrideExpressionResult       *SubmitRequirementExpressionInfo `json:"override_expression_result,omitempty"`
+}
+
+// SubmitRequirementExpressionInfo describes the result of evaluating
+// one of the expressions in a submit requirement.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#submit-requirement-expression-info
+type SubmitRequirementExpressionInfo struct {
+	Expression   string                  `json:"expression,omitempty"`
+	Fulfilled    bool                    `json:"fulfilled"`
+	Status       SubmitRequirementStatus `json:"status,omitempty"`
+	PassingAtoms []string                `json:"passing_atoms,omitempty"`
+	FailingAtoms []string                `json:"failing_atoms,omitempty"`
+	ErrorMessage string                  `json:"error_message,omitempty"`
+}
+
+// Requirement is a legacy submit requirement.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#requirement
+type Requirement struct {
+	Status       string `json:"status"` // "OK", "NOT_READY", or "RULE_ERROR"
+	FallbackText string `json:"fallback_text"`
+	Type         string `json:"type"`
+}
+
 type AccountInfo struct {
 	// The numeric ID of the account.
 	NumericID int64 `json:"_account_id"`
@@ -252,6 +669,10 @@ type AccountInfo struct {
 	// to the approval values (“-2”, “-1”, “0”, “+1”, “+2”).
 	// For use when AccountInfo is being used as ReviewerInfo.
 	Approvals map[string]string `json:"approvals,omitempty"`
+
+	// Whether the query would deliver more results if not limited.
+	// Only set on the last account that is returned by a query.
+	MoreAccounts bool `json:"_more_accounts,omitempty"`
 }
 
 func (ai *AccountInfo) Equal(v *AccountInfo) bool {
@@ -267,6 +688,10 @@ type ChangeMessageInfo struct {
 	Time           TimeStamp    `json:"date"`
 	Message        string       `json:"message"`
 	RevisionNumber int          `json:"_revision_number"`
+
+	// Tag is the tag given when the message was posted, if any.
+	// Tags starting with "autogenerated:" mark messages posted by tools.
+	Tag string `json:"tag,omitempty"`
 }
 
 // The LabelInfo entity contains information about a label on a
@@ -325,6 +750,102 @@ type LabelInfo struct {
 	Values map[string]string `json:"values"`
 }
 
+// AllowedValues returns the values allowed for the label, in increasing order.
+// It returns nil if the values are unknown,
+// because DETAILED_LABELS was not requested.
+func (l LabelInfo) AllowedValues() []int {
+	return labelValues(l.Values)
+}
+
+// A VoteError reports a vote that the caller is not permitted to cast.
+type VoteError struct {
+	Label  string // label name, like "Code-Review"
+	Value  int    // proposed vote
+	Reason string // why the vote is not permitted, like "max +1"
+}
+
+func (e *VoteError) Error() string {
+	v := fmt.Sprintf("%+d", e.Value)
+	if e.Value == 0 {
+		v = "0"
+	}
+	return fmt.Sprintf("you cannot set %s%s (%s)", e.Label, v, e.Reason)
+}
+
+// CheckVotes checks the proposed votes, a map from label name to value,
+// against the values the caller is permitted to set on ch,
+// returning an error for each vote that is not permitted,
+// in label order.
+// The permitted values are only known if ch was fetched
+// with DETAILED_LABELS; if they are unknown, CheckVotes returns nil
+// and leaves the decision to the server.
+func CheckVotes(ch *ChangeInfo, votes map[string]int) []*VoteError {
+	if ch.PermittedLabels == nil {
+		return nil
+	}
+	var labels []string
+	for label := range votes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var errs []*VoteError
+	for _, label := range labels {
+		n := votes[label]
+		if _, ok := ch.Labels[label]; !ok {
+			errs = append(errs, &VoteError{label, n, "no such label on change"})
+			continue
+		}
+		permitted := labelValues(stringSet(ch.PermittedLabels[label]))
+		if len(permitted) == 0 {
+			errs = append(errs, &VoteError{label, n, "not permitted to vote on label"})
+			continue
+		}
+		min, max := permitted[0], permitted[len(permitted)-1]
+		switch {
+		case n > max:
+			errs = append(errs, &VoteError{label, n, fmt.Sprintf("max %+d", max)})
+		case n < min:
+			errs = append(errs, &VoteError{label, n, fmt.Sprintf("min %+d", min)})
+		default:
+			ok := false
+			for _, x := range permitted {
+				if x == n {
+					ok = true
+				}
+			}
+			if !ok {
+				errs = append(errs, &VoteError{label, n, "not a value of the label"})
+			}
+		}
+	}
+	return errs
+}
+
+// stringSet returns a map with the strings in list as its keys.
+func stringSet(list []string) map[string]string {
+	m := make(map[string]string)
+	for _, s := range list {
+		m[s] = ""
+	}
+	return m
+}
+
+// labelValues returns the numeric keys of a label's values map,
+// in increasing order.
+func labelValues(values map[string]string) []int {
+	var list []int
+	for v := range values {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		list = append(list, n)
+	}
+	sort.Ints(list)
+	return list
+}
+
 type ApprovalInfo struct {
 	AccountInfo
 	Value int       `json:"value"`
@@ -344,7 +865,9 @@ type RevisionInfo struct {
 	Fetch          map[string]*FetchInfo `json:"fetch"`
 	Commit         *CommitInfo           `json:"commit"`
 	Files          map[string]*FileInfo  `json:"files"`
-	// TODO: more
+
+	// Extra holds the fields not listed above; see ChangeInfo.Extra.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CommitInfo struct {
@@ -353,6 +876,10 @@ type CommitInfo struct {
 	CommitID  string        `json:"commit"`
 	Subject   string        `json:"subject"`
 	Message   string        `json:"message"`
+
+	// The parent commits of this commit.
+	// In each parent only CommitID and Subject are set.
+	Parents []CommitInfo `json:"parents"`
 }
 
 type GitPersonInfo struct {
@@ -368,6 +895,8 @@ type FileInfo struct {
 	OldPath       string `json:"old_path"`
 	LinesInserted int    `json:"lines_inserted"`
 	LinesDeleted  int    `json:"lines_deleted"`
+	Size          int64  `json:"size"`       // size of the file in bytes
+	SizeDelta     int64  `json:"size_delta"` // change in size of the file in bytes
 }
 
 type FetchInfo struct {
@@ -382,11 +911,21 @@ type QueryChangesOpt struct {
 	// If 0, the 'n' parameter is not sent to Gerrit.
 	N int
 
+	// Start is the number of results to skip,
+	// for fetching the results of a query a page at a time.
+	// If 0, the 'start' parameter is not sent to Gerrit.
+	Start int
+
 	// Fields are optional fields to also return.
 	// Example strings include "ALL_REVISIONS", "LABELS", "MESSAGES".
 	// For a complete list, see:
 	// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#change-info
 	Fields []string
+
+	// Anonymous makes the query without authentication,
+	// even if the client has credentials, so that it sees
+	// only the changes visible to anonymous users.
+	Anonymous bool
 }
 
 func condInt(n int) []string {
@@ -408,15 +947,56 @@ func (c *Client) QueryChanges(q string, opts ...QueryChangesOpt) ([]*ChangeInfo,
 	default:
 		return nil, errors.New("only 1 option struct supported")
 	}
+	auth := c.auth
+	if opt.Anonymous {
+		auth = NoAuth
+	}
 	var changes []*ChangeInfo
-	err := c.do(&changes, "GET", "/changes/", url.Values{
-		"q": {q},
-		"n": condInt(opt.N),
-		"o": opt.Fields,
+	err := c.doAuth(auth, &changes, "GET", "/changes/", url.Values{
+		"q":     {q},
+		"n":     condInt(opt.N),
+		"start": condInt(opt.Start),
+		"o":     opt.Fields,
 	}, nil)
 	return changes, err
 }
 
+// QueryChangesAll is like QueryChanges but fetches all the results,
+// a page at a time, calling c.OnProgress after each page.
+// The page size is opt.N, or 500 if opt.N is 0,
+// and the results start at opt.Start.
+func (c *Client) QueryChangesAll(q string, opts ...QueryChangesOpt) ([]*ChangeInfo, error) {
+	var opt QueryChangesOpt
+	switch len(opts) {
+	case 0:
+	case 1:
+		opt = opts[0]
+	default:
+		return nil, errors.New("only 1 option struct supported")
+	}
+	if opt.N == 0 {
+		opt.N = 500
+	}
+	var all []*ChangeInfo
+	for {
+		chs, err := c.QueryChanges(q, opt)
+		if err != nil {
+			return all, err
+		}
+		all = append(all, chs...)
+		opt.Start += len(chs)
+		if len(chs) == 0 || !chs[len(chs)-1].MoreChanges {
+			if c.OnProgress != nil {
+				c.OnProgress(len(all), len(all))
+			}
+			return all, nil
+		}
+		if c.OnProgress != nil {
+			c.OnProgress(len(all), -1)
+		}
+	}
+}
+
 // GetChangeDetail retrieves a change with labels, detailed labels, detailed
 // accounts, and messages.
 // For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-change-detail
@@ -429,8 +1009,12 @@ func (c *Client) GetChangeDetail(changeID string, opts ...QueryChangesOpt) (*Cha
 	default:
 		return nil, errors.New("only 1 option struct supported")
 	}
+	auth := c.auth
+	if opt.Anonymous {
+		auth = NoAuth
+	}
 	var change ChangeInfo
-	err := c.do(&change, "GET", "/changes/"+changeID+"/detail", url.Values{
+	err := c.doAuth(auth, &change, "GET", "/changes/"+changeID+"/detail", url.Values{
 		"o": opt.Fields,
 	}, nil)
 	if err != nil {
@@ -439,6 +1023,38 @@ func (c *Client) GetChangeDetail(changeID string, opts ...QueryChangesOpt) (*Cha
 	return &change, nil
 }
 
+// ListChangeMessages lists all the messages of a change,
+// without the rest of the change detail.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#list-change-messages
+func (c *Client) ListChangeMessages(changeID string) ([]*ChangeMessageInfo, error) {
+	var list []*ChangeMessageInfo
+	err := c.do(&list, "GET", "/changes/"+url.QueryEscape(changeID)+"/messages", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DeleteChangeMessage redacts a change message, replacing its text
+// with a placeholder that records who deleted it and the given reason.
+// It returns the updated message.
+// Only administrators are allowed to delete change messages.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#delete-change-message
+func (c *Client) DeleteChangeMessage(changeID, messageID, reason string) (*ChangeMessageInfo, error) {
+	req := struct {
+		Reason string `json:"reason,omitempty"`
+	}{
+		reason,
+	}
+
+	var out ChangeMessageInfo
+	err := c.do(&out, "POST", "/changes/"+url.QueryEscape(changeID)+"/messages/"+url.QueryEscape(messageID)+"/delete", nil, &req)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
 // A ReviewInput contains information for adding a review to a revision.
 type ReviewInput struct {
 	// Text to be added as review comment.
@@ -471,6 +1087,10 @@ type ReviewInput struct {
 	// If not set, the default is ALL.
 	Notify string `json:"notify,omitempty"`
 
+	// Tag to apply to the review message, such as "autogenerated:trybot".
+	// Gerrit's UI can hide messages with tags starting with "autogenerated:".
+	Tag string `json:"tag,omitempty"`
+
 	// The review should be posted on behalf of this account.
 	// To use this option the caller must have been granted labelAs-NAME
 	// permission for all keys of labels.
@@ -481,6 +1101,12 @@ type reviewInfo struct {
 	Labels map[string]int `json:"labels,omitempty"`
 }
 
+// CurrentRevision is a revision ID that Gerrit takes to mean
+// the current patch set of a change. It can be passed as the revision ID
+// to any method that takes one, so that callers wanting only the
+// latest patch set need not look up ChangeInfo.CurrentRevision first.
+const CurrentRevision = "current"
+
 // SetReview posts a review message on a change.
 //
 // For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#set-review
@@ -492,18 +1118,199 @@ func (c *Client) SetReview(changeID, revision string, review *ReviewInput) error
 		nil, review)
 }
 
+// SetReviewNotify is like SetReview but overrides review.Notify
+// with notify, which is one of NONE, OWNER, OWNER_REVIEWERS, and ALL.
+// It does not modify review.
+func (c *Client) SetReviewNotify(changeID, revision, notify string, review *ReviewInput) error {
+	r := *review
+	r.Notify = notify
+	return c.SetReview(changeID, revision, &r)
+}
+
+// GetCommit retrieves a parsed commit of a revision.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-commit
+func (c *Client) GetCommit(changeID, revID string) (*CommitInfo, error) {
+	var commit CommitInfo
+	err := c.do(&commit, "GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/commit", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &commit, nil
+}
+
+// GetPatch retrieves the formatted patch for a revision,
+// in the mailbox format produced by git format-patch.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-patch
+func (c *Client) GetPatch(changeID, revID string) ([]byte, error) {
+	data, err := c.doRaw("GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/patch", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The patch is sent base64-encoded.
+	patch, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding patch: %v", err)
+	}
+	return patch, nil
+}
+
+// GetPatchZip is like GetPatch but returns the patch
+// as a zip file containing a single patch file.
+func (c *Client) GetPatchZip(changeID, revID string) ([]byte, error) {
+	return c.doRaw("GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/patch", url.Values{"zip": {""}}, nil)
+}
+
 // GetAccountInfo gets the specified account's information from Gerrit.
 // For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-accounts.html#get-account
 // The accountID is https://gerrit-review.googlesource.com/Documentation/rest-api-accounts.html#account-id
 //
 // Note that getting "self" is a good way to validate host access, since it only requires peeker
 // access to the host, not to any particular repository.
+//
+// If the client has an account cache (see AccountCacheSize),
+// GetAccountInfo checks it first and adds the result to it.
 func (c *Client) GetAccountInfo(accountID string) (AccountInfo, error) {
+	if a := c.cachedAccount(accountID); a != nil {
+		return *a, nil
+	}
 	var res AccountInfo
 	err := c.do(&res, "GET", fmt.Sprintf("/accounts/%s", accountID), nil, nil)
+	if err == nil {
+		c.cacheAccount(&res, accountID)
+	}
 	return res, err
 }
 
+// LookupAccounts returns the accounts with the given account IDs,
+// which may be numeric IDs, email addresses, or user names,
+// as a map keyed by account ID. IDs not matching exactly one account
+// are omitted from the map.
+// It takes the accounts in the client's account cache (see AccountCacheSize)
+// from there and looks up the rest in batches with QueryAccounts,
+// making far fewer calls than GetAccountInfo would for each.
+func (c *Client) LookupAccounts(accountIDs []string) (map[string]*AccountInfo, error) {
+	const batch = 10 // IDs per query, to keep URLs short
+
+	found := make(map[string]*AccountInfo)
+	var need []string
+	for _, id := range accountIDs {
+		if a := c.cachedAccount(id); a != nil {
+			found[id] = a
+		} else if id != "" {
+			need = append(need, id)
+		}
+	}
+	for len(need) > 0 {
+		ids := need
+		if len(ids) > batch {
+			ids = ids[:batch]
+		}
+		need = need[len(ids):]
+
+		var q []string
+		for _, id := range ids {
+			q = append(q, accountPredicate(id))
+		}
+		list, err := c.QueryAccounts(strings.Join(q, " OR "), 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			var match *AccountInfo
+			for _, a := range list {
+				if accountMatches(a, id) {
+					if match != nil {
+						match = nil // ambiguous
+						break
+					}
+					match = a
+				}
+			}
+			if match != nil {
+				found[id] = match
+				c.cacheAccount(match, id)
+			}
+		}
+	}
+	return found, nil
+}
+
+// accountPredicate returns the account search predicate
+// matching the account ID id.
+func accountPredicate(id string) string {
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+		// A bare number matches the numeric account ID.
+		return id
+	}
+	if strings.Contains(id, "@") {
+		return "email:" + strconv.Quote(id)
+	}
+	return "username:" + strconv.Quote(id)
+}
+
+// accountMatches reports whether the account a has the account ID id.
+func accountMatches(a *AccountInfo, id string) bool {
+	return id == fmt.Sprint(a.NumericID) ||
+		strings.EqualFold(id, a.Email) ||
+		id == a.Username
+}
+
+// cachedAccount returns the cached account with the account ID id,
+// or nil if there is none.
+func (c *Client) cachedAccount(id string) *AccountInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accounts[strings.ToLower(id)]
+}
+
+// cacheAccount adds the account a to the account cache, if any,
+// under its numeric ID, email address, and user name, and also id,
+// the ID by which it was requested (like "self").
+// If the cache is full, the oldest account is evicted.
+func (c *Client) cacheAccount(a *AccountInfo, id string) {
+	if c.AccountCacheSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accounts == nil {
+		c.accounts = make(map[string]*AccountInfo)
+	}
+	if len(c.accountQ) >= c.AccountCacheSize {
+		old := c.accountQ[0]
+		c.accountQ = c.accountQ[1:]
+		for k, v := range c.accounts {
+			if v == old {
+				delete(c.accounts, k)
+			}
+		}
+	}
+	c.accountQ = append(c.accountQ, a)
+	for _, k := range []string{id, fmt.Sprint(a.NumericID), a.Email, a.Username} {
+		if k != "" && k != "0" {
+			c.accounts[strings.ToLower(k)] = a
+		}
+	}
+}
+
+// QueryAccounts queries accounts, returning at most n results
+// (or the server's default limit if n is 0).
+// If there are more results, the last account returned has MoreAccounts set.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-accounts.html#query-account
+// For the query syntax, see https://gerrit-review.googlesource.com/Documentation/user-search-accounts.html
+func (c *Client) QueryAccounts(query string, n int) ([]*AccountInfo, error) {
+	var list []*AccountInfo
+	err := c.do(&list, "GET", "/accounts/", url.Values{
+		"q": {query},
+		"n": condInt(n),
+		"o": {"DETAILS"},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
 type TimeStamp time.Time
 
 // Gerrit's timestamp layout is like time.RFC3339Nano, but with a space instead of the "T",
@@ -511,7 +1318,7 @@ type TimeStamp time.Time
 const timeStampLayout = `"2006-01-02 15:04:05.999999999"`
 
 func (ts *TimeStamp) MarshalJSON() ([]byte, error) {
-	return []byte(ts.Time().Local().Format(timeStampLayout)), nil
+	return []byte(ts.Time().UTC().Format(timeStampLayout)), nil
 }
 
 func (ts *TimeStamp) UnmarshalJSON(p []byte) error {
@@ -623,8 +1430,19 @@ type GetDiffOpt struct {
 	Intraline bool
 
 	// The base parameter can be specified to control the base patch set from which the diff should be generated.
+	// Base is a revision ID: usually the commit ID of another patch set of the same change.
+	// It is passed to Gerrit as is, so it can also be a patch set number or any other commit ID.
+	// Gerrit documents Base only as a patch set of the same change, and the 2.x and 3.x
+	// servers look it up among the change's patch sets, by number or commit ID,
+	// answering 404 Not Found for any other commit. Diffing against an arbitrary commit
+	// therefore needs a server extended to allow it.
 	Base string
 
+	// For merge commits, Parent selects the parent (numbered from 1)
+	// against which the diff should be generated.
+	// Omitted if 0, meaning the first parent. Ignored if Base is set.
+	Parent int
+
 	// If the weblinks-only parameter is specified, only the diff web links are returned.
 	WebLinksOnly bool
 
@@ -634,10 +1452,46 @@ type GetDiffOpt struct {
 	// The context parameter can be specified to control the number of lines of surrounding context in the diff. Valid values are -1 (ALL) or number of lines.
 	// Omitted if 0.
 	Context int
+
+	// MaxLines, if positive, limits the size of files to diff.
+	// If either side of the file has more than MaxLines lines,
+	// the diff fails with an error instead of being loaded into memory.
+	MaxLines int
 }
 
 // GetDiff gets the diff of a file from a certain revision.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-diff
 func (c *Client) GetDiff(changeID, revID, filePath string, opts ...GetDiffOpt) (*DiffInfo, error) {
+	var diff *DiffInfo
+	err := c.retry("GET", func() error {
+		var content []*DiffContent
+		d, err := c.GetDiffFunc(changeID, revID, filePath, func(dc *DiffContent) error {
+			content = append(content, dc)
+			return nil
+		}, opts...)
+		if err != nil {
+			return err
+		}
+		d.Content = content
+		diff = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// GetDiffFunc is like GetDiff but streams the diff content:
+// instead of collecting the content in the returned DiffInfo,
+// it calls fn for each DiffContent entry as it is decoded.
+// If fn returns an error, GetDiffFunc stops and returns that error.
+// Using GetDiffFunc, very large diffs can be processed
+// without holding the entire diff in memory.
+// Unlike GetDiff, GetDiffFunc does not retry transient errors
+// (see Client.MaxRetries), because fn may already have seen
+// part of the diff.
+func (c *Client) GetDiffFunc(changeID, revID, filePath string, fn func(*DiffContent) error, opts ...GetDiffOpt) (*DiffInfo, error) {
 	var opt GetDiffOpt
 	switch len(opts) {
 	case 0:
@@ -646,13 +1500,14 @@ func (c *Client) GetDiff(changeID, revID, filePath string, opts ...GetDiffOpt) (
 	default:
 		return nil, errors.New("only 1 option struct supported")
 	}
-	var diff DiffInfo
 	v := url.Values{}
 	if opt.Intraline {
 		v["intraline"] = []string{""}
 	}
 	if opt.Base != "" {
 		v["base"] = []string{opt.Base}
+	} else if opt.Parent > 0 {
+		v["parent"] = []string{fmt.Sprint(opt.Parent)}
 	}
 	if opt.WebLinksOnly {
 		v["weblinks-only"] = []string{""}
@@ -667,13 +1522,166 @@ func (c *Client) GetDiff(changeID, revID, filePath string, opts ...GetDiffOpt) (
 		v["context"] = []string{fmt.Sprint(opt.Context)}
 	}
 
-	err := c.do(&diff, "GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/files/"+url.QueryEscape(filePath)+"/diff", v, nil)
+	res, err := c.send("GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/files/"+url.QueryEscape(filePath)+"/diff", v, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// Skip the XSRF-defeating header, as in do.
+	br := bufio.NewReader(res.Body)
+	if _, err := br.ReadSlice('\n'); err != nil {
+		return nil, err
+	}
+	u := res.Request.URL.String()
+	dec := json.NewDecoder(br)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	// Decode everything but the content into fields,
+	// and then fields into the DiffInfo.
+	// Gerrit sends the file metadata before the content,
+	// so the MaxLines check happens before any content is read.
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", u, err)
+		}
+		key, _ := tok.(string)
+		if key != "content" {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("%s: %w", u, err)
+			}
+			fields[key] = raw
+			if opt.MaxLines > 0 && (key == "meta_a" || key == "meta_b") {
+				var meta DiffFileMetaInfo
+				if err := json.Unmarshal(raw, &meta); err != nil {
+					return nil, fmt.Errorf("%s: %w", u, err)
+				}
+				if meta.Lines > opt.MaxLines {
+					return nil, fmt.Errorf("%s: file too large to diff (%d lines, limit %d)", meta.Name, meta.Lines, opt.MaxLines)
+				}
+			}
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, fmt.Errorf("%s: %w", u, err)
+		}
+		for dec.More() {
+			dc := new(DiffContent)
+			if err := dec.Decode(dc); err != nil {
+				return nil, fmt.Errorf("%s: %w", u, err)
+			}
+			if err := fn(dc); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, fmt.Errorf("%s: %w", u, err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+
+	data, err := json.Marshal(fields)
 	if err != nil {
 		return nil, err
 	}
+	var diff DiffInfo
+	if err := json.Unmarshal(data, &diff); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
 	return &diff, nil
 }
 
+// expectDelim reads the next JSON token from dec
+// and checks that it is the delimiter d.
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("unexpected JSON token %v, want %v", tok, d)
+	}
+	return nil
+}
+
+// ListFilesOpt are options for ListFiles.
+type ListFilesOpt struct {
+	// Base is the revision ID of the base patch set
+	// against which the files should be compared.
+	// If empty, the files are compared against the parent commit.
+	Base string
+
+	// Reviewed restricts the result to the files that
+	// the caller has marked as reviewed.
+	// Gerrit only sends the file names in that case,
+	// so the FileInfo values are all zero.
+	Reviewed bool
+}
+
+// ListFiles lists the files that were modified, added or deleted in a revision.
+// It returns a map keyed by file name.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#list-files
+func (c *Client) ListFiles(changeID, revID string, opts ...ListFilesOpt) (map[string]*FileInfo, error) {
+	var opt ListFilesOpt
+	switch len(opts) {
+	case 0:
+	case 1:
+		opt = opts[0]
+	default:
+		return nil, errors.New("only 1 option struct supported")
+	}
+	v := url.Values{}
+	if opt.Base != "" {
+		v["base"] = []string{opt.Base}
+	}
+	path := "/changes/" + url.QueryEscape(changeID) + "/revisions/" + url.QueryEscape(revID) + "/files/"
+	if opt.Reviewed {
+		list, err := c.ListReviewedFiles(changeID, revID)
+		if err != nil {
+			return nil, err
+		}
+		files := make(map[string]*FileInfo)
+		for _, name := range list {
+			files[name] = new(FileInfo)
+		}
+		return files, nil
+	}
+	var files map[string]*FileInfo
+	if err := c.do(&files, "GET", path, v, nil); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ListReviewedFiles lists the files in a revision
+// that the caller has marked as reviewed.
+func (c *Client) ListReviewedFiles(changeID, revID string) ([]string, error) {
+	var list []string
+	err := c.do(&list, "GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/files/", url.Values{"reviewed": {""}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// SetReviewed marks a file in a revision as reviewed by the caller.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#set-reviewed
+func (c *Client) SetReviewed(changeID, revID, filePath string) error {
+	return c.do(nil, "PUT", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/files/"+url.QueryEscape(filePath)+"/reviewed", nil, nil)
+}
+
+// DeleteReviewed clears the caller's reviewed mark on a file in a revision.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#delete-reviewed
+func (c *Client) DeleteReviewed(changeID, revID, filePath string) error {
+	return c.do(nil, "DELETE", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/files/"+url.QueryEscape(filePath)+"/reviewed", nil, nil)
+}
+
 // The CommentInfo entity contains information about an inline comment.
 // This struct is also used in place of a Gerrit CommentInput.
 type CommentInfo struct {
@@ -713,6 +1721,17 @@ type CommentInfo struct {
 	// The author of the message as an AccountInfo entity.
 	// Unset for draft comments, assumed to be the calling user.
 	Author *AccountInfo `json:"author,omitempty"`
+
+	// Whether or not the comment must be addressed by the user.
+	// The state of resolution of a comment thread is stored
+	// in the last comment in that thread chronologically.
+	// When creating a comment, if not set, the default is false
+	// for a new thread, or else the value of the comment
+	// it is replying to.
+	Unresolved *bool `json:"unresolved,omitempty"`
+
+	// Extra holds the fields not listed above; see ChangeInfo.Extra.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // IsDraft reports whether the comment is a draft.
@@ -720,6 +1739,14 @@ func (c *CommentInfo) IsDraft() bool {
 	return c.Author == nil
 }
 
+// SameLocation reports whether the comments c and d are at the same location:
+// the same line and side of the same file in the same patch set,
+// replying to the same comment, if any.
+// A draft at the same location as an existing draft is an edit of that draft.
+func (c *CommentInfo) SameLocation(d *CommentInfo) bool {
+	return c.Path == d.Path && c.Side == d.Side && c.Line == d.Line && c.PatchSet == d.PatchSet && c.InReplyTo == d.InReplyTo
+}
+
 // AuthorName returns the name of the comment author.
 // If the comment is a draft, AuthorName returns the empty string.
 func (c *CommentInfo) AuthorName() string {
@@ -740,10 +1767,59 @@ func (c *CommentInfo) AuthorEmail() string {
 
 // The CommentRange entity describes the range of an inline comment.
 type CommentRange struct {
-	StartLine int `json:"start_line"` // start line number
-	StartChar int `json:"start_char"` // character position in start line
-	EndLine   int `json:"end_line"`   // end line number
-	EndChar   int `json:"end_char"`   // character position in end line
+	StartLine int `json:"start_line"`      // start line number
+	StartChar int `json:"start_character"` // character position in start line
+	EndLine   int `json:"end_line"`        // end line number
+	EndChar   int `json:"end_character"`   // character position in end line
+}
+
+// The RobotCommentInfo entity contains information about a robot inline comment,
+// a comment posted by an automated analyzer rather than a person.
+type RobotCommentInfo struct {
+	CommentInfo
+
+	// The ID of the robot that generated this comment.
+	RobotID string `json:"robot_id"`
+
+	// An ID of the run of the robot.
+	RobotRunID string `json:"robot_run_id"`
+
+	// URL to more information.
+	URL string `json:"url,omitempty"`
+
+	// Robot specific properties as map that maps arbitrary keys to values.
+	Properties map[string]string `json:"properties,omitempty"`
+
+	// Suggested fixes for this robot comment.
+	FixSuggestions []*FixSuggestionInfo `json:"fix_suggestions,omitempty"`
+}
+
+// The FixSuggestionInfo entity represents a suggested fix.
+type FixSuggestionInfo struct {
+	// The UUID of the suggested fix.
+	// It will be generated automatically and hence will be ignored if it's set for input objects.
+	FixID string `json:"fix_id"`
+
+	// A description of the suggested fix.
+	Description string `json:"description"`
+
+	// A list of FixReplacementInfo entities indicating how the content of one or several files should be modified.
+	// Within a file, they should refer to non-overlapping regions.
+	Replacements []*FixReplacementInfo `json:"replacements"`
+}
+
+// The FixReplacementInfo entity describes how the content of a file should be replaced by another content.
+type FixReplacementInfo struct {
+	// The path of the file which should be modified.
+	// Any file in the repository may be modified.
+	Path string `json:"path"`
+
+	// A CommentRange indicating which content of the file should be replaced.
+	// Lines in the file are assumed to be separated by the line feed character.
+	Range *CommentRange `json:"range"`
+
+	// The content which should be used instead of the current one.
+	Replacement string `json:"replacement"`
 }
 
 func (c *Client) listComments(url string) (map[string][]*CommentInfo, error) {
@@ -778,8 +1854,17 @@ func (c *Client) ListRevisionDrafts(changeID, revID string) (map[string][]*Comme
 	return c.listComments("/changes/" + url.QueryEscape(changeID) + "/revisions/" + url.QueryEscape(revID) + "/drafts")
 }
 
-// TODO(rsc): Do we really need both CreateDraft and PutDraft?
-// What if you call CreateDraft with draft.ID set?
+// ListRevisionRobotComments lists the robot comments for the given revision.
+// It returns a map keyed by file name.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#list-robot-comments
+func (c *Client) ListRevisionRobotComments(changeID, revID string) (map[string][]*RobotCommentInfo, error) {
+	m := make(map[string][]*RobotCommentInfo)
+	err := c.do(&m, "GET", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/robotcomments", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
 // CreateDraft creates a draft comment on a revision.
 func (c *Client) CreateDraft(changeID, revID string, draft *CommentInfo) (*CommentInfo, error) {
@@ -804,13 +1889,25 @@ func (c *Client) GetDraft(changeID, revID, draftID string) (*CommentInfo, error)
 // UpdateDraft updates a draft comment on a revision.
 func (c *Client) UpdateDraft(changeID, revID, draftID string, draft *CommentInfo) (*CommentInfo, error) {
 	var out CommentInfo
-	err := c.do(&out, "PUT", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/drafts/"+url.QueryEscape(draftID), nil, nil)
+	err := c.do(&out, "PUT", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/drafts/"+url.QueryEscape(draftID), nil, draft)
 	if err != nil {
 		return nil, err
 	}
 	return &out, nil
 }
 
+// UpsertDraft saves a draft comment on a revision:
+// if draft.ID is set, UpsertDraft updates that draft,
+// and otherwise it creates a new one.
+// Callers editing a list of drafts can use SameLocation
+// to find the existing draft, if any, for a comment.
+func (c *Client) UpsertDraft(changeID, revID string, draft *CommentInfo) (*CommentInfo, error) {
+	if draft.ID != "" {
+		return c.UpdateDraft(changeID, revID, draft.ID, draft)
+	}
+	return c.CreateDraft(changeID, revID, draft)
+}
+
 // DeleteDraft deletes a draft comment from a revision.
 func (c *Client) DeleteDraft(changeID, revID, draftID string) error {
 	return c.do(nil, "DELETE", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/drafts/"+url.QueryEscape(draftID), nil, nil)
@@ -826,11 +1923,39 @@ func (c *Client) ListReviewers(changeID string) ([]*AccountInfo, error) {
 	return list, nil
 }
 
+// ListReviewersByState lists the reviewers of a change by their state,
+// as a map from reviewer state (REVIEWER, CC, or REMOVED)
+// to the accounts in that state.
+// Unlike ListReviewers, it distinguishes the reviewers from the people
+// who are only copied on the change.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-change-detail
+func (c *Client) ListReviewersByState(changeID string) (map[string][]*AccountInfo, error) {
+	var ch ChangeInfo
+	err := c.do(&ch, "GET", "/changes/"+url.QueryEscape(changeID), url.Values{
+		"o": {"DETAILED_LABELS", "DETAILED_ACCOUNTS"},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ch.Reviewers == nil {
+		ch.Reviewers = make(map[string][]*AccountInfo)
+	}
+	return ch.Reviewers, nil
+}
+
 // DeleteReviewer deletes a reviewer from a change.
 func (c *Client) DeleteReviewer(changeID, accountID string) error {
 	return c.do(nil, "DELETE", "/changes/"+url.QueryEscape(changeID)+"/reviewers/"+url.QueryEscape(accountID), nil, nil)
 }
 
+// DeleteVote deletes a single vote by a reviewer on a change,
+// leaving the reviewer on the change.
+// Note that deleting a vote is not the same as voting 0.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#delete-vote
+func (c *Client) DeleteVote(changeID, accountID, label string) error {
+	return c.do(nil, "DELETE", "/changes/"+url.QueryEscape(changeID)+"/reviewers/"+url.QueryEscape(accountID)+"/votes/"+url.QueryEscape(label), nil, nil)
+}
+
 // AddReviewer adds one user or all members of a group to the change.
 func (c *Client) AddReviewer(changeID string, rev *ReviewerInput) (*AddReviewerResult, error) {
 	var out AddReviewerResult
@@ -851,6 +1976,10 @@ type ReviewerInput struct {
 	// The Gerrit server may be configured to require a confirmation
 	// when adding a group as reviewer that has many members.
 	Confirmed bool `json:"confirmed,omitempty"`
+
+	// The state to add the reviewer in: REVIEWER (the default) or CC.
+	// Adding an existing reviewer or CC in the other state moves them.
+	State string `json:"state,omitempty"`
 }
 
 // AddReviewerResult describes the result of adding a reviewer to a change.
@@ -865,15 +1994,87 @@ type AddReviewerResult struct {
 	Confirm bool `json:"confirm"`
 }
 
-// SuggestReviewers lists the reviewers of a change.
-func (c *Client) SuggestReviewers(changeID, query string, n int) ([]*SuggestedReviewerInfo, error) {
+// AttentionSetInfo describes an account in the attention set of a change.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#attention-set-info
+type AttentionSetInfo struct {
+	// The account in the attention set.
+	Account *AccountInfo `json:"account"`
+
+	// When the account was last added to or removed from the attention set.
+	LastUpdate TimeStamp `json:"last_update"`
+
+	// Why the account was added to the attention set.
+	Reason string `json:"reason"`
+}
+
+// AddToAttentionSet adds the account to the attention set of the change,
+// recording the reason, which Gerrit shows in its web interface.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#add-to-attention-set
+func (c *Client) AddToAttentionSet(changeID, accountID, reason string) error {
+	req := struct {
+		User   string `json:"user"`
+		Reason string `json:"reason"`
+	}{
+		accountID,
+		reason,
+	}
+	return c.do(nil, "POST", "/changes/"+url.QueryEscape(changeID)+"/attention", nil, &req)
+}
+
+// RemoveFromAttentionSet removes the account from the attention set
+// of the change, recording the reason.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#remove-from-attention-set
+func (c *Client) RemoveFromAttentionSet(changeID, accountID, reason string) error {
+	req := struct {
+		Reason string `json:"reason"`
+	}{
+		reason,
+	}
+	return c.do(nil, "POST", "/changes/"+url.QueryEscape(changeID)+"/attention/"+url.QueryEscape(accountID)+"/delete", nil, &req)
+}
+
+// SuggestReviewersOpt are options for SuggestReviewers.
+type SuggestReviewersOpt struct {
+	// ExcludeGroups excludes groups from the suggestions,
+	// leaving only accounts.
+	ExcludeGroups bool
+
+	// Filter optionally selects the suggestions to return.
+	// If Filter is non-nil, SuggestReviewers returns only the
+	// suggestions for which it returns true.
+	Filter func(*SuggestedReviewerInfo) bool
+}
+
+// SuggestReviewers suggests up to n reviewers for a change,
+// matching query against account names, email addresses, and group names.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#suggest-reviewers
+func (c *Client) SuggestReviewers(changeID, query string, n int, opts ...SuggestReviewersOpt) ([]*SuggestedReviewerInfo, error) {
+	var opt SuggestReviewersOpt
+	switch len(opts) {
+	case 0:
+	case 1:
+		opt = opts[0]
+	default:
+		return nil, errors.New("only 1 option struct supported")
+	}
+	arg := url.Values{"q": []string{query}, "n": []string{fmt.Sprint(n)}}
+	if opt.ExcludeGroups {
+		arg["exclude-groups"] = []string{""}
+	}
 	var list []*SuggestedReviewerInfo
-	err := c.do(&list, "GET", "/changes/"+url.QueryEscape(changeID)+"/suggest_reviewers",
-		url.Values{"q": []string{query}, "n": []string{fmt.Sprint(n)}},
-		nil)
+	err := c.do(&list, "GET", "/changes/"+url.QueryEscape(changeID)+"/suggest_reviewers", arg, nil)
 	if err != nil {
 		return nil, err
 	}
+	if opt.Filter != nil {
+		var keep []*SuggestedReviewerInfo
+		for _, r := range list {
+			if opt.Filter(r) {
+				keep = append(keep, r)
+			}
+		}
+		list = keep
+	}
 	return list, nil
 }
 
@@ -891,22 +2092,587 @@ type GroupBaseInfo struct {
 	Name string `json:"name"`
 }
 
+// SubmitInput contains information for submitting a change.
+type SubmitInput struct {
+	// Whether to wait for the merge to happen before returning.
+	WaitForMerge bool `json:"wait_for_merge,omitempty"`
+
+	// Who to notify (email) after the change is submitted.
+	// Allowed values are NONE, OWNER, OWNER_REVIEWERS and ALL.
+	// If not set, the default is ALL.
+	Notify string `json:"notify,omitempty"`
+}
+
+// GroupInfo contains information about a group.
+type GroupInfo struct {
+	// The URL encoded UUID of the group.
+	ID string `json:"id"`
+
+	// The name of the group.
+	// Not set if returned in a map where the group name is used as map key.
+	Name string `json:"name,omitempty"`
+
+	// The numeric ID of the group.
+	GroupID int `json:"group_id"`
+
+	// The description of the group.
+	Description string `json:"description"`
+
+	// The name of the owner group.
+	Owner string `json:"owner"`
+
+	// The URL encoded UUID of the owner group.
+	OwnerID string `json:"owner_id"`
+}
+
+// ListGroupsOpt are options for ListGroups.
+type ListGroupsOpt struct {
+	// Match limits the results to groups whose name contains Match.
+	Match string
+
+	// User limits the results to groups of which the given user is a member.
+	User string
+
+	// Owned limits the results to groups that are owned by the calling user.
+	Owned bool
+
+	// N is the number of results to return.
+	// If 0, the 'n' parameter is not sent to Gerrit.
+	N int
+}
+
+// ListGroups lists the groups accessible by the caller, sorted by name.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-groups.html#list-groups
+func (c *Client) ListGroups(opts ...ListGroupsOpt) ([]*GroupInfo, error) {
+	var opt ListGroupsOpt
+	switch len(opts) {
+	case 0:
+	case 1:
+		opt = opts[0]
+	default:
+		return nil, errors.New("only 1 option struct supported")
+	}
+	v := url.Values{
+		"n": condInt(opt.N),
+	}
+	if opt.Match != "" {
+		v["m"] = []string{opt.Match}
+	}
+	if opt.User != "" {
+		v["user"] = []string{opt.User}
+	}
+	if opt.Owned {
+		v["owned"] = []string{""}
+	}
+	var m map[string]*GroupInfo
+	if err := c.do(&m, "GET", "/groups/", v, nil); err != nil {
+		return nil, err
+	}
+	var list []*GroupInfo
+	for name, g := range m {
+		g.Name = name
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// GetGroupMembers lists the direct members of a group.
+// The groupID is https://gerrit-review.googlesource.com/Documentation/rest-api-groups.html#group-id
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-groups.html#group-members
+func (c *Client) GetGroupMembers(groupID string) ([]*AccountInfo, error) {
+	var list []*AccountInfo
+	err := c.do(&list, "GET", "/groups/"+url.QueryEscape(groupID)+"/members/", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
 // Submit submits the change.
-// It blocks until the change has been merged into the repository.
-func (c *Client) Submit(changeID string) error {
+// If opt is nil, Submit uses the default options,
+// which block until the change has been merged into the repository.
+func (c *Client) Submit(changeID string, opt *SubmitInput) error {
+	if opt == nil {
+		opt = &SubmitInput{WaitForMerge: true}
+	}
+	var ch ChangeInfo
+	return c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/submit", nil, opt)
+}
+
+// SetAssignee sets the assignee of a change.
+// It returns the account information of the new assignee.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#set-assignee
+func (c *Client) SetAssignee(changeID, accountID string) (*AccountInfo, error) {
+	req := struct {
+		Assignee string `json:"assignee"`
+	}{
+		accountID,
+	}
+
+	var out AccountInfo
+	err := c.do(&out, "PUT", "/changes/"+url.QueryEscape(changeID)+"/assignee", nil, &req)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteAssignee deletes the assignee of a change.
+// It returns the account information of the deleted assignee,
+// or nil if the change had no assignee.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#delete-assignee
+func (c *Client) DeleteAssignee(changeID string) (*AccountInfo, error) {
+	var out *AccountInfo
+	err := c.do(&out, "DELETE", "/changes/"+url.QueryEscape(changeID)+"/assignee", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Star marks the change as starred by the calling user.
+// An optional accountID can be given to star the change
+// on behalf of a different account; the default is "self".
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-accounts.html#star-change
+func (c *Client) Star(changeID string, accountID ...string) error {
+	path, err := starredPath(changeID, accountID)
+	if err != nil {
+		return err
+	}
+	return c.do(nil, "PUT", path, nil, nil)
+}
+
+// Unstar removes the star from the change.
+// Like for Star, the optional accountID defaults to "self".
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-accounts.html#unstar-change
+func (c *Client) Unstar(changeID string, accountID ...string) error {
+	path, err := starredPath(changeID, accountID)
+	if err != nil {
+		return err
+	}
+	return c.do(nil, "DELETE", path, nil, nil)
+}
+
+func starredPath(changeID string, accountID []string) (string, error) {
+	acct := "self"
+	switch len(accountID) {
+	case 0:
+	case 1:
+		acct = accountID[0]
+	default:
+		return "", errors.New("only 1 account ID supported")
+	}
+	return "/accounts/" + url.QueryEscape(acct) + "/starred.changes/" + url.QueryEscape(changeID), nil
+}
+
+// SetWorkInProgress marks the change as work in progress.
+// The message, if not empty, is added as a change message.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#set-work-in-pogress
+func (c *Client) SetWorkInProgress(changeID, message string) error {
+	return c.do(nil, "POST", "/changes/"+url.QueryEscape(changeID)+"/wip", nil, &workInProgressInput{message})
+}
+
+// SetReadyForReview marks the change as ready for review
+// (that is, no longer work in progress).
+// The message, if not empty, is added as a change message.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#set-ready-for-review
+func (c *Client) SetReadyForReview(changeID, message string) error {
+	return c.do(nil, "POST", "/changes/"+url.QueryEscape(changeID)+"/ready", nil, &workInProgressInput{message})
+}
+
+type workInProgressInput struct {
+	Message string `json:"message,omitempty"`
+}
+
+// Restore restores an abandoned change.
+// The message, if not empty, is added as a change message.
+// If the change is not abandoned, Restore returns an error
+// for which IsConflict reports true.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#restore-change
+func (c *Client) Restore(changeID, message string) error {
 	req := struct {
-		Wait bool `json:"wait_for_merge"`
+		Message string `json:"message,omitempty"`
 	}{
-		true,
+		message,
 	}
 
 	var ch ChangeInfo
-	return c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/submit", nil, &req)
+	return c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/restore", nil, &req)
+}
+
+// AbandonInput contains information for abandoning a change.
+type AbandonInput struct {
+	// Message to be added as review comment to the change when abandoning it.
+	Message string `json:"message,omitempty"`
+
+	// Who to notify (email) after the change is abandoned.
+	// Allowed values are NONE, OWNER, OWNER_REVIEWERS and ALL.
+	// If not set, the default is ALL.
+	Notify string `json:"notify,omitempty"`
 }
 
 // Abandon abandons the change.
-// It does not allow posting a message at the same time (but it could).
-func (c *Client) Abandon(changeID string) error {
+// If opt is nil, the change is abandoned without a message.
+func (c *Client) Abandon(changeID string, opt *AbandonInput) error {
+	var body interface{}
+	if opt != nil {
+		body = opt
+	}
+	var ch ChangeInfo
+	return c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/abandon", nil, body)
+}
+
+// DeleteChange deletes a change.
+// Gerrit only allows deleting new or abandoned changes,
+// by their owners or by administrators;
+// otherwise it responds 409 Conflict (see IsConflict)
+// or 403 Forbidden (see IsForbidden).
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#delete-change
+func (c *Client) DeleteChange(changeID string) error {
+	return c.do(nil, "DELETE", "/changes/"+url.QueryEscape(changeID), nil, nil)
+}
+
+// RebaseInput contains information for rebasing a change.
+type RebaseInput struct {
+	// The new parent revision: a change number, a change number and patch set
+	// (as in "1234/2"), or a commit ID. If empty, the change is rebased
+	// onto the tip of its destination branch, or onto the current patch set
+	// of the change it depends on.
+	Base string `json:"base,omitempty"`
+}
+
+// RebaseChange rebases the current patch set of the change,
+// returning the updated change.
+// If opt is nil, the change is rebased onto its default base.
+// If the change cannot be rebased (for example, because it is already
+// up to date or because of a merge conflict), RebaseChange returns
+// an error for which IsConflict reports true.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#rebase-change
+func (c *Client) RebaseChange(changeID string, opt *RebaseInput) (*ChangeInfo, error) {
+	if opt == nil {
+		opt = &RebaseInput{}
+	}
+	var ch ChangeInfo
+	if err := c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/rebase", nil, opt); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// CherryPickInput contains information for cherry-picking a change.
+type CherryPickInput struct {
+	// Commit message for the cherry-picked change.
+	// If empty, the message of the revision being cherry-picked is used.
+	Message string `json:"message,omitempty"`
+
+	// Destination branch.
+	Destination string `json:"destination"`
+}
+
+// CherryPick cherry-picks a revision of the change onto a destination branch,
+// returning the new change.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#cherry-pick
+func (c *Client) CherryPick(changeID, revID string, opt *CherryPickInput) (*ChangeInfo, error) {
 	var ch ChangeInfo
-	return c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/abandon", nil, nil)
+	if err := c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/revisions/"+url.QueryEscape(revID)+"/cherrypick", nil, opt); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// Revert creates a change reverting the (merged) change,
+// returning the new change.
+// The message, if not empty, is used as the commit message of the revert;
+// otherwise Gerrit generates one.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#revert-change
+func (c *Client) Revert(changeID, message string) (*ChangeInfo, error) {
+	req := struct {
+		Message string `json:"message,omitempty"`
+	}{
+		message,
+	}
+	var ch ChangeInfo
+	if err := c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/revert", nil, &req); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// MoveChange moves the change to the destination branch
+// of the same project, returning the updated change.
+// The message, if not empty, is posted on the change to explain the move.
+// Gerrit only moves open changes, responding 409 Conflict otherwise
+// (see IsConflict), and requires permission to abandon the change
+// and to upload to the destination, responding 403 Forbidden otherwise
+// (see IsForbidden).
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#move-change
+func (c *Client) MoveChange(changeID, branch, message string) (*ChangeInfo, error) {
+	req := struct {
+		DestinationBranch string `json:"destination_branch"`
+		Message           string `json:"message,omitempty"`
+	}{
+		branch,
+		message,
+	}
+	var ch ChangeInfo
+	if err := c.do(&ch, "POST", "/changes/"+url.QueryEscape(changeID)+"/move", nil, &req); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// SetCommitMessage changes the commit message of the change,
+// creating a new patch set with the new message.
+// The message should keep the change's Change-Id footer.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#set-message
+func (c *Client) SetCommitMessage(changeID, message string) error {
+	req := struct {
+		Message string `json:"message"`
+	}{
+		message,
+	}
+	return c.do(nil, "PUT", "/changes/"+url.QueryEscape(changeID)+"/message", nil, &req)
+}
+
+// IncludedInInfo lists the branches and tags containing a merged change.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#included-in-info
+type IncludedInInfo struct {
+	Branches []string `json:"branches"`
+	Tags     []string `json:"tags"`
+
+	// External lists the branches and tags of other repositories
+	// containing the change, keyed by the name of the system
+	// that reported them.
+	External map[string][]string `json:"external,omitempty"`
+}
+
+// GetIncludedIn returns the branches and tags containing the merged change.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-included-in
+func (c *Client) GetIncludedIn(changeID string) (*IncludedInInfo, error) {
+	var in IncludedInInfo
+	if err := c.do(&in, "GET", "/changes/"+url.QueryEscape(changeID)+"/in", nil, nil); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// BranchInfo describes a branch of a project.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#branch-info
+type BranchInfo struct {
+	Ref       string `json:"ref"`      // "refs/heads/master"
+	Revision  string `json:"revision"` // commit hash at the branch head
+	CanDelete bool   `json:"can_delete"`
+}
+
+// TagInfo describes a tag of a project.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#tag-info
+type TagInfo struct {
+	Ref      string `json:"ref"`      // "refs/tags/v1.0"
+	Revision string `json:"revision"` // tag object hash, or commit hash for a lightweight tag
+
+	// The remaining fields are only set for annotated tags.
+	Object  string         `json:"object,omitempty"` // commit hash
+	Message string         `json:"message,omitempty"`
+	Tagger  *GitPersonInfo `json:"tagger,omitempty"`
+}
+
+// ListBranches lists the branches of the project.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#list-branches
+func (c *Client) ListBranches(project string) ([]*BranchInfo, error) {
+	var list []*BranchInfo
+	if err := c.do(&list, "GET", "/projects/"+url.QueryEscape(project)+"/branches/", nil, nil); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CreateBranch creates the branch in the project, starting at revision,
+// which can be a commit hash or another branch name.
+// If revision is empty, the branch starts at the project's HEAD.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#create-branch
+func (c *Client) CreateBranch(project, branch, revision string) (*BranchInfo, error) {
+	req := struct {
+		Revision string `json:"revision,omitempty"`
+	}{
+		revision,
+	}
+	var b BranchInfo
+	if err := c.do(&b, "PUT", "/projects/"+url.QueryEscape(project)+"/branches/"+url.QueryEscape(branch), nil, &req); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// ListTags lists the tags of the project.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#list-tags
+func (c *Client) ListTags(project string) ([]*TagInfo, error) {
+	var list []*TagInfo
+	if err := c.do(&list, "GET", "/projects/"+url.QueryEscape(project)+"/tags/", nil, nil); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ConfigInfo describes the configuration of a project.
+// Only the label and submit type parts are modeled.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#config-info
+type ConfigInfo struct {
+	Description string `json:"description,omitempty"`
+
+	// The submit type, such as "MERGE_IF_NECESSARY" or "CHERRY_PICK".
+	// Newer servers report it in DefaultSubmitType instead.
+	SubmitType        string          `json:"submit_type,omitempty"`
+	DefaultSubmitType *SubmitTypeInfo `json:"default_submit_type,omitempty"`
+
+	// The labels defined for the project, keyed by label name.
+	Labels map[string]*LabelTypeInfo `json:"labels,omitempty"`
+}
+
+// SubmitTypeInfo describes a project's submit type.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#submit-type-info
+type SubmitTypeInfo struct {
+	Value           string `json:"value"` // effective submit type
+	ConfiguredValue string `json:"configured_value"`
+	InheritedValue  string `json:"inherited_value"`
+}
+
+// LabelTypeInfo describes a label defined by a project.
+// See https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#label-type-info
+type LabelTypeInfo struct {
+	// Values maps each allowed value, such as "+2" or " 0",
+	// to its description.
+	Values       map[string]string `json:"values"`
+	DefaultValue int               `json:"default_value"`
+
+	// Function is the label's function, such as "MaxWithBlock",
+	// for servers that report it.
+	Function string `json:"function,omitempty"`
+}
+
+// AllowedValues returns the values allowed for the label, in increasing order.
+func (l *LabelTypeInfo) AllowedValues() []int {
+	return labelValues(l.Values)
+}
+
+// GetProjectConfig returns the configuration of the project.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-projects.html#get-config
+func (c *Client) GetProjectConfig(project string) (*ConfigInfo, error) {
+	var cfg ConfigInfo
+	if err := c.do(&cfg, "GET", "/projects/"+url.QueryEscape(project)+"/config", nil, nil); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ServerVersion returns the version of the Gerrit server, such as "2.14.6".
+// The version is fetched once and cached for the lifetime of the client.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-config.html#get-version
+func (c *Client) ServerVersion() (string, error) {
+	c.mu.Lock()
+	v := c.version
+	c.mu.Unlock()
+	if v != "" {
+		return v, nil
+	}
+	// Ask anonymously first, to avoid an authentication challenge
+	// on servers that let anyone read the version,
+	// and fall back to authenticating if the server refuses.
+	err := c.doAuth(NoAuth, &v, "GET", "/config/server/version", nil, nil)
+	if _, ok := c.auth.(noAuth); !ok && (IsUnauthorized(err) || IsForbidden(err)) {
+		err = c.do(&v, "GET", "/config/server/version", nil, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.version = v
+	c.mu.Unlock()
+	return v, nil
+}
+
+// ServerVersionAtLeast reports whether the Gerrit server's version
+// is at least major.minor. Higher-level code can use it to avoid
+// calling endpoints that older servers do not implement.
+func (c *Client) ServerVersionAtLeast(major, minor int) (bool, error) {
+	v, err := c.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	// Versions look like "2.14.6" or "2.15-rc2" or "3.0.0-123-gabcdef".
+	f := strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' })
+	if len(f) < 2 {
+		return false, fmt.Errorf("cannot parse server version %q", v)
+	}
+	vmajor, err1 := strconv.Atoi(f[0])
+	vminor, err2 := strconv.Atoi(f[1])
+	if err1 != nil || err2 != nil {
+		return false, fmt.Errorf("cannot parse server version %q", v)
+	}
+	return vmajor > major || vmajor == major && vminor >= minor, nil
+}
+
+// ServerInfo contains information about the Gerrit server configuration.
+// Gerrit does not report a server-wide default submit type;
+// that is configured per project.
+type ServerInfo struct {
+	Change  ChangeConfigInfo  `json:"change"`
+	Gerrit  GerritInfo        `json:"gerrit"`
+	Plugin  PluginConfigInfo  `json:"plugin"`
+	Suggest SuggestInfo       `json:"suggest"`
+	User    UserConfigInfo    `json:"user"`
+	Sshd    *struct{}         `json:"sshd"` // non-nil if SSH is enabled
+	Receive ReceiveConfigInfo `json:"receive"`
+}
+
+// ChangeConfigInfo contains information about the change configuration of the server.
+type ChangeConfigInfo struct {
+	AllowBlame                 bool   `json:"allow_blame"`
+	AllowDrafts                bool   `json:"allow_drafts"`
+	DisablePrivateChanges      bool   `json:"disable_private_changes"`
+	LargeChange                int    `json:"large_change"`
+	ReplyLabel                 string `json:"reply_label"`
+	ReplyTooltip               string `json:"reply_tooltip"`
+	ShowAssigneeInChangesTable bool   `json:"show_assignee_in_changes_table"`
+	SubmitWholeTopic           bool   `json:"submit_whole_topic"`
+	UpdateDelay                int    `json:"update_delay"` // in seconds
+}
+
+// GerritInfo contains general information about the Gerrit server.
+type GerritInfo struct {
+	AllProjects  string `json:"all_projects"`
+	AllUsers     string `json:"all_users"`
+	DocURL       string `json:"doc_url"`
+	ReportBugURL string `json:"report_bug_url"`
+}
+
+// PluginConfigInfo contains information about the plugin configuration of the server.
+type PluginConfigInfo struct {
+	HasAvatars bool `json:"has_avatars"`
+}
+
+// SuggestInfo contains information about the reviewer suggestion configuration of the server.
+type SuggestInfo struct {
+	From int `json:"from"`
+}
+
+// UserConfigInfo contains information about the user configuration of the server.
+type UserConfigInfo struct {
+	AnonymousCowardName string `json:"anonymous_coward_name"`
+}
+
+// ReceiveConfigInfo contains information about the receive-pack configuration of the server.
+type ReceiveConfigInfo struct {
+	EnableSignedPush bool `json:"enable_signed_push"`
+}
+
+// GetServerInfo returns information about the Gerrit server configuration,
+// including which optional features are enabled.
+// For the API call, see https://gerrit-review.googlesource.com/Documentation/rest-api-config.html#get-info
+func (c *Client) GetServerInfo() (*ServerInfo, error) {
+	var info ServerInfo
+	if err := c.do(&info, "GET", "/config/server/info", nil, nil); err != nil {
+		return nil, err
+	}
+	return &info, nil
 }
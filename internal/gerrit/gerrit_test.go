@@ -0,0 +1,761 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gerrit
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A clientTest is a call to a Client method
+// together with the request it should send
+// and a recorded server reply.
+type clientTest struct {
+	name   string
+	call   func(c *Client) (interface{}, error)
+	method string
+	path   string // escaped request path
+	query  string // request query, or "" for none
+	body   string // JSON request body, or "" for none
+	reply  string // JSON reply, without the XSRF-defeating line
+	want   interface{}
+}
+
+// jsonEqual reports whether x and y are the same JSON value,
+// ignoring formatting and the order of object keys.
+func jsonEqual(x, y string) bool {
+	var vx, vy interface{}
+	if json.Unmarshal([]byte(x), &vx) != nil || json.Unmarshal([]byte(y), &vy) != nil {
+		return false
+	}
+	return reflect.DeepEqual(vx, vy)
+}
+
+func runClientTests(t *testing.T, tests []clientTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := false
+			c := NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sent = true
+				if r.Method != tt.method || r.URL.EscapedPath() != tt.path {
+					t.Errorf("request %s %s, want %s %s", r.Method, r.URL.EscapedPath(), tt.method, tt.path)
+				}
+				want, _ := url.ParseQuery(tt.query)
+				if got := r.URL.Query(); len(got) > 0 || len(want) > 0 {
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("query %q, want %q", r.URL.RawQuery, tt.query)
+					}
+				}
+				body, _ := ioutil.ReadAll(r.Body)
+				if tt.body == "" && len(body) > 0 {
+					t.Errorf("body %s, want none", body)
+				}
+				if tt.body != "" && !jsonEqual(string(body), tt.body) {
+					t.Errorf("body %s, want %s", body, tt.body)
+				}
+				if tt.reply == "" {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				fmt.Fprintf(w, ")]}'\n%s\n", tt.reply)
+			}))
+			got, err := tt.call(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sent {
+				t.Fatal("no request sent")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				gotJS, _ := json.Marshal(got)
+				wantJS, _ := json.Marshal(tt.want)
+				t.Errorf("result:\n%s\nwant:\n%s", gotJS, wantJS)
+			}
+		})
+	}
+}
+
+func mustTime(s string) TimeStamp {
+	t, err := time.Parse("2006-01-02 15:04:05", s)
+	if err != nil {
+		panic(err)
+	}
+	return TimeStamp(t)
+}
+
+var clientTests = []clientTest{
+	{
+		name: "QueryChanges",
+		call: func(c *Client) (interface{}, error) {
+			return c.QueryChanges("is:open owner:self", QueryChangesOpt{N: 2, Fields: []string{"LABELS", "DETAILED_ACCOUNTS"}})
+		},
+		method: "GET",
+		path:   "/changes/",
+		query:  "q=is:open+owner:self&n=2&o=LABELS&o=DETAILED_ACCOUNTS",
+		reply: `[
+			{
+				"id": "go~master~I8473b95934b5732ac55d26311a706c9c2bde9940",
+				"project": "go",
+				"branch": "master",
+				"change_id": "I8473b95934b5732ac55d26311a706c9c2bde9940",
+				"subject": "runtime: fix the thing",
+				"status": "NEW",
+				"updated": "2015-03-04 05:06:07.000000000",
+				"_number": 1234,
+				"owner": {"_account_id": 1000, "name": "Gopher", "email": "gopher@golang.org"}
+			},
+			{
+				"id": "go~master~I0000000000000000000000000000000000000001",
+				"project": "go",
+				"branch": "master",
+				"subject": "cmd/go: another thing",
+				"status": "NEW",
+				"_number": 1235,
+				"_more_changes": true
+			}
+		]`,
+		want: []*ChangeInfo{
+			{
+				ID:           "go~master~I8473b95934b5732ac55d26311a706c9c2bde9940",
+				Project:      "go",
+				Branch:       "master",
+				ChangeID:     "I8473b95934b5732ac55d26311a706c9c2bde9940",
+				Subject:      "runtime: fix the thing",
+				Status:       "NEW",
+				Updated:      mustTime("2015-03-04 05:06:07"),
+				ChangeNumber: 1234,
+				Owner:        &AccountInfo{NumericID: 1000, Name: "Gopher", Email: "gopher@golang.org"},
+			},
+			{
+				ID:           "go~master~I0000000000000000000000000000000000000001",
+				Project:      "go",
+				Branch:       "master",
+				Subject:      "cmd/go: another thing",
+				Status:       "NEW",
+				ChangeNumber: 1235,
+				MoreChanges:  true,
+			},
+		},
+	},
+	{
+		name: "GetDiff",
+		call: func(c *Client) (interface{}, error) {
+			return c.GetDiff("1234", "abc", "src/x.go", GetDiffOpt{Context: -1, Intraline: true})
+		},
+		method: "GET",
+		path:   "/changes/1234/revisions/abc/files/src%2Fx.go/diff",
+		query:  "context=ALL&intraline=",
+		reply: `{
+			"meta_a": {"name": "src/x.go", "content_type": "text/x-go", "lines": 3},
+			"meta_b": {"name": "src/x.go", "content_type": "text/x-go", "lines": 3},
+			"change_type": "MODIFIED",
+			"intraline_status": "OK",
+			"diff_header": ["diff --git a/src/x.go b/src/x.go"],
+			"content": [
+				{"ab": ["package x"]},
+				{"a": ["var y = 1"], "b": ["var y = 2"], "edit_a": [[8, 1]], "edit_b": [[8, 1]]},
+				{"ab": [""]}
+			]
+		}`,
+		want: &DiffInfo{
+			MetaA:           &DiffFileMetaInfo{Name: "src/x.go", ContentType: "text/x-go", Lines: 3},
+			MetaB:           &DiffFileMetaInfo{Name: "src/x.go", ContentType: "text/x-go", Lines: 3},
+			ChangeType:      "MODIFIED",
+			IntralineStatus: "OK",
+			DiffHeader:      []string{"diff --git a/src/x.go b/src/x.go"},
+			Content: []*DiffContent{
+				{AB: []string{"package x"}},
+				{A: []string{"var y = 1"}, B: []string{"var y = 2"}, EditA: DiffIntralineInfo{{8, 1}}, EditB: DiffIntralineInfo{{8, 1}}},
+				{AB: []string{""}},
+			},
+		},
+	},
+	{
+		name: "SetReview",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.SetReview("go~master~I8473b95934b5732ac55d26311a706c9c2bde9940", "abc", &ReviewInput{
+				Message: "LGTM",
+				Labels:  map[string]int{"Code-Review": 2},
+				Comments: map[string]*CommentInfo{
+					"src/x.go": {Line: 2, Message: "nice"},
+				},
+			})
+		},
+		method: "POST",
+		path:   "/changes/go~master~I8473b95934b5732ac55d26311a706c9c2bde9940/revisions/abc/review",
+		body:   `{"message": "LGTM", "labels": {"Code-Review": 2}, "comments": {"src/x.go": {"line": 2, "message": "nice"}}}`,
+		reply:  `{"labels": {"Code-Review": 2}}`,
+	},
+	{
+		name: "ListRevisionRobotComments",
+		call: func(c *Client) (interface{}, error) {
+			return c.ListRevisionRobotComments("1234", "abc")
+		},
+		method: "GET",
+		path:   "/changes/1234/revisions/abc/robotcomments",
+		reply: `{"src/x.go": [{
+			"id": "r1", "line": 3, "message": "unused variable",
+			"robot_id": "vet", "robot_run_id": "run1", "url": "https://example.com/vet",
+			"properties": {"check": "unused"},
+			"fix_suggestions": [{
+				"fix_id": "f1", "description": "delete it",
+				"replacements": [{"path": "src/x.go", "range": {"start_line": 3, "start_character": 0, "end_line": 4, "end_character": 0}, "replacement": ""}]
+			}],
+			"commit_id": "deadbeef"
+		}]}`,
+		want: map[string][]*RobotCommentInfo{
+			"src/x.go": {{
+				CommentInfo: CommentInfo{
+					ID:      "r1",
+					Line:    3,
+					Message: "unused variable",
+					Extra:   map[string]json.RawMessage{"commit_id": json.RawMessage(`"deadbeef"`)},
+				},
+				RobotID:    "vet",
+				RobotRunID: "run1",
+				URL:        "https://example.com/vet",
+				Properties: map[string]string{"check": "unused"},
+				FixSuggestions: []*FixSuggestionInfo{{
+					FixID:       "f1",
+					Description: "delete it",
+					Replacements: []*FixReplacementInfo{{
+						Path:  "src/x.go",
+						Range: &CommentRange{StartLine: 3, EndLine: 4},
+					}},
+				}},
+			}},
+		},
+	},
+}
+
+func TestClient(t *testing.T) {
+	runClientTests(t, clientTests)
+}
+
+// A draftServer is a fake Gerrit server holding the drafts on one revision.
+type draftServer struct {
+	t      *testing.T
+	next   int
+	drafts map[string]*CommentInfo
+}
+
+func (s *draftServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/changes/1234/revisions/abc/drafts"
+	path := r.URL.Path
+	if len(path) < len(prefix) || path[:len(prefix)] != prefix {
+		s.t.Errorf("unexpected request %s %s", r.Method, path)
+		http.NotFound(w, r)
+		return
+	}
+	id := path[len(prefix):]
+	if id != "" {
+		id = id[1:]
+	}
+	reply := func(v interface{}) {
+		js, _ := json.Marshal(v)
+		fmt.Fprintf(w, ")]}'\n%s\n", js)
+	}
+	switch {
+	case r.Method == "GET" && id == "":
+		m := make(map[string][]*CommentInfo)
+		for _, c := range s.drafts {
+			c1 := *c
+			c1.Path = ""
+			m[c.Path] = append(m[c.Path], &c1)
+		}
+		reply(m)
+	case r.Method == "PUT":
+		var c CommentInfo
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			s.t.Errorf("decoding draft: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if id == "" {
+			if c.ID != "" {
+				s.t.Errorf("creating draft with ID %q", c.ID)
+			}
+			s.next++
+			id = fmt.Sprintf("draft%d", s.next)
+		} else if s.drafts[id] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		c.ID = id
+		s.drafts[id] = &c
+		reply(&c)
+	case r.Method == "DELETE" && id != "":
+		if s.drafts[id] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.drafts, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, path)
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func TestDraftLifecycle(t *testing.T) {
+	srv := &draftServer{t: t, drafts: make(map[string]*CommentInfo)}
+	c := NewTestClient(srv)
+
+	checkDrafts := func(want map[string][]*CommentInfo) {
+		t.Helper()
+		got, err := c.ListRevisionDrafts("1234", "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			gotJS, _ := json.Marshal(got)
+			wantJS, _ := json.Marshal(want)
+			t.Fatalf("drafts:\n%s\nwant:\n%s", gotJS, wantJS)
+		}
+	}
+
+	checkDrafts(map[string][]*CommentInfo{})
+
+	d, err := c.UpsertDraft("1234", "abc", &CommentInfo{Path: "x.go", Line: 3, Message: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ID == "" {
+		t.Fatal("created draft has no ID")
+	}
+	checkDrafts(map[string][]*CommentInfo{"x.go": {{ID: d.ID, Line: 3, Message: "first"}}})
+
+	d.Message = "second"
+	d2, err := c.UpsertDraft("1234", "abc", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.ID != d.ID {
+		t.Fatalf("updated draft ID %q, want %q", d2.ID, d.ID)
+	}
+	checkDrafts(map[string][]*CommentInfo{"x.go": {{ID: d.ID, Line: 3, Message: "second"}}})
+
+	if err := c.DeleteDraft("1234", "abc", d.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkDrafts(map[string][]*CommentInfo{})
+
+	if err := c.DeleteDraft("1234", "abc", d.ID); !IsNotFound(err) {
+		t.Fatalf("deleting deleted draft: %v, want not found", err)
+	}
+}
+
+var assigneeTests = []clientTest{
+	{
+		name: "SetAssignee",
+		call: func(c *Client) (interface{}, error) {
+			return c.SetAssignee("go~master~I8473b95934b5732ac55d26311a706c9c2bde9940", "gopher@golang.org")
+		},
+		method: "PUT",
+		path:   "/changes/go~master~I8473b95934b5732ac55d26311a706c9c2bde9940/assignee",
+		body:   `{"assignee": "gopher@golang.org"}`,
+		reply:  `{"_account_id": 1000, "name": "Gopher", "email": "gopher@golang.org"}`,
+		want:   &AccountInfo{NumericID: 1000, Name: "Gopher", Email: "gopher@golang.org"},
+	},
+	{
+		name: "DeleteAssignee",
+		call: func(c *Client) (interface{}, error) {
+			return c.DeleteAssignee("1234")
+		},
+		method: "DELETE",
+		path:   "/changes/1234/assignee",
+		reply:  `{"_account_id": 1000, "email": "gopher@golang.org"}`,
+		want:   &AccountInfo{NumericID: 1000, Email: "gopher@golang.org"},
+	},
+	{
+		name: "DeleteNoAssignee",
+		call: func(c *Client) (interface{}, error) {
+			return c.DeleteAssignee("1234")
+		},
+		method: "DELETE",
+		path:   "/changes/1234/assignee",
+		want:   (*AccountInfo)(nil),
+	},
+}
+
+func TestAssignee(t *testing.T) {
+	runClientTests(t, assigneeTests)
+}
+
+var currentRevisionTests = []clientTest{
+	{
+		name: "GetDiff",
+		call: func(c *Client) (interface{}, error) {
+			return c.GetDiff("1234", CurrentRevision, "x.go")
+		},
+		method: "GET",
+		path:   "/changes/1234/revisions/current/files/x.go/diff",
+		reply:  `{"change_type": "ADDED", "content": [{"b": ["package x"]}]}`,
+		want:   &DiffInfo{ChangeType: "ADDED", Content: []*DiffContent{{B: []string{"package x"}}}},
+	},
+	{
+		name: "SetReview",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.SetReview("1234", CurrentRevision, &ReviewInput{Message: "hi"})
+		},
+		method: "POST",
+		path:   "/changes/1234/revisions/current/review",
+		body:   `{"message": "hi"}`,
+		reply:  `{}`,
+	},
+	{
+		name: "ListRevisionComments",
+		call: func(c *Client) (interface{}, error) {
+			return c.ListRevisionComments("1234", CurrentRevision)
+		},
+		method: "GET",
+		path:   "/changes/1234/revisions/current/comments",
+		reply:  `{}`,
+		want:   map[string][]*CommentInfo{},
+	},
+	{
+		name: "ListRevisionDrafts",
+		call: func(c *Client) (interface{}, error) {
+			return c.ListRevisionDrafts("1234", CurrentRevision)
+		},
+		method: "GET",
+		path:   "/changes/1234/revisions/current/drafts",
+		reply:  `{}`,
+		want:   map[string][]*CommentInfo{},
+	},
+	{
+		name: "CreateDraft",
+		call: func(c *Client) (interface{}, error) {
+			return c.CreateDraft("1234", CurrentRevision, &CommentInfo{Path: "x.go", Line: 1, Message: "hi"})
+		},
+		method: "PUT",
+		path:   "/changes/1234/revisions/current/drafts",
+		body:   `{"path": "x.go", "line": 1, "message": "hi"}`,
+		reply:  `{"id": "d1", "path": "x.go", "line": 1, "message": "hi"}`,
+		want:   &CommentInfo{ID: "d1", Path: "x.go", Line: 1, Message: "hi"},
+	},
+}
+
+func TestCurrentRevision(t *testing.T) {
+	runClientTests(t, currentRevisionTests)
+}
+
+var serverPathTests = []struct {
+	prefix string // server path in the client URL
+	auth   Auth
+	path   string // request path the server should see
+}{
+	{"", NoAuth, "/changes/1234/messages"},
+	{"", BasicAuth("gopher", "secret"), "/a/changes/1234/messages"},
+	{"/", BasicAuth("gopher", "secret"), "/a/changes/1234/messages"},
+	{"/gerrit", NoAuth, "/gerrit/changes/1234/messages"},
+	{"/gerrit", BasicAuth("gopher", "secret"), "/gerrit/a/changes/1234/messages"},
+	{"/gerrit/", BasicAuth("gopher", "secret"), "/gerrit/a/changes/1234/messages"},
+	{"/gerrit?x=1#y", BasicAuth("gopher", "secret"), "/gerrit/a/changes/1234/messages"},
+	{"/a/b", BasicAuth("gopher", "secret"), "/a/b/a/changes/1234/messages"},
+}
+
+func TestServerPath(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprintf(w, ")]}'\n[]\n")
+	}))
+	defer srv.Close()
+
+	for _, tt := range serverPathTests {
+		path = ""
+		c := NewClient(srv.URL+tt.prefix, tt.auth)
+		if _, err := c.ListChangeMessages("1234"); err != nil {
+			t.Errorf("NewClient(%q): %v", srv.URL+tt.prefix, err)
+			continue
+		}
+		if path != tt.path {
+			t.Errorf("NewClient(%q): request path %s, want %s", srv.URL+tt.prefix, path, tt.path)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var got http.Header
+	c := NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		fmt.Fprintf(w, ")]}'\n{}\n")
+	}))
+
+	if _, err := c.GetAccountInfo("self"); err != nil {
+		t.Fatal(err)
+	}
+	if ua := got.Get("User-Agent"); ua != DefaultUserAgent {
+		t.Errorf("default User-Agent %q, want %q", ua, DefaultUserAgent)
+	}
+
+	c.UserAgent = "reviewbot/1.0"
+	c.Header = http.Header{
+		"X-Trace":    {"abc"},
+		"X-Multiple": {"one", "two"},
+		"User-Agent": {"overridden"},
+	}
+	if _, err := c.GetAccountInfo("1000"); err != nil {
+		t.Fatal(err)
+	}
+	if ua := got.Get("User-Agent"); ua != "reviewbot/1.0" {
+		t.Errorf("User-Agent %q, want %q", ua, "reviewbot/1.0")
+	}
+	if v := got.Get("X-Trace"); v != "abc" {
+		t.Errorf("X-Trace %q, want %q", v, "abc")
+	}
+	if v := got["X-Multiple"]; !reflect.DeepEqual(v, []string{"one", "two"}) {
+		t.Errorf("X-Multiple %q, want %q", v, []string{"one", "two"})
+	}
+
+	// A request with a body sets its own Content-Type.
+	c.Header.Set("Content-Type", "text/plain")
+	if err := c.SetReview("1234", CurrentRevision, &ReviewInput{Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if ct := got.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+}
+
+var includedInTests = []clientTest{
+	{
+		name: "GetIncludedIn",
+		call: func(c *Client) (interface{}, error) {
+			return c.GetIncludedIn("go~master~I8473b95934b5732ac55d26311a706c9c2bde9940")
+		},
+		method: "GET",
+		path:   "/changes/go~master~I8473b95934b5732ac55d26311a706c9c2bde9940/in",
+		// The sample from the Gerrit REST API documentation,
+		// with an external entry added.
+		reply: `{
+			"branches": ["master"],
+			"tags": [],
+			"external": {
+				"ci": ["build-123"]
+			}
+		}`,
+		want: &IncludedInInfo{
+			Branches: []string{"master"},
+			Tags:     []string{},
+			External: map[string][]string{"ci": {"build-123"}},
+		},
+	},
+	{
+		name: "GetIncludedInRelease",
+		call: func(c *Client) (interface{}, error) {
+			return c.GetIncludedIn("1234")
+		},
+		method: "GET",
+		path:   "/changes/1234/in",
+		reply:  `{"branches": ["master", "release-branch.go1.21"], "tags": ["go1.21.0", "go1.21rc2"]}`,
+		want: &IncludedInInfo{
+			Branches: []string{"master", "release-branch.go1.21"},
+			Tags:     []string{"go1.21.0", "go1.21rc2"},
+		},
+	},
+}
+
+func TestIncludedIn(t *testing.T) {
+	runClientTests(t, includedInTests)
+}
+
+var escapeTests = []clientTest{
+	{
+		name: "DeleteVote",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.DeleteVote("golang/go~master~I8473b95934b5732ac55d26311a706c9c2bde9940", "gopher@golang.org", "Code-Review")
+		},
+		method: "DELETE",
+		path:   "/changes/golang%2Fgo~master~I8473b95934b5732ac55d26311a706c9c2bde9940/reviewers/gopher%40golang.org/votes/Code-Review",
+	},
+	{
+		name: "DeleteVoteNumeric",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.DeleteVote("1234", "1000", "Run-TryBot")
+		},
+		method: "DELETE",
+		path:   "/changes/1234/reviewers/1000/votes/Run-TryBot",
+	},
+	{
+		name: "SetReviewed",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.SetReviewed("golang/go~master~I1", "abc", "src/cmd/go/testdata/a b#c?.txt")
+		},
+		method: "PUT",
+		path:   "/changes/golang%2Fgo~master~I1/revisions/abc/files/src%2Fcmd%2Fgo%2Ftestdata%2Fa+b%23c%3F.txt/reviewed",
+	},
+	{
+		name: "GetDiffPath",
+		call: func(c *Client) (interface{}, error) {
+			return c.GetDiff("1234", "abc", "doc/go1.21.html")
+		},
+		method: "GET",
+		path:   "/changes/1234/revisions/abc/files/doc%2Fgo1.21.html/diff",
+		reply:  `{"change_type": "MODIFIED"}`,
+		want:   &DiffInfo{ChangeType: "MODIFIED"},
+	},
+}
+
+func TestEscape(t *testing.T) {
+	runClientTests(t, escapeTests)
+}
+
+var tagTests = []clientTest{
+	{
+		name: "Tagged",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.SetReview("1234", "abc", &ReviewInput{Message: "TryBots are happy.", Tag: "autogenerated:trybots"})
+		},
+		method: "POST",
+		path:   "/changes/1234/revisions/abc/review",
+		body:   `{"message": "TryBots are happy.", "tag": "autogenerated:trybots"}`,
+		reply:  `{}`,
+	},
+	{
+		// jsonEqual compares keys, so an empty "tag" field would not match.
+		name: "Untagged",
+		call: func(c *Client) (interface{}, error) {
+			return nil, c.SetReview("1234", "abc", &ReviewInput{Message: "LGTM"})
+		},
+		method: "POST",
+		path:   "/changes/1234/revisions/abc/review",
+		body:   `{"message": "LGTM"}`,
+		reply:  `{}`,
+	},
+}
+
+func TestReviewTag(t *testing.T) {
+	runClientTests(t, tagTests)
+}
+
+func TestListChangeMessages(t *testing.T) {
+	runClientTests(t, []clientTest{{
+		name: "ListChangeMessages",
+		call: func(c *Client) (interface{}, error) {
+			return c.ListChangeMessages("go~master~I1")
+		},
+		method: "GET",
+		path:   "/changes/go~master~I1/messages",
+		reply: `[
+			{"id": "m1", "author": {"_account_id": 1000}, "date": "2015-03-04 05:06:07.000000000", "message": "Uploaded patch set 1.", "_revision_number": 1, "tag": "autogenerated:gerrit:newPatchSet"},
+			{"id": "m2", "date": "2015-03-05 05:06:07.000000000", "message": "Patch Set 1: Code-Review+2", "_revision_number": 1}
+		]`,
+		want: []*ChangeMessageInfo{
+			{ID: "m1", Author: &AccountInfo{NumericID: 1000}, Time: mustTime("2015-03-04 05:06:07"), Message: "Uploaded patch set 1.", RevisionNumber: 1, Tag: "autogenerated:gerrit:newPatchSet"},
+			{ID: "m2", Time: mustTime("2015-03-05 05:06:07"), Message: "Patch Set 1: Code-Review+2", RevisionNumber: 1},
+		},
+	}})
+}
+
+func TestChangeWithoutOwner(t *testing.T) {
+	// Gerrit omits the owner of changes whose owner account
+	// has been deleted or is not visible to the caller.
+	runClientTests(t, []clientTest{{
+		name: "GetChangeDetail",
+		call: func(c *Client) (interface{}, error) {
+			return c.GetChangeDetail("1234")
+		},
+		method: "GET",
+		path:   "/changes/1234/detail",
+		reply:  `{"id": "go~master~I1", "_number": 1234, "subject": "orphan"}`,
+		want:   &ChangeInfo{ID: "go~master~I1", ChangeNumber: 1234, Subject: "orphan"},
+	}})
+}
+
+// A timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// urlError returns err as returned by http.Client.Do.
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "https://gerrit.test/changes/", Err: err}
+}
+
+// opError returns the error for a failed system call on a connection.
+func opError(errno syscall.Errno) error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", errno)}
+}
+
+var transientTests = []struct {
+	err  error
+	want bool
+}{
+	{io.ErrUnexpectedEOF, true},
+	{urlError(io.ErrUnexpectedEOF), true},
+	{urlError(timeoutError{}), true},
+	{urlError(opError(syscall.ECONNRESET)), true},
+	{urlError(opError(syscall.ECONNREFUSED)), true},
+	{&HTTPError{Res: &http.Response{StatusCode: http.StatusServiceUnavailable}}, true},
+
+	{urlError(&net.DNSError{Err: "no such host", Name: "gerrit.test", IsNotFound: true}), false},
+	{urlError(x509.UnknownAuthorityError{}), false},
+	{urlError(fmt.Errorf("unsupported protocol scheme %q", "htp")), false},
+	{&HTTPError{Res: &http.Response{StatusCode: http.StatusTooManyRequests}}, false},
+	{&HTTPError{Res: &http.Response{StatusCode: http.StatusNotFound}}, false},
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tt := range transientTests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%#v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRobotCommentJSON(t *testing.T) {
+	// robotCommentPlain must list the same fields as RobotCommentInfo.
+	if n, m := reflect.TypeOf(robotCommentPlain{}).NumField(), reflect.TypeOf(RobotCommentInfo{}).NumField(); n != m {
+		t.Fatalf("robotCommentPlain has %d fields, RobotCommentInfo has %d", n, m)
+	}
+
+	in := `{"id": "r1", "message": "m", "robot_id": "vet", "robot_run_id": "run1", "properties": {"k": "v"}, "commit_id": "deadbeef"}`
+	var c RobotCommentInfo
+	if err := json.Unmarshal([]byte(in), &c); err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jsonEqual(string(out), in) {
+		t.Errorf("round trip:\n%s\nwant:\n%s", out, in)
+	}
+}
+
+func TestTimeStampJSON(t *testing.T) {
+	// Gerrit timestamps are always in UTC, whatever the time's location.
+	ts := TimeStamp(time.Date(2015, 3, 4, 14, 6, 7, 0, time.FixedZone("UTC+9", 9*60*60)))
+	data, err := json.Marshal(&ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"2015-03-04 05:06:07"`; string(data) != want {
+		t.Errorf("json.Marshal = %s, want %s", data, want)
+	}
+	var back TimeStamp
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !back.Time().Equal(ts.Time()) {
+		t.Errorf("round trip = %v, want %v", back.Time(), ts.Time())
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gerrit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// NewTestClient returns a client that sends its requests
+// to the handler h instead of a real Gerrit server.
+// It is meant for testing code that uses a Client:
+// h can check the request method, path, query, and body
+// and reply with a recorded Gerrit response.
+// Like a real Gerrit server, h must begin JSON responses
+// with the XSRF-defeating line ")]}'".
+//
+// The client is unauthenticated, so request paths
+// do not have the "/a" prefix.
+func NewTestClient(h http.Handler) *Client {
+	c := NewClient("http://gerrit.test", NoAuth)
+	c.HTTPClient = &http.Client{Transport: handlerTransport{h}}
+	return c
+}
+
+// A handlerTransport is an http.RoundTripper
+// that serves requests by calling a handler directly.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A server request always has a body, even if empty,
+	// but a RoundTripper must not modify the client's request.
+	sreq := req
+	if req.Body == nil {
+		r := *req
+		r.Body = http.NoBody
+		sreq = &r
+	}
+	w := &responseRecorder{header: make(http.Header)}
+	t.h.ServeHTTP(w, sreq)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.code, http.StatusText(w.code)),
+		StatusCode:    w.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// A responseRecorder is an http.ResponseWriter
+// that saves the response in memory.
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) Header() http.Header { return w.header }
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
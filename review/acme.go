@@ -11,16 +11,21 @@ import (
 	"flag"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"9fans.net/go/acme"
 	"9fans.net/go/draw"
+	"rsc.io/gerrit/internal/gerrit"
 )
 
 func acmeMode() {
 	var dummy awin
-	dummy.prefix = "/gerrit/go/" // XXX
+	dummy.prefix = "/gerrit/" + serverName(server) + "/"
+	dryRunOut = dummy.err
 	if flag.NArg() > 0 {
 		// TODO(rsc): Without -a flag, the query is concatenated into one query.
 		// Decide which behavior should be used, and use it consistently.
@@ -37,6 +42,16 @@ func acmeMode() {
 	select {}
 }
 
+// serverName returns the short name for the Gerrit server host
+// used in acme window names: "go" for go-review.googlesource.com,
+// or else the host name itself.
+func serverName(host string) string {
+	if name := strings.TrimSuffix(host, ".googlesource.com"); name != host {
+		return strings.TrimSuffix(name, "-review")
+	}
+	return host
+}
+
 const (
 	modeQuery = 1 + iota
 	modeCL
@@ -57,13 +72,20 @@ type awin struct {
 	title        string
 	cl           *CL
 	changeNumber int
-	basePatchSet int
+	base         string // base patch set number or commit ID
 	patchSet     int
+	context      int  // lines of diff context in a patch set window
+	side         bool // show a patch set window's diffs side by side
+	ignoreWS     bool // ignore whitespace changes in a patch set window
+	intraline    bool // mark changes within lines in a patch set window
+	showWS       bool // show invisible whitespace in a patch set window
+
+	deleteAsked time.Time // time of unconfirmed Delete command
 }
 
 var (
 	numRE      = regexp.MustCompile(`(?m)^([0-9]{4,})(\.[0-9]+)?(\.[0-9]+)?\t`)
-	patchSetRE = regexp.MustCompile(`(?m)^([0-9]{4,})(\.[0-9]+)?(\.[0-9]+)?$`)
+	patchSetRE = regexp.MustCompile(`(?m)^([0-9]{4,})(\.[0-9]+|\.[0-9a-f]{7,40})?(\.[0-9]+)?$`)
 )
 
 func (w *awin) look(text string) bool {
@@ -106,19 +128,31 @@ func (w *awin) look(text string) bool {
 func (w *awin) newCL(name string) {
 	w = w.new(name)
 	w.mode = modeCL
+	w.context = *flagContext
+	w.side = *flagSide
+	w.ignoreWS = *flagIgnoreWS
+	w.intraline = *flagIntraline
+	w.showWS = *flagShowWS
 	m := patchSetRE.FindStringSubmatch(name)
 	switch {
 	case len(m) == 0:
 		println("BAD", name)
 	case m[3] != "":
 		w.changeNumber, _ = strconv.Atoi(m[1])
-		w.basePatchSet, _ = strconv.Atoi(m[2][1:])
+		w.base = m[2][1:]
 		w.patchSet, _ = strconv.Atoi(m[3][1:])
 		w.mode = modePatchSet
 	case m[2] != "":
 		w.changeNumber, _ = strconv.Atoi(m[1])
-		w.patchSet, _ = strconv.Atoi(m[2][1:])
 		w.mode = modePatchSet
+		if n, err := strconv.Atoi(m[2][1:]); err == nil {
+			w.patchSet = n
+		} else {
+			// nnnn.commit names a base but no patch set:
+			// show the current patch set against it
+			// (patch set 0 means the current one).
+			w.base = m[2][1:]
+		}
 	default:
 		w.changeNumber, _ = strconv.Atoi(m[1])
 	}
@@ -148,6 +182,10 @@ func readBulkIDs(text []byte) []string {
 		if i := strings.Index(line, " "); i >= 0 {
 			line = line[:i]
 		}
+		// Allow clicks on ids in running text, like "(1234.4)",
+		// and the nnnn/b/p form, which names the same window as nnnn.b.p.
+		line = strings.Trim(line, "()[]{},;:.")
+		line = strings.Replace(line, "/", ".", -1)
 		if patchSetRE.MatchString(line) {
 			ids = append(ids, line)
 		}
@@ -155,30 +193,59 @@ func readBulkIDs(text []byte) []string {
 	return ids
 }
 
+// printQuery replaces the body of the list window w
+// with the list of changes all, preceded by a summary line
+// noting whether more changes match.
+// The summary goes above the list, where Sort and
+// bulk actions on the whole body do not mistake it for a change.
+func (w *awin) printQuery(all []*gerrit.ChangeInfo, more bool) {
+	var buf bytes.Buffer
+	n := printQuery(&buf, all)
+	w.clear()
+	if w.title == "search" {
+		w.Fprintf("body", "Search %s\n", w.query)
+		if f := queryFilter(); f != "" {
+			w.Fprintf("body", "Filter %s\n", f)
+		}
+	}
+	w.Fprintf("body", "%s\n\n", querySummary(n, more))
+	w.printTabbed(buf.String())
+}
+
 func (w *awin) load() {
 	w.fixfont()
 
 	switch w.mode {
 	case modeQuery:
-		var buf bytes.Buffer
+		if r := cachedQuery(w.query); r != nil {
+			w.printQuery(r.changes, r.more)
+			w.Ctl("clean")
+			break
+		}
+		// Redraw the list as each page of results arrives,
+		// so that large queries show something right away.
 		stop := w.blinker()
-		err := showQuery(&buf, w.query)
+		var shown []*gerrit.ChangeInfo
+		var more bool
+		err := searchIssuesPages(w.query, *flagLimit, func(all []*gerrit.ChangeInfo, m bool) {
+			w.printQuery(all, m)
+			shown, more = all, m
+		})
 		stop()
-		w.clear()
 		if err != nil {
+			if shown == nil {
+				w.clear()
+			}
 			w.Write("body", []byte(err.Error()))
 			break
 		}
-		if w.title == "search" {
-			w.Fprintf("body", "Search %s\n\n", w.query)
-		}
-		w.printTabbed(buf.String())
+		cacheQuery(w.query, shown, more)
 		w.Ctl("clean")
 
 	case modeCL:
 		var buf bytes.Buffer
 		stop := w.blinker()
-		cl, err := showCL(&buf, w.changeNumber)
+		cl, err := showCL(&buf, w.changeNumber, w.textWrap())
 		stop()
 		w.clear()
 		if err != nil {
@@ -188,11 +255,24 @@ func (w *awin) load() {
 		w.Write("body", buf.Bytes())
 		w.Ctl("clean")
 		w.cl = cl
+		w.Ctl("cleartag")
+		if cl.ChangeInfo.Status == "ABANDONED" {
+			w.Fprintf("tag", " Get Put Look Restore ")
+		} else {
+			w.Fprintf("tag", " Get Put Look ")
+		}
 
 	case modePatchSet:
 		var buf bytes.Buffer
 		stop := w.blinker()
-		cl, err := showPatchSet(&buf, w.changeNumber, w.basePatchSet, w.patchSet)
+		view := diffView{context: w.context, ignoreWS: w.ignoreWS, intraline: w.intraline, showWS: w.showWS}
+		view.wrap = w.textWrap()
+		if w.side {
+			if view.width = w.columns(); view.width == 0 {
+				view.width = 160
+			}
+		}
+		cl, err := showPatchSet(&buf, w.changeNumber, w.base, w.patchSet, view)
 		stop()
 		w.clear()
 		if err != nil {
@@ -223,7 +303,12 @@ func (w *awin) put() {
 		if w.mode == modeCL {
 			err = writeCL(w.cl, data)
 		} else {
-			err = writePatchSet(w.cl, data)
+			// A selection in the body gives the range
+			// for a new comment written just below it.
+			w.Ctl("addr=dot")
+			q0, q1, _ := w.ReadAddr()
+			text := string(data)
+			err = writePatchSet(w.cl, data, byteOffset(text, q0), byteOffset(text, q1))
 		}
 		if err != nil {
 			w.err(err.Error())
@@ -237,12 +322,12 @@ func (w *awin) put() {
 }
 
 func (w *awin) submit() {
-	if *flagN {
-		w.err("submit")
+	if blocked := submitBlockers(w.cl.ChangeInfo); len(blocked) > 0 {
+		w.err("Submit: not submittable: " + strings.Join(blocked, ", "))
 		return
 	}
 	stop := w.blinker()
-	err := client.Submit(w.cl.ChangeInfo.ID)
+	err := client.Submit(w.cl.ChangeInfo.ID, nil)
 	stop()
 	if err != nil {
 		w.err(fmt.Sprintf("Submit: %v", err))
@@ -252,27 +337,531 @@ func (w *awin) submit() {
 }
 
 func (w *awin) abandon() {
-	if *flagN {
-		w.err("abandon")
+	// Use the comment typed into the window, if any, as the reason.
+	data, err := w.ReadAll("body")
+	if err != nil {
+		w.err(fmt.Sprintf("Abandon: %v", err))
 		return
 	}
+	opt := &gerrit.AbandonInput{Message: clComment(string(data))}
 	stop := w.blinker()
-	err := client.Abandon(w.cl.ChangeInfo.ID)
+	err = client.Abandon(w.cl.ChangeInfo.ID, opt)
 	stop()
 	if err != nil {
 		w.err(fmt.Sprintf("Abandon: %v", err))
 		return
 	}
+	if *flagN {
+		// Keep the reason in the window: nothing was abandoned.
+		return
+	}
+	w.load()
+}
+
+// deleteConfirmTime is how long after a first Delete
+// a second one must come to confirm it.
+const deleteConfirmTime = 10 * time.Second
+
+// delete deletes the change, which must be owned by the user
+// and not merged. Because deletion cannot be undone,
+// the first Delete only asks for confirmation,
+// and a second Delete soon after deletes the change.
+func (w *awin) delete() {
+	ch := w.cl.ChangeInfo
+	if ch.Status == "MERGED" {
+		w.err("Delete: cannot delete merged change")
+		return
+	}
+	stop := w.blinker()
+	me, err := client.GetAccountInfo("self")
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("Delete: %v", err))
+		return
+	}
+	if !me.Equal(ch.Owner) {
+		w.err("Delete: can only delete your own changes")
+		return
+	}
+	if time.Since(w.deleteAsked) > deleteConfirmTime {
+		w.deleteAsked = time.Now()
+		w.err(fmt.Sprintf("Delete: execute Delete again to delete change %d permanently", ch.ChangeNumber))
+		return
+	}
+	w.deleteAsked = time.Time{}
+	stop = w.blinker()
+	err = client.DeleteChange(ch.ID)
+	stop()
+	switch {
+	case gerrit.IsConflict(err):
+		w.err("Delete: change cannot be deleted in its current state")
+		return
+	case gerrit.IsForbidden(err):
+		w.err("Delete: not permitted to delete change")
+		return
+	case err != nil:
+		w.err(fmt.Sprintf("Delete: %v", err))
+		return
+	}
+	if *flagN {
+		return
+	}
+	w.Ctl("del")
+}
+
+func (w *awin) restore() {
+	stop := w.blinker()
+	err := client.Restore(w.cl.ChangeInfo.ID, "")
+	stop()
+	if gerrit.IsConflict(err) {
+		w.err("Restore: change is not abandoned")
+		return
+	}
+	if err != nil {
+		w.err(fmt.Sprintf("Restore: %v", err))
+		return
+	}
+	w.load()
+}
+
+// checkout prints the git command that fetches and checks out
+// the window's patch set (in a CL window, the current patch set),
+// using the download scheme from the configuration file if the server offers it.
+func (w *awin) checkout() {
+	stop := w.blinker()
+	ch, err := client.GetChangeDetail(w.cl.ChangeInfo.ID, gerrit.QueryChangesOpt{
+		Fields: []string{"ALL_REVISIONS", "DOWNLOAD_COMMANDS"},
+	})
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("Checkout: %v", err))
+		return
+	}
+	revID := ch.CurrentRevision
+	if w.mode == modePatchSet {
+		revID = w.cl.PatchID
+	}
+	rev := ch.Revisions[revID]
+	if rev == nil || len(rev.Fetch) == 0 {
+		w.err("Checkout: server offers no download commands")
+		return
+	}
+	fetch := rev.Fetch[config.fetch]
+	if fetch == nil {
+		// Fall back to the first scheme the server offers.
+		var schemes []string
+		for scheme := range rev.Fetch {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+		fetch = rev.Fetch[schemes[0]]
+	}
+	cmd := fetch.Commands["Checkout"]
+	if cmd == "" {
+		cmd = fmt.Sprintf("git fetch %s %s && git checkout FETCH_HEAD", fetch.URL, fetch.Ref)
+	}
+	w.err(cmd)
+}
+
+// vote sets a single vote, like "Code-Review+2" or "CR+2" (see parseVote),
+// on the current patch set, leaving the rest of the review alone.
+func (w *awin) vote(text string) {
+	label, n, ok := parseVote(text)
+	if !ok {
+		w.err("usage: Vote Label+n")
+		return
+	}
+	if _, ok := w.cl.ChangeInfo.Labels[label]; !ok {
+		w.err(fmt.Sprintf("Vote: no label %s on this change", label))
+		return
+	}
+	votes := map[string]int{label: n}
+	if errs := gerrit.CheckVotes(w.cl.ChangeInfo, votes); len(errs) > 0 {
+		w.err(fmt.Sprintf("Vote: %v", errs[0]))
+		return
+	}
+	review := &gerrit.ReviewInput{Labels: votes, Drafts: "KEEP"}
+	stop := w.blinker()
+	err := client.SetReview(w.cl.ChangeInfo.ID, gerrit.CurrentRevision, review)
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("Vote: %v", err))
+		return
+	}
 	w.load()
 }
 
+func (w *awin) web() {
+	patch := 0
+	if w.mode == modePatchSet {
+		patch = w.patchSet
+	}
+	if err := openBrowser(webURL(w.changeNumber, w.base, patch)); err != nil {
+		w.err(fmt.Sprintf("Web: %v", err))
+	}
+}
+
+func (w *awin) rebase() {
+	stop := w.blinker()
+	_, err := client.RebaseChange(w.cl.ChangeInfo.ID, nil)
+	stop()
+	if gerrit.IsConflict(err) {
+		w.err("Rebase: change is up to date or cannot be rebased cleanly")
+		return
+	}
+	if err != nil {
+		w.err(fmt.Sprintf("Rebase: %v", err))
+		return
+	}
+	w.load()
+}
+
+func (w *awin) revert() {
+	stop := w.blinker()
+	ch, err := client.Revert(w.cl.ChangeInfo.ID, "")
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("Revert: %v", err))
+		return
+	}
+	if *flagN {
+		// There is no new change to show.
+		return
+	}
+	w.newCL(fmt.Sprint(ch.ChangeNumber))
+}
+
+func (w *awin) cherryPick(branch string) {
+	opt := &gerrit.CherryPickInput{Destination: branch}
+	stop := w.blinker()
+	ch, err := client.CherryPick(w.cl.ChangeInfo.ID, w.cl.ChangeInfo.CurrentRevision, opt)
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("Cherry-Pick: %v", err))
+		return
+	}
+	if *flagN {
+		return
+	}
+	w.newCL(fmt.Sprint(ch.ChangeNumber))
+}
+
+func (w *awin) move(branch string) {
+	stop := w.blinker()
+	_, err := client.MoveChange(w.cl.ChangeInfo.ID, branch, "")
+	stop()
+	switch {
+	case gerrit.IsConflict(err):
+		w.err(fmt.Sprintf("Move: cannot move change to %s: change must be open and not already on that branch", branch))
+		return
+	case gerrit.IsForbidden(err):
+		w.err(fmt.Sprintf("Move: not permitted to move change to %s", branch))
+		return
+	case err != nil:
+		w.err(fmt.Sprintf("Move: %v", err))
+		return
+	}
+	w.load()
+}
+
+func (w *awin) star(cmd string) {
+	stop := w.blinker()
+	var err error
+	if cmd == "Star" {
+		err = client.Star(w.cl.ChangeInfo.ID)
+	} else {
+		err = client.Unstar(w.cl.ChangeInfo.ID)
+	}
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("%s: %v", cmd, err))
+		return
+	}
+	// Starring does not change the update time,
+	// so the cached detail would not notice.
+	forgetChangeDetail(w.changeNumber)
+	w.load()
+}
+
+// toggleReviewed toggles the reviewed mark on the file
+// shown around rune offset q in a patch set window.
+func (w *awin) toggleReviewed(q int) {
+	file, err := w.fileAt(q)
+	if err != nil {
+		w.err(fmt.Sprintf("Reviewed: %v", err))
+		return
+	}
+	stop := w.blinker()
+	if w.cl.Reviewed[file] {
+		err = client.DeleteReviewed(w.cl.ChangeInfo.ID, w.cl.PatchID, file)
+	} else {
+		err = client.SetReviewed(w.cl.ChangeInfo.ID, w.cl.PatchID, file)
+	}
+	stop()
+	if err != nil {
+		w.err(fmt.Sprintf("Reviewed: %v", err))
+		return
+	}
+	w.load()
+}
+
+// fileAt returns the name of the file shown around rune offset q
+// in a patch set window, as given by the nearest "File" line
+// at or before q.
+func (w *awin) fileAt(q int) (string, error) {
+	data, err := w.ReadAll("body")
+	if err != nil {
+		return "", err
+	}
+	text := string(data)
+	i := byteOffset(text, q)
+	if j := strings.Index(text[i:], "\n"); j >= 0 {
+		i += j
+	} else {
+		i = len(text)
+	}
+	lines := strings.Split(text[:i], "\n")
+	for j := len(lines) - 1; j >= 0; j-- {
+		if strings.HasPrefix(lines[j], "File ") {
+			return fileLineName(lines[j]), nil
+		}
+	}
+	return "", fmt.Errorf("no file")
+}
+
+// reply starts a reply to the inline comment around rune offset q
+// in a patch set window: it inserts the quoted comment text
+// as a new draft just after the comment and leaves dot
+// on an empty line for the reply. On Put, writePatchSet saves
+// the draft as a reply to the comment preceding it.
+func (w *awin) reply(q int) {
+	data, err := w.ReadAll("body")
+	if err != nil {
+		w.err(fmt.Sprintf("Reply: %v", err))
+		return
+	}
+	text := string(data)
+	lines := strings.SplitAfter(text, "\n")
+
+	// Find the line holding q.
+	i, off := 0, 0
+	for pos := byteOffset(text, q); i < len(lines)-1 && off+len(lines[i]) <= pos; i++ {
+		off += len(lines[i])
+	}
+
+	// Find the comment header at or before that line,
+	// stopping at anything that is not part of a comment.
+	for ; i >= 0; i-- {
+		line := lines[i]
+		if inlineCommentRE.MatchString(line) {
+			break
+		}
+		if !isCont(line) {
+			i = -1
+			break
+		}
+	}
+	if i < 0 {
+		w.err("Reply: no comment selected")
+		return
+	}
+
+	// Quote the comment body and insert it after the comment.
+	var buf bytes.Buffer
+	j := i + 1
+	for ; j < len(lines) && isCont(lines[j]); j++ {
+		if line := strings.TrimSpace(lines[j]); line != "" {
+			fmt.Fprintf(&buf, "> %s\n", line)
+		}
+	}
+	buf.WriteString("\n")
+	end := 0
+	for _, line := range lines[:j] {
+		end += len(line)
+	}
+	q0 := utf8.RuneCountInString(text[:end])
+	w.Addr("#%d", q0)
+	w.Write("data", append(buf.Bytes(), "\n\n"...))
+	w.Addr("#%d", q0+utf8.RuneCount(buf.Bytes()))
+	w.Ctl("dot=addr")
+	w.Ctl("show")
+}
+
+// bulkVoteRE matches the argument to the bulk Vote command, like Code-Review+2.
+var bulkVoteRE = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*?)([+-]?[0-9]+)$`)
+
+// labelAbbrevs maps the label abbreviations accepted by the Vote command,
+// in upper case, to the full names of the labels used by the Go project.
+var labelAbbrevs = map[string]string{
+	"AS": "Auto-Submit",
+	"CQ": "Commit-Queue",
+	"CR": "Code-Review",
+	"H":  "Hold",
+	"TR": "Run-TryBot",
+	"V":  "Verified",
+}
+
+// parseVote parses a vote like "Code-Review+2", "Code-Review +2", or "CR+2",
+// returning the full label name and the value.
+func parseVote(text string) (label string, n int, ok bool) {
+	m := bulkVoteRE.FindStringSubmatch(strings.Join(strings.Fields(text), ""))
+	if m == nil {
+		return "", 0, false
+	}
+	label = m[1]
+	if full := labelAbbrevs[strings.ToUpper(label)]; full != "" {
+		label = full
+	}
+	n, _ = strconv.Atoi(m[2])
+	return label, n, true
+}
+
+// isVoteAbbrev reports whether cmd is an abbreviated vote like "CR+2",
+// which can be executed without the Vote command name.
+func isVoteAbbrev(cmd string) bool {
+	m := bulkVoteRE.FindStringSubmatch(cmd)
+	return m != nil && labelAbbrevs[strings.ToUpper(m[1])] != "" && (m[2][0] == '+' || m[2][0] == '-')
+}
+
+// bulk applies the action cmd to each change selected in a list window.
+// The actions are "Reviewer +name" and "Reviewer -name",
+// which add or remove a reviewer, and "Vote Label+n", which votes on a label
+// (see parseVote).
+func (w *awin) bulk(cmd string) {
+	f := strings.Fields(cmd)
+	if len(f) < 2 {
+		w.err(fmt.Sprintf("usage: %s", bulkUsage))
+		return
+	}
+	var apply func(id string) error
+	label, n, isVote := parseVote(strings.Join(f[1:], ""))
+	switch {
+	case f[0] == "Reviewer" && len(f) == 2 && (strings.HasPrefix(f[1], "+") || strings.HasPrefix(f[1], "-")):
+		name := f[1][1:]
+		add := f[1][0] == '+'
+		apply = func(id string) error {
+			var errbuf bytes.Buffer
+			who := findAccount(&CL{ChangeInfo: &gerrit.ChangeInfo{ID: id}}, name, &errbuf)
+			if who == "" {
+				return fmt.Errorf("%s", strings.TrimSpace(errbuf.String()))
+			}
+			if add {
+				_, err := client.AddReviewer(id, &gerrit.ReviewerInput{Reviewer: who})
+				return err
+			}
+			return client.DeleteReviewer(id, who)
+		}
+	case f[0] == "Vote" && isVote:
+		review := &gerrit.ReviewInput{
+			Labels: map[string]int{label: n},
+			Drafts: "KEEP",
+		}
+		apply = func(id string) error {
+			// Check the vote against the labels this change permits,
+			// rather than letting the server quietly ignore it.
+			ch, err := client.GetChangeDetail(id, gerrit.QueryChangesOpt{Fields: []string{"DETAILED_LABELS"}})
+			if err != nil {
+				return err
+			}
+			if errs := gerrit.CheckVotes(ch, review.Labels); len(errs) > 0 {
+				return errs[0]
+			}
+			return client.SetReview(id, gerrit.CurrentRevision, review)
+		}
+	default:
+		w.err(fmt.Sprintf("usage: %s", bulkUsage))
+		return
+	}
+
+	ids := readBulkIDs([]byte(w.selection()))
+	if len(ids) == 0 {
+		w.err(fmt.Sprintf("%s: no changes selected", cmd))
+		return
+	}
+	stop := w.blinker()
+	defer stop()
+	failed := 0
+	for _, id := range ids {
+		if i := strings.Index(id, "."); i >= 0 {
+			id = id[:i]
+		}
+		if err := apply(id); err != nil {
+			w.err(fmt.Sprintf("%s: %s: %v", cmd, id, err))
+			failed++
+		}
+	}
+	w.err(fmt.Sprintf("%s: %d changes, %d failed", cmd, len(ids), failed))
+}
+
+const bulkUsage = "Reviewer +name, Reviewer -name, or Vote Label+n"
+
+// hunkRE matches the lines that begin diff hunks and files in a patch set window.
+const hunkRE = `^(` + DiffPrefix + `@@ |File )`
+
+// nextHunk moves dot to the next (cmd == "Next") or previous (cmd == "Prev")
+// hunk or file header line in a patch set window.
+// Like acme's searches, it wraps around at the end of the window.
+func (w *awin) nextHunk(cmd string) {
+	dir := "/"
+	if cmd == "Prev" {
+		dir = "-/"
+	}
+	w.Ctl("addr=dot")
+	if err := w.Addr("%s%s/-+", dir, hunkRE); err != nil {
+		w.err(fmt.Sprintf("%s: no hunks", cmd))
+		return
+	}
+	w.Ctl("dot=addr")
+	w.Ctl("show")
+}
+
+// byteOffset returns the byte offset in text of rune offset q.
+func byteOffset(text string, q int) int {
+	i := 0
+	for ; q > 0 && i < len(text); q-- {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+	}
+	return i
+}
+
+// isWriteCommand reports whether executing cmd
+// changes code reviews on the server.
+func isWriteCommand(cmd string) bool {
+	if isVoteAbbrev(cmd) {
+		return true
+	}
+	if i := strings.Index(cmd, " "); i >= 0 {
+		cmd = cmd[:i]
+	}
+	switch cmd {
+	case "Put", "Submit", "Abandon", "Delete", "Restore", "Rebase", "Revert",
+		"Cherry-Pick", "Move", "Star", "Unstar", "Reviewed", "Reviewer", "Vote":
+		return true
+	}
+	return false
+}
+
 func (w *awin) loop() {
 	defer w.exit()
 	for e := range w.EventChan() {
 		switch e.C2 {
 		case 'x', 'X': // execute
 			cmd := strings.TrimSpace(string(e.Text))
+			if readOnly != "" && !*flagN && isWriteCommand(cmd) {
+				w.err(readOnly)
+				break
+			}
+			if isWriteCommand(cmd) {
+				forgetQueries()
+			}
 			if cmd == "Get" {
+				if w.mode == modeCL || w.mode == modePatchSet {
+					forgetChangeDetail(w.changeNumber)
+				}
+				if w.mode == modeQuery {
+					forgetQueries()
+				}
 				w.load()
 				break
 			}
@@ -293,7 +882,7 @@ func (w *awin) loop() {
 				break
 			}
 			if cmd == "Nop" {
-				*flagN = !*flagN
+				setDryRun(!*flagN)
 				w.err(fmt.Sprintf("flagN = %v\n", *flagN))
 				break
 			}
@@ -305,6 +894,193 @@ func (w *awin) loop() {
 				w.abandon()
 				break
 			}
+			if cmd == "Delete" {
+				if w.mode != modeCL {
+					w.err("can only delete top-level CL")
+					break
+				}
+				w.delete()
+				break
+			}
+			if cmd == "Restore" {
+				if w.mode != modeCL {
+					w.err("can only restore top-level CL")
+					break
+				}
+				w.restore()
+				break
+			}
+			if cmd == "Rebase" {
+				if w.mode != modeCL {
+					w.err("can only rebase top-level CL")
+					break
+				}
+				w.rebase()
+				break
+			}
+			if cmd == "Revert" {
+				if w.mode != modeCL {
+					w.err("can only revert top-level CL")
+					break
+				}
+				w.revert()
+				break
+			}
+			if cmd == "Cherry-Pick" || strings.HasPrefix(cmd, "Cherry-Pick ") {
+				if w.mode != modeCL {
+					w.err("can only cherry-pick top-level CL")
+					break
+				}
+				branch := strings.TrimSpace(strings.TrimPrefix(cmd, "Cherry-Pick"))
+				if branch == "" {
+					w.err("usage: Cherry-Pick branch")
+					break
+				}
+				w.cherryPick(branch)
+				break
+			}
+			if cmd == "Move" || strings.HasPrefix(cmd, "Move ") {
+				if w.mode != modeCL {
+					w.err("can only move top-level CL")
+					break
+				}
+				branch := strings.TrimSpace(strings.TrimPrefix(cmd, "Move"))
+				if branch == "" {
+					w.err("usage: Move branch")
+					break
+				}
+				w.move(branch)
+				break
+			}
+			if cmd == "Web" {
+				if w.mode != modeCL && w.mode != modePatchSet {
+					w.err("can only open review or patch set window in browser")
+					break
+				}
+				w.web()
+				break
+			}
+			if cmd == "Checkout" {
+				if w.mode != modeCL && w.mode != modePatchSet {
+					w.err("can only check out CL or patch set")
+					break
+				}
+				w.checkout()
+				break
+			}
+			if cmd == "Star" || cmd == "Unstar" {
+				if w.mode != modeCL {
+					w.err("can only star top-level CL")
+					break
+				}
+				w.star(cmd)
+				break
+			}
+			if cmd == "Reviewed" {
+				if w.mode != modePatchSet {
+					w.err("can only mark files reviewed in patch set window")
+					break
+				}
+				q := e.Q0
+				if e.C2 == 'x' {
+					// Executed in the tag; use the body's dot.
+					w.Ctl("addr=dot")
+					q, _, _ = w.ReadAddr()
+				}
+				w.toggleReviewed(q)
+				break
+			}
+			if cmd == "Reply" {
+				if w.mode != modePatchSet {
+					w.err("can only reply in patch set window")
+					break
+				}
+				q := e.Q0
+				if e.C2 == 'x' {
+					// Executed in the tag; use the body's dot.
+					w.Ctl("addr=dot")
+					q, _, _ = w.ReadAddr()
+				}
+				w.reply(q)
+				break
+			}
+			if cmd == "Context" || strings.HasPrefix(cmd, "Context ") {
+				if w.mode != modePatchSet {
+					w.err("can only set context in patch set window")
+					break
+				}
+				arg := strings.TrimSpace(strings.TrimPrefix(cmd, "Context"))
+				if arg == "" {
+					// Toggle between the default and a generous amount.
+					if w.context == *flagContext {
+						w.context = 25
+					} else {
+						w.context = *flagContext
+					}
+				} else if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+					w.context = n
+				} else {
+					w.err("usage: Context [n]")
+					break
+				}
+				w.load()
+				break
+			}
+			if cmd == "Side" {
+				if w.mode != modePatchSet {
+					w.err("can only show diffs side by side in patch set window")
+					break
+				}
+				w.side = !w.side
+				w.load()
+				break
+			}
+			if cmd == "Whitespace" {
+				if w.mode != modePatchSet {
+					w.err("can only ignore whitespace in patch set window")
+					break
+				}
+				w.ignoreWS = !w.ignoreWS
+				w.load()
+				break
+			}
+			if cmd == "Intraline" {
+				if w.mode != modePatchSet {
+					w.err("can only mark changes within lines in patch set window")
+					break
+				}
+				w.intraline = !w.intraline
+				w.load()
+				break
+			}
+			if cmd == "Next" || cmd == "Prev" {
+				if w.mode != modePatchSet {
+					w.err("can only move between hunks in patch set window")
+					break
+				}
+				w.nextHunk(cmd)
+				break
+			}
+			if cmd == "Vote" || strings.HasPrefix(cmd, "Vote ") || isVoteAbbrev(cmd) {
+				vote := strings.TrimSpace(strings.TrimPrefix(cmd, "Vote"))
+				switch w.mode {
+				case modeCL:
+					w.vote(vote)
+				case modeQuery:
+					w.bulk("Vote " + vote)
+				default:
+					w.err("can only vote in review and list windows")
+				}
+				break
+			}
+			if strings.HasPrefix(cmd, "Reviewer ") {
+				if w.mode != modeQuery {
+					w.err("can only apply bulk actions in list windows")
+					break
+				}
+				w.bulk(cmd)
+				break
+			}
 			if cmd == "Sort" {
 				if w.mode != modeQuery {
 					w.err("can only sort list windows")
@@ -0,0 +1,32 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var readBulkIDsTests = []struct {
+	text string
+	ids  []string
+}{
+	{"1234\tgo\tfix it\n", []string{"1234"}},
+	{"1234.4 (1235.2) [1236/2/3]\n", []string{"1234.4"}},
+	{"(1234.4)\n1235/2/3\n", []string{"1234.4", "1235.2.3"}},
+	{"12\tgo\ttoo short\n", nil},
+	{querySummary(1037, false) + "\n\n1234\tgo\tfix it\n", []string{"1234"}},
+	{querySummary(1037, true) + "\n", nil},
+	{"Search is:open\nFilter -project:scratch\n" + querySummary(2, false) + "\n\n1234\ta\n5678\tb\n", []string{"1234", "5678"}},
+}
+
+func TestReadBulkIDs(t *testing.T) {
+	for _, tt := range readBulkIDsTests {
+		ids := readBulkIDs([]byte(tt.text))
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("readBulkIDs(%q) = %q, want %q", tt.text, ids, tt.ids)
+		}
+	}
+}
@@ -113,6 +113,43 @@ func (w *awin) fixfont() {
 	w.font = font
 }
 
+// columns returns the width of the window body in characters,
+// assuming a fixed-width font, or 0 if the width is unknown.
+func (w *awin) columns() int {
+	ctl := make([]byte, 1000)
+	w.Seek("ctl", 0, 0)
+	n, err := w.Read("ctl", ctl)
+	if err != nil || w.font == nil {
+		return 0
+	}
+	f := strings.Fields(string(ctl[:n]))
+	if len(f) < 8 {
+		return 0
+	}
+	width, _ := strconv.Atoi(f[5])
+	if cw := w.font.StringWidth("0"); cw > 0 {
+		return width / cw
+	}
+	return 0
+}
+
+// textWrap returns the width to wrap text to in the window,
+// leaving room for a tab of indentation,
+// or wrapWidth if the window width is unknown.
+func (w *awin) textWrap() int {
+	cols := w.columns()
+	if cols == 0 {
+		return wrapWidth
+	}
+	if cw := w.font.StringWidth("0"); cw > 0 && w.tab > 0 {
+		cols -= (w.tab + cw - 1) / cw
+	}
+	if cols < 40 {
+		cols = 40
+	}
+	return cols
+}
+
 func (w *awin) blinker() func() {
 	c := make(chan struct{})
 	go func() {
@@ -0,0 +1,187 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/gerrit/internal/gerrit"
+)
+
+// detailFields are the fields fetched by getChangeDetail.
+var detailFields = []string{
+	"ALL_REVISIONS",
+	"DETAILED_ACCOUNTS",
+	"DETAILED_LABELS",
+	"ALL_COMMITS",
+	"ALL_FILES",
+	"MESSAGES",
+	"REVIEWED",
+	"SUBMITTABLE",
+}
+
+// A cachedDetail is the content of a cache file.
+type cachedDetail struct {
+	// Updated is the change's update time, in UTC,
+	// stored apart from the detail so that comparing it
+	// does not depend on how TimeStamps are encoded.
+	Updated time.Time
+	Change  *gerrit.ChangeInfo
+}
+
+// fresh reports whether the cached detail d is still good
+// for the change ch returned by a query.
+// Starring a change or reviewing it does not change its
+// update time, so those must be compared separately.
+func (d *cachedDetail) fresh(ch *gerrit.ChangeInfo) bool {
+	return d.Change != nil &&
+		ch.Updated.Time().UTC().Equal(d.Updated) &&
+		ch.Starred == d.Change.Starred &&
+		ch.Reviewed == d.Change.Reviewed
+}
+
+// cacheFile returns the name of the file caching the detail for change id,
+// or "" if there is no cache directory.
+func cacheFile(id int) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "review", server, fmt.Sprintf("%d.json", id))
+}
+
+// getChangeDetail returns the detail for change id.
+// It keeps the last detail fetched for each change in a cache file
+// and reuses it as long as the change has not been updated
+// (or starred or reviewed) since, which costs only a small query
+// instead of the full detail.
+// The cache is best effort: any problem with it is ignored.
+func getChangeDetail(id int) (*gerrit.ChangeInfo, error) {
+	file := cacheFile(id)
+	if file != "" {
+		if data, err := ioutil.ReadFile(file); err == nil {
+			var cached cachedDetail
+			if json.Unmarshal(data, &cached) == nil {
+				chs, err := client.QueryChanges(fmt.Sprintf("change:%d", id), gerrit.QueryChangesOpt{
+					N:      1,
+					Fields: []string{"REVIEWED"},
+				})
+				if err == nil && len(chs) == 1 && cached.fresh(chs[0]) {
+					return cached.Change, nil
+				}
+			}
+		}
+	}
+
+	fields := detailFields
+	if ok, _ := client.ServerVersionAtLeast(3, 5); ok {
+		fields = append(fields[:len(fields):len(fields)], "SUBMIT_REQUIREMENTS")
+	}
+	ch, err := client.GetChangeDetail(fmt.Sprint(id), gerrit.QueryChangesOpt{Fields: fields})
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		writeCacheFile(file, &cachedDetail{ch.Updated.Time().UTC(), ch})
+	}
+	return ch, nil
+}
+
+// writeCacheFile writes d to the cache file.
+// It writes a new temporary file and renames it,
+// so that a concurrent reader never sees a partial file,
+// and windows caching the same change at once do not
+// write over each other's temporary files.
+func writeCacheFile(file string, d *cachedDetail) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(file)
+	os.MkdirAll(dir, 0777)
+	f, err := ioutil.TempFile(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// forgetChangeDetail removes the cached detail for change id,
+// so that the next getChangeDetail fetches it from the server.
+func forgetChangeDetail(id int) {
+	if file := cacheFile(id); file != "" {
+		os.Remove(file)
+	}
+}
+
+// queryCacheTTL is how long a list window reuses cached query results.
+const queryCacheTTL = 2 * time.Minute
+
+// queryCache holds the results of recent queries, so that reopening
+// a list window redraws it right away instead of querying the server again.
+// Unlike the change details, the results are only kept in memory.
+var queryCache struct {
+	sync.Mutex
+	m map[string]*queryResult // keyed by normalized query
+}
+
+type queryResult struct {
+	time    time.Time
+	changes []*gerrit.ChangeInfo
+	more    bool // more changes match than the -limit flag allowed
+}
+
+// queryKey returns the normalized form of q used as the queryCache key.
+func queryKey(q string) string {
+	return strings.Join(strings.Fields(q), " ")
+}
+
+// cachedQuery returns the cached results for query q,
+// if they are younger than queryCacheTTL.
+func cachedQuery(q string) *queryResult {
+	queryCache.Lock()
+	defer queryCache.Unlock()
+	r := queryCache.m[queryKey(q)]
+	if r == nil || time.Since(r.time) > queryCacheTTL {
+		return nil
+	}
+	return r
+}
+
+// cacheQuery records chs as the results for query q,
+// with more reporting whether more changes match.
+func cacheQuery(q string, chs []*gerrit.ChangeInfo, more bool) {
+	queryCache.Lock()
+	defer queryCache.Unlock()
+	if queryCache.m == nil {
+		queryCache.m = make(map[string]*queryResult)
+	}
+	queryCache.m[queryKey(q)] = &queryResult{time.Now(), chs, more}
+}
+
+// forgetQueries empties the query cache,
+// because a code review has changed or is about to,
+// making any cached results stale.
+func forgetQueries() {
+	queryCache.Lock()
+	defer queryCache.Unlock()
+	queryCache.m = nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// config holds the settings read from the configuration file.
+var config struct {
+	email  string            // how to show email addresses: "local" or "full"
+	nick   map[string]string // nicknames, keyed by email address
+	query  map[string]string // saved queries, keyed by name
+	filter map[string]string // implicit search filters, keyed by server host
+	fetch  string            // preferred download scheme, like "http" or "ssh"
+}
+
+// defaultFilter is the implicit search filter for servers
+// without a filter setting.
+const defaultFilter = "is:open -project:scratch -message:do-not-review"
+
+// defaultQueries are the saved queries available without configuration.
+var defaultQueries = map[string]string{
+	"mine": "owner:self is:open",
+	"todo": "reviewer:self is:open -owner:self",
+}
+
+// configFile returns the name of the configuration file.
+func configFile() string {
+	return os.Getenv("HOME") + "/.reviewrc"
+}
+
+// readConfig reads the configuration file, if it exists.
+// Each line is a setting name followed by its arguments.
+// Blank lines and lines beginning with # are ignored.
+func readConfig(file string) {
+	config.email = "local"
+	config.nick = make(map[string]string)
+	config.query = make(map[string]string)
+	config.filter = make(map[string]string)
+	config.fetch = "http"
+	for name, q := range defaultQueries {
+		config.query[name] = q
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		return
+	}
+	for i, line := range lines(string(data)) {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		switch f[0] {
+		default:
+			log.Fatalf("%s:%d: unknown setting %s", file, i+1, f[0])
+
+		case "email":
+			if len(f) != 2 || f[1] != "local" && f[1] != "full" {
+				log.Fatalf("%s:%d: usage: email local|full", file, i+1)
+			}
+			config.email = f[1]
+
+		case "nick":
+			if len(f) != 3 {
+				log.Fatalf("%s:%d: usage: nick email name", file, i+1)
+			}
+			config.nick[f[1]] = f[2]
+
+		case "query":
+			if len(f) < 3 {
+				log.Fatalf("%s:%d: usage: query name search", file, i+1)
+			}
+			config.query[f[1]] = strings.Join(f[2:], " ")
+
+		case "filter":
+			if len(f) < 2 {
+				log.Fatalf("%s:%d: usage: filter host [search...]", file, i+1)
+			}
+			config.filter[f[1]] = strings.Join(f[2:], " ")
+
+		case "fetch":
+			if len(f) < 2 {
+				log.Fatalf("%s:%d: usage: fetch scheme", file, i+1)
+			}
+			config.fetch = strings.Join(f[1:], " ")
+		}
+	}
+}
+
+// expandQuery returns the search for the query q,
+// which is either the name of a saved query or a search itself.
+func expandQuery(q string) string {
+	if x, ok := config.query[strings.TrimSpace(q)]; ok {
+		return x
+	}
+	return q
+}
+
+// queryFilter returns the implicit filter added to every search
+// on the current server, or "" for none.
+func queryFilter() string {
+	if f, ok := config.filter[server]; ok {
+		return f
+	}
+	return defaultFilter
+}
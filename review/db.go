@@ -0,0 +1,185 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"rsc.io/gerrit/internal/gerrit"
+	_ "rsc.io/sqlite"
+)
+
+// A dbSource is a reviewSource reading from a reviewdb database,
+// for reviewing without a network connection.
+// The database holds only the change details and published comments,
+// so there are no drafts, no reviewed marks, and no diffs.
+// The database is SQLite, so reading it needs cgo (see nodb.go).
+type dbSource struct {
+	db   *sql.DB
+	host string
+}
+
+// openDB opens the reviewdb database file for the Gerrit server host.
+func openDB(file, host string) (reviewSource, error) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return nil, err
+	}
+	return &dbSource{db: db, host: host}, nil
+}
+
+var errOffline = errors.New("not available from database")
+
+// raw reads the stored JSON for the change with the given column
+// (Number or ID) equal to key.
+func (s *dbSource) raw(column string, key interface{}) (info, comments []byte, err error) {
+	row := s.db.QueryRow("select ChangeInfo, Comments from RawJSON where Host = ? and "+column+" = ?", s.host, key)
+	if err := row.Scan(&info, &comments); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("change %v not found in database", key)
+		}
+		return nil, nil, err
+	}
+	return info, comments, nil
+}
+
+func (s *dbSource) ChangeDetail(id int) (*gerrit.ChangeInfo, error) {
+	info, _, err := s.raw("Number", id)
+	if err != nil {
+		return nil, err
+	}
+	var ch gerrit.ChangeInfo
+	if err := json.Unmarshal(info, &ch); err != nil {
+		return nil, fmt.Errorf("change %d: %v", id, err)
+	}
+	return &ch, nil
+}
+
+// change is like ChangeDetail but looks the change up by its ID.
+func (s *dbSource) change(changeID string) (*gerrit.ChangeInfo, map[string][]*gerrit.CommentInfo, error) {
+	info, comments, err := s.raw("ID", changeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ch gerrit.ChangeInfo
+	if err := json.Unmarshal(info, &ch); err != nil {
+		return nil, nil, fmt.Errorf("change %s: %v", changeID, err)
+	}
+	msgs := make(map[string][]*gerrit.CommentInfo)
+	if len(comments) > 0 {
+		if err := json.Unmarshal(comments, &msgs); err != nil {
+			return nil, nil, fmt.Errorf("change %s comments: %v", changeID, err)
+		}
+	}
+	return &ch, msgs, nil
+}
+
+// ListReviewers returns the accounts that voted on the change,
+// which is all the database records about reviewers.
+func (s *dbSource) ListReviewers(changeID string) ([]*gerrit.AccountInfo, error) {
+	ch, _, err := s.change(changeID)
+	if err != nil {
+		return nil, err
+	}
+	var list []*gerrit.AccountInfo
+	seen := make(map[int64]bool)
+	for _, label := range ch.Labels {
+		for _, v := range label.All {
+			if !seen[v.NumericID] {
+				seen[v.NumericID] = true
+				a := v.AccountInfo
+				list = append(list, &a)
+			}
+		}
+	}
+	return list, nil
+}
+
+// revision returns the revision of ch with the given ID,
+// which may be gerrit.CurrentRevision, or nil if there is none.
+func revision(ch *gerrit.ChangeInfo, revID string) *gerrit.RevisionInfo {
+	if revID == gerrit.CurrentRevision {
+		revID = ch.CurrentRevision
+	}
+	return ch.Revisions[revID]
+}
+
+func (s *dbSource) ListChangeComments(changeID string) (map[string][]*gerrit.CommentInfo, error) {
+	_, msgs, err := s.change(changeID)
+	return msgs, err
+}
+
+func (s *dbSource) ListChangeDrafts(changeID string) (map[string][]*gerrit.CommentInfo, error) {
+	return nil, nil
+}
+
+// ListRevisionComments returns the stored comments on the revision.
+func (s *dbSource) ListRevisionComments(changeID, revID string) (map[string][]*gerrit.CommentInfo, error) {
+	ch, msgs, err := s.change(changeID)
+	if err != nil {
+		return nil, err
+	}
+	rev := revision(ch, revID)
+	if rev == nil {
+		return nil, fmt.Errorf("change %s: unknown revision %s", changeID, revID)
+	}
+	out := make(map[string][]*gerrit.CommentInfo)
+	for file, list := range msgs {
+		for _, m := range list {
+			if m.PatchSet == rev.PatchSetNumber {
+				out[file] = append(out[file], m)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (s *dbSource) ListRevisionRobotComments(changeID, revID string) (map[string][]*gerrit.RobotCommentInfo, error) {
+	return nil, nil
+}
+
+func (s *dbSource) ListRevisionDrafts(changeID, revID string) (map[string][]*gerrit.CommentInfo, error) {
+	return nil, nil
+}
+
+func (s *dbSource) GetCommit(changeID, revID string) (*gerrit.CommitInfo, error) {
+	ch, _, err := s.change(changeID)
+	if err != nil {
+		return nil, err
+	}
+	if rev := revision(ch, revID); rev != nil && rev.Commit != nil {
+		return rev.Commit, nil
+	}
+	return nil, fmt.Errorf("commit for change %s revision %s: %v", changeID, revID, errOffline)
+}
+
+func (s *dbSource) ListFiles(changeID, revID string, opts ...gerrit.ListFilesOpt) (map[string]*gerrit.FileInfo, error) {
+	ch, _, err := s.change(changeID)
+	if err != nil {
+		return nil, err
+	}
+	if rev := revision(ch, revID); rev != nil && rev.Files != nil && (len(opts) == 0 || opts[0].Base == "") {
+		return rev.Files, nil
+	}
+	return nil, fmt.Errorf("files for change %s revision %s: %v", changeID, revID, errOffline)
+}
+
+func (s *dbSource) ListReviewedFiles(changeID, revID string) ([]string, error) {
+	return nil, nil
+}
+
+func (s *dbSource) GetDiff(changeID, revID, filePath string, opts ...gerrit.GetDiffOpt) (*gerrit.DiffInfo, error) {
+	return nil, fmt.Errorf("diff of %s: %v", filePath, errOffline)
+}
+
+func (s *dbSource) GetIncludedIn(changeID string) (*gerrit.IncludedInInfo, error) {
+	return nil, fmt.Errorf("branches including %s: %v", changeID, errOffline)
+}
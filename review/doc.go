@@ -5,11 +5,14 @@
 /*
 Review is a client for reading and updating code reviews on a Gerrit server.
 
-	usage: review [-a] [-e] [-h server] <query>
+	usage: review [-a] [-e] [-json] [-v] [-web] [-db file] [-h server] <query>
 
 Review runs the query against the Gerrit server and prints a table of
 matching code reviews, sorted by code review summary.
 The default server is go-review.googlesource.com.
+The -h flag selects a different server, as in "-h gerrit-review.googlesource.com".
+For a server hosted under a path rather than at the root of its host,
+include the path, as in "-h gerrit.example.com/gerrit".
 
 If multiple arguments are given as the query, review joins them by spaces
 to form a single code review search. These two commands are equivalent:
@@ -17,7 +20,23 @@ to form a single code review search. These two commands are equivalent:
 	issue file:runtime reviewer:rsc
 	issue "file:runtime reviewer:rsc"
 
-Searches are always limited to pending reviews.
+Searches are limited by an implicit filter, which by default is
+"is:open -project:scratch -message:do-not-review": pending reviews
+outside the scratch project and not marked do-not-review.
+The filter can be changed for each server in the configuration file
+(see below).
+
+By default, search results are sorted by project and then by summary.
+The -sort flag selects a different order: -sort=number sorts by
+decreasing code review number, and -sort=updated puts the most recently
+updated code reviews first. The -reverse flag reverses the order.
+The -project flag limits the results to code reviews in the given project.
+The -since flag limits them to code reviews updated within the given
+duration, as in "-since 3d" or "-since 12h", which is awkward to express
+in Gerrit's search syntax.
+The -limit flag fetches at most the given number of code reviews from the
+server, before the -project and -since flags apply, and then prints a
+summary line reporting how many were shown and whether more match.
 
 If the query is a single number N, review prints detailed information
 about the code review with that numeric ID.
@@ -28,6 +47,54 @@ about code review N's patch set P.
 If the query is of the form N/B/P, review prints detailed information
 about code review N's patch set P using patch set B as the base.
 
+The -web flag opens the code review or patch set in a web browser instead,
+for viewing things like rendered images that review cannot show.
+It runs the command in $BROWSER, if set, or else the system's usual
+command for opening URLs, such as xdg-open on Linux or open on macOS.
+
+The -json flag changes the output to JSON, for use by other programs.
+For a search, review prints a JSON array of code review summaries;
+for a single code review, it prints that review's summary.
+A summary is a JSON object with these fields:
+
+	number       code review number
+	project      project name
+	branch       target branch
+	subject      first line of the commit message
+	status       NEW, MERGED, or ABANDONED
+	owner        owner's email address
+	insertions   number of inserted lines
+	deletions    number of deleted lines
+	labels       non-zero votes, as a map from label name to a list of
+	             {"who": email address, "value": vote} objects
+	review       "approved" or "rejected" if someone voted the maximum
+	             or minimum Code-Review score (omitted otherwise)
+	updated      time of last update, in RFC 3339 format
+	submittable  whether the code review can be submitted (omitted if false)
+	starred      whether the caller starred the code review (omitted if false)
+	new          whether the caller is in the attention set or, on servers
+	             without attention sets, has not yet reviewed it
+	             (omitted if false)
+	wip          whether the code review is a work in progress (omitted if false)
+
+Following a Review
+
+	usage: review -f N
+
+Review -f prints the latest messages on code review N and then
+checks the server every few seconds, printing new messages,
+new patch sets, and status changes as they appear, like tail -f.
+It polls less often while the server reports being busy.
+Type an interrupt (usually ^C) to stop.
+
+Downloading Patches
+
+	usage: review download N[/P] [file]
+
+Review download writes code review N's patch set P (by default, the
+current patch set) to file (by default, N.P.patch) in the mailbox format
+used by git format-patch, ready to apply with git am.
+
 Authentication
 
 Review looks in the files $HOME/.netrc and $HOME/.gitcookies for
@@ -36,6 +103,123 @@ These are the files where Gerrit suggests storing authentication data
 for command-line use of the git command.
 Gerrit used to use $HOME/.netrc but now uses $HOME/.gitcookies.
 If you have neither, follow Gerrit's instructions to populate $HOME/.gitcookies.
+Without either, review can still read code reviews the server shows
+to anonymous users, but commands that would change a code review,
+such as publishing comments or submitting, fail with the message
+"read-only: no credentials found for" the server host.
+
+The -v flag logs each request to the server, with its result and timing,
+to standard error, for diagnosing authentication problems or slow responses.
+By default, review logs nothing.
+
+The -n flag makes a dry run: review still reads from the server, but instead
+of sending any request that would change a code review, it prints the
+request's method, URL, and JSON body, and carries on as if the request
+had succeeded. In acme, the report goes to the +Errors window,
+and executing Nop turns the dry run on or off.
+Because -n changes nothing, it works even without credentials.
+
+Caching
+
+Review caches the details of each code review it shows in a file
+in the user's cache directory (for example, $HOME/.cache/review on Linux).
+Before using a cached copy, review checks with the server that the code
+review has not been updated, starred, or unstarred since the copy was made.
+In acme, executing Get in a review or patch set window discards the cached copy.
+
+In acme, review also remembers the results of each search for two minutes,
+so that reopening a list window redraws it right away.
+Executing Get in a list window, or any command that changes a code review,
+discards the remembered results.
+
+Reading Offline
+
+The -db flag makes review read code reviews from a database file
+maintained by the reviewdb command instead of from the Gerrit server,
+so that reviews can be read without a network connection.
+The database holds only the details and published comments of each
+code review, so with -db review can show only single code reviews:
+drafts are unavailable, patch sets (N/P) cannot be shown for lack of diffs,
+and searches are not supported.
+With -db, review never writes to the server, as if -n were given.
+The database is SQLite, so -db works only in a review built with cgo.
+
+Publishing and Discarding Drafts
+
+	usage: review publish N [message]
+	       review discard N
+
+Review publish publishes all draft comments on code review N,
+on every patch set, along with the message, if given.
+Review discard deletes all draft comments on code review N.
+
+Looking Up People
+
+	usage: review whois <name>
+	       review whoami
+
+Review whois prints the name, email address, and user name
+of each account on the Gerrit server matching name.
+Review whoami prints the same for the account review authenticates as,
+or else reports whether the credentials for the server are missing or
+were rejected. It is a quick way to check that authentication is set up
+(see below).
+
+Listing Branches
+
+	usage: review branches <project>
+
+Review branches prints the branches and then the tags of project,
+one per line, each with the commit hash it refers to, like git ls-remote.
+
+Tracking a Review Queue
+
+	usage: review queue <query>
+
+Review queue runs the query and compares the result against the result
+from the last time the same query was run, reporting which code reviews
+are new, which have been updated, which are still waiting, and which
+have been resolved (are no longer pending or no longer match the query).
+For example, running "review queue reviewer:self" at the start of each
+day shows what has happened to your review queue since the day before.
+The query results are saved in $HOME/.reviewqueue.
+
+Configuration
+
+Review reads settings from $HOME/.reviewrc, if it exists.
+Each line gives a setting name followed by its arguments.
+Blank lines and lines beginning with # are ignored.
+The settings are:
+
+	email local|full
+		Show people by the local part of their email address (the default)
+		or by their full email address.
+
+	nick email name
+		Show the person with the given email address as name.
+
+	query name search...
+		Define a saved query: a query consisting of just name
+		runs the given search instead.
+
+	filter host [search...]
+		Use the given search as the implicit filter for searches
+		on the server host. With no search, there is no filter.
+
+	fetch scheme
+		Use the download scheme, such as http (the default) or ssh,
+		in the commands printed by Checkout (see below).
+
+There are two predefined saved queries, which can be redefined:
+
+	query mine owner:self is:open
+	query todo reviewer:self is:open -owner:self
+
+For example:
+
+	email full
+	nick rsc@golang.org rsc
+	query runtime file:^src/runtime/ reviewer:self
 
 Acme Editor Integration
 
@@ -51,29 +235,62 @@ a window (or navigate to an existing one).
 	nnnn        review nnnn
 	nnnn/p      review nnnn, patch set p
 	nnnn/b/p    review nnnn, base patch set b, patch set p
+	nnnn/c/p    review nnnn, base commit c (a commit hash), patch set p
+	nnnn/c      review nnnn, base commit c, current patch set
 	all         all pending code reviews
 
+Dots can be used in place of the slashes, as in the "Patch Set 4 (1234.4)"
+lines in a review window, and surrounding punctuation is ignored,
+so right clicking on the 1234.4 in that line opens patch set 4 of review 1234.
+Against a base commit, the window omits comments on the old side,
+which Gerrit places by the lines of the patch set's parent,
+and new comments can only be made on the new side.
+
 Executing "Search <query>" opens a new window showing the results
 of that search.
 
 Review List Window
 
-A review list window displays a list of pending code reviews.
+A review list window displays a list of pending code reviews,
+one per line, in aligned columns: code review number, project, summary,
+owner, size in lines added and removed, Code-Review votes, and status.
+The status shows +2 or -2 for a code review approved or rejected in
+Code-Review, ✓ if it can be submitted, ☆ if starred, NEW if you
+are in its attention set (on servers older than Gerrit 3.3, which have
+no attention sets, if you have not reviewed it), and WIP if it is
+a work in progress. A line above the list gives the number of code reviews
+listed, noting when the -limit flag left out some that match.
 For example:
 
+	showing XXX code reviews
+
 	XXX
 
 Like in any window, right clicking on a review number opens a window
 for that review.
 
 Executing "Search <query>" opens a review list window showing only
-the reviews matching the search. It shows the query in a header line.
+the reviews matching the search. It shows the query in a header line,
+followed by the implicit filter, if any.
 For example:
 
 	Search XXX
+	Filter is:open -project:scratch -message:do-not-review
+	showing XXX code reviews
 
 	XXX
 
+Bulk actions apply to every code review selected in a review list window.
+Select the lines for the code reviews and then execute one of:
+
+	Reviewer +name    add name as a reviewer
+	Reviewer -name    remove reviewer name
+	Vote Label+n      vote +n on the label, as in "Vote Code-Review+1"
+	                  or, abbreviated, "Vote CR+1" (see Review Window below)
+
+Any failures are reported in the +Errors window, including votes
+that a code review does not permit, which are not sent.
+
 Executing "Sort" in a review list window toggles between sorting by
 title and sorting by decreasing code review number.
 
@@ -189,6 +406,63 @@ and then shows the most recent patch set.
 	« bradfitz on Oct 16 18:08 » [12]
 	Damn Mac builder time skew/clock resolution issue again.
 
+The Reviewers line lists the reviewers, and the CC line below it lists the
+people only copied on the code review. Editing either line and executing Put
+adds or removes people; moving a name from one line to the other changes
+that person's role without removing them.
+An Assignee line, shown when the code review has an assignee,
+works the same way: editing it changes the assignee, and emptying it
+removes the assignee. On servers that support assignees, adding the line
+to a code review without one sets its assignee.
+
+By default, executing Put in a review window sends email about the
+review to everyone involved. To control who is notified, add a header line
+
+	Notify: OWNER
+
+before executing Put. The value is one of NONE, OWNER, OWNER_REVIEWERS, or ALL.
+The line is not saved: reloading the window returns to the default, ALL.
+Similarly, a header line "Tag: autogenerated:name" attaches a tag to the
+posted review message, which lets Gerrit's web interface fold it away
+as tool-generated noise.
+
+Executing "Vote Label+n" in a review window casts just that vote on the
+current patch set, without posting the rest of the window, as in
+"Vote Code-Review+2". Common labels can be abbreviated, and an abbreviated
+vote can be executed on its own, as in "CR+2":
+
+	AS   Auto-Submit
+	CQ   Commit-Queue
+	CR   Code-Review
+	H    Hold
+	TR   Run-TryBot
+	V    Verified
+
+Editing the indented commit message shown under the current patch set
+and executing Put changes the commit message, creating a new patch set.
+The message is shown with its lines as they are, not rewrapped,
+so the new message differs from the old only where it was edited.
+The edited message must keep the Change-Id line.
+
+Executing "Rebase" in a review window rebases the code review's current
+patch set. Executing "Revert" creates a new code review reverting this one,
+and executing "Cherry-Pick branch" creates a new code review applying
+the current patch set to the given branch; both open a window for the
+new code review.
+Executing "Move branch" moves the code review itself to the given branch,
+for fixing a code review uploaded for the wrong branch.
+
+Executing "Delete" in a review window deletes a code review you own that is
+not merged, such as an accidental upload. Because deletion cannot be undone,
+Delete must be executed twice within ten seconds.
+
+Executing "Checkout" in a review or patch set window prints, in the +Errors
+window, the git command to fetch and check out the current patch set (or
+the window's patch set), ready to run in a local copy of the repository.
+
+Executing "Web" in a review or patch set window opens the code review
+or patch set in a web browser, as with the -web flag.
+
 Patch Set Window
 
 	Owner: bradfitz
@@ -579,8 +853,56 @@ Patch Set Window
 	188		13/src/net/http/httptest/server.go
 	27		13/src/net/http/httptest/server_test.go
 
-
-
+Unsent draft comments are shown below a "Draft (unsent):" line and can be
+edited in place; deleting a draft's text deletes the draft. The review window
+lists all unsent drafts, on every file and patch set, at the end.
+
+Executing "Next" or "Prev" in a patch set window moves to the next
+or previous diff hunk or file.
+
+Patch set diffs show 3 lines of context around each change, or the number
+given by the -context flag. Executing "Context" in a patch set window
+switches between that and a much larger context; "Context n" shows n lines.
+
+Executing "Side" in a patch set window switches between unified diffs and
+side-by-side diffs, which show the old file on the left and the new file on
+the right, wrapped to the window width. The -side flag makes side-by-side
+diffs the default. In a side-by-side diff, a line marked ! shows a deleted
+line beside the line replacing it, and a line marked . continues the line
+above it. A comment typed below a ! line is saved on the new line, unless a
+selection in the left column says otherwise.
+
+Executing "Whitespace" in a patch set window switches between showing and
+ignoring changes in whitespace, such as reindented lines, which are then
+shown as unchanged. The -ignore-ws flag ignores whitespace by default.
+
+Executing "Intraline" in a patch set window switches between showing and
+hiding the marks around the changed text within each replaced line of a
+unified diff, as in "⋮-x := ⟦old⟧(y)". The -intraline flag shows the marks by
+default.
+
+The -show-ws flag makes the whitespace that is otherwise hard to see in patch
+set diffs visible, showing tabs as →, trailing spaces as ·, and carriage
+returns as ␍.
+
+When printing a patch set to a terminal, review colors the diffs: insertions
+green, deletions red, context dim, and hunk headers and file names bold.
+The -color flag controls this: -color=always colors even when the output is
+not a terminal, -color=never never colors, and the default, -color=auto,
+colors only on a terminal and only if $NO_COLOR is unset.
+Acme windows are never colored.
+
+To reply to a comment, select any part of it and execute Reply.
+Review inserts the quoted comment as a new draft just below the comment,
+with the cursor positioned for typing the reply. Any text typed just below
+a comment is saved as a reply to that comment.
+
+To comment on a range of lines rather than a single line, type the comment
+below the last line of the range, then select the lines (or part of them)
+and execute Put. The new comment is saved with the selection as its range.
+A comment on a range of lines is shown with the range in its header,
+as in "rsc (Oct 16 18:19): (lines 10-14)", and replies to it
+are attached to the same range.
 
 Alternate Editor Integration
 
@@ -591,8 +913,18 @@ temporary file, opens that file in the editor, waits for the editor
 to exit, and then applies any changes from the file to the actual
 code review.
 
-Not yet implemented.
+	usage: review -e N[/P]
+	       review -e N/B/P
+
+With a single number N, review edits the review window text for
+code review N, described above: edit the reviewers or scores,
+or type a new comment below the header lines.
+With N/P or N/B/P, review edits the patch set window text for
+code review N's patch set P (against base B), in which new text
+typed below a diff line is saved as a draft comment on that line.
 
-TODO: Describe what gets edited.
+If the file is unchanged when the editor exits, review does nothing.
+If applying the changes fails, review leaves the edited file in place
+and prints its name.
 */
 package main
@@ -8,6 +8,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"rsc.io/gerrit/internal/gerrit"
 )
@@ -24,113 +26,123 @@ func writeCL(old *CL, updated []byte) (xerr error) {
 	review.Labels = make(map[string]int)
 	review.Drafts = "PUBLISH_ALL_REVISIONS"
 
+	// Votes on behalf of other users, in order of appearance.
+	var behalf []*gerrit.ReviewInput
+
+	// Reviewers and CCs listed in the summary lines,
+	// and which of the two lines were present.
+	kept := make(map[string]bool)
+	if old.ChangeInfo.Owner != nil {
+		kept[old.ChangeInfo.Owner.Email] = true // why the owner is a reviewer I don't know!
+	}
+	seenState := make(map[string]bool)
+
 	parseError := false
-	off := 0
 	sdata := string(updated)
 	for _, origLine := range strings.SplitAfter(sdata, "\n") {
 		line := strings.TrimSpace(origLine)
 		if line == "" || strings.HasPrefix(line, "#") {
-			off += len(origLine)
 			continue
 		}
 		i := strings.Index(line, ":")
 		if i < 0 {
 			break
 		}
-		off += len(origLine)
 		key := strings.TrimSpace(line[:i])
 		value := strings.TrimSpace(line[i+1:])
 		if key == "Owner" {
 			continue
 		}
-		if key == "Reviewers" {
-			have := make(map[string]string)
-			for _, r := range old.Reviewers {
-				have[shortEmail(r.Email)] = r.Email
-				have[r.Email] = r.Email
+		if key == "Reviewers" || key == "CC" && old.CCs != nil {
+			state, list := "REVIEWER", old.Reviewers
+			if key == "CC" {
+				state, list = "CC", old.CCs
 			}
-			kept := make(map[string]bool)
-			kept[old.ChangeInfo.Owner.Email] = true // why the owner is a reviewer I don't know!
-			for _, f := range strings.Fields(value) {
-				if have[f] != "" {
-					kept[have[f]] = true
-					continue
-				}
-				q := f
-				if !strings.Contains(q, "@") {
-					q += "@"
-				}
-				if len(q) == 2 {
-					q += "go"
-				}
-				acct, err := client.SuggestReviewers(old.ChangeInfo.ID, q, 10)
-				if err != nil && len(f) >= 3 {
-					acct, err = client.SuggestReviewers(old.ChangeInfo.ID, q, 10)
-				}
-				if err != nil || len(acct) == 0 {
-					fmt.Fprintf(&errbuf, "unknown reviewer: %s\n", f)
-					continue
+			seenState[state] = true
+			addReviewers(old, state, list, value, kept, &errbuf)
+			continue
+		}
+		if key == "Notify" {
+			switch value {
+			case "NONE", "OWNER", "OWNER_REVIEWERS", "ALL":
+				review.Notify = value
+			default:
+				fmt.Fprintf(&errbuf, "invalid Notify value %q: want NONE, OWNER, OWNER_REVIEWERS, or ALL\n", value)
+				parseError = true
+			}
+			continue
+		}
+		if key == "Tag" {
+			review.Tag = value
+			continue
+		}
+		if key == "Assignee" {
+			var have string
+			if old.ChangeInfo.Assignee != nil {
+				have = old.ChangeInfo.Assignee.Email
+			}
+			if value == have || value == shortEmail(have) {
+				continue
+			}
+			if value == "" {
+				if _, err := client.DeleteAssignee(old.ChangeInfo.ID); err != nil {
+					fmt.Fprintf(&errbuf, "deleting assignee %s: %v\n", have, err)
 				}
-				n := 0
-				var best string
-				for _, r := range acct {
-					if r.Account == nil {
+				continue
+			}
+			if strings.Contains(value, " ") {
+				fmt.Fprintf(&errbuf, "multiple assignees: %s\n", value)
+				continue
+			}
+			best := findAccount(old, value, &errbuf)
+			if best == "" {
+				continue
+			}
+			if _, err := client.SetAssignee(old.ChangeInfo.ID, best); err != nil {
+				fmt.Fprintf(&errbuf, "setting assignee %s: %v\n", best, err)
+			}
+			continue
+		}
+		if _, ok := old.ChangeInfo.Labels[key]; ok {
+			for _, vote := range strings.Fields(value) {
+				if m := onBehalfVoteRE.FindStringSubmatch(vote); m != nil {
+					n, err := checkVote(old, key, m[1])
+					if err != nil {
+						fmt.Fprintf(&errbuf, "%v\n", err)
 						continue
 					}
-					email := r.Account.Email
-					if best == "" {
-						best = email
+					who := findAccount(old, m[2], &errbuf)
+					if who == "" {
+						continue
 					}
-					if strings.HasSuffix(email, "@golang.org") || strings.HasSuffix(email, "@google.com") {
-						n++
-						best = email
+					var r *gerrit.ReviewInput
+					for _, b := range behalf {
+						if b.OnBehalfOf == who {
+							r = b
+							break
+						}
 					}
-				}
-				if n > 1 || n == 0 && len(acct) > 1 {
-					fmt.Fprintf(&errbuf, "ambiguous reviewer %q:", f)
-					for _, r := range acct {
-						if r.Account == nil {
-							continue
+					if r == nil {
+						r = &gerrit.ReviewInput{
+							Labels:     make(map[string]int),
+							Drafts:     "KEEP",
+							OnBehalfOf: who,
 						}
-						email := r.Account.Email
-						fmt.Fprintf(&errbuf, " %s", email)
+						behalf = append(behalf, r)
 					}
-					fmt.Fprintf(&errbuf, "\n")
+					r.Labels[key] = n
 					continue
 				}
-				if *flagN {
-					fmt.Fprintf(&errbuf, "add reviewer %s\n", best)
-				} else {
-					_, err = client.AddReviewer(old.ChangeInfo.ID, &gerrit.ReviewerInput{Reviewer: best})
-					if err != nil {
-						fmt.Fprintf(&errbuf, "adding reviewer %s: %v\n", best, err)
-						continue
-					}
-				}
-				kept[best] = true
-			}
-			for _, r := range old.Reviewers {
-				if !kept[r.Email] {
-					if *flagN {
-						fmt.Fprintf(&errbuf, "delete reviewer %s\n", r.Email)
-					} else {
-						err := client.DeleteReviewer(old.ChangeInfo.ID, r.Email)
-						if err != nil {
-							fmt.Fprintf(&errbuf, "removing reviewer %s: %v\n", r.Email, err)
-						}
-					}
+				if !voteRE.MatchString(vote) {
+					// Someone else's vote, like rsc+2.
+					continue
 				}
-			}
-			continue
-		}
-		if _, ok := old.ChangeInfo.Labels[key]; ok {
-			allowed := old.ChangeInfo.PermittedLabels[key]
-			for _, vote := range strings.Fields(value) {
-				for _, x := range allowed {
-					if vote == strings.TrimSpace(x) {
-						review.Labels[key], _ = strconv.Atoi(vote)
-					}
+				n, err := checkVote(old, key, vote)
+				if err != nil {
+					fmt.Fprintf(&errbuf, "%v\n", err)
+					continue
 				}
+				review.Labels[key] = n
 			}
 			continue
 		}
@@ -138,25 +150,41 @@ func writeCL(old *CL, updated []byte) (xerr error) {
 		parseError = true
 	}
 
+	// Delete the reviewers and CCs no longer listed on either line,
+	// so that moving someone from one line to the other does not remove them.
+	if seenState["REVIEWER"] {
+		deleteReviewers(old, old.Reviewers, kept, &errbuf)
+	}
+	if seenState["CC"] {
+		deleteReviewers(old, old.CCs, kept, &errbuf)
+	}
+
 	if parseError {
 		return nil
 	}
 
-	marker := "\nPatch Set "
-	var comment string
-	if i := strings.Index(sdata, marker); i >= off {
-		comment = strings.TrimSpace(sdata[off:i])
+	// If the commit message was edited, set the new one
+	// after posting the review, since it creates a new patch set.
+	var newMsg string
+	rev := old.ChangeInfo.Revisions[old.ChangeInfo.CurrentRevision]
+	if msg, ok := editedCommitMessage(sdata); ok && rev != nil && rev.Commit != nil && unindent(msg) != unindent(indent(rev.Commit.Message)) {
+		newMsg = unindent(msg)
+		if err := checkChangeID(rev.Commit.Message, newMsg); err != nil {
+			fmt.Fprintf(&errbuf, "%v\n", err)
+			return nil
+		}
 	}
 
-	if comment == "<optional comment here>" {
-		comment = ""
+	// Report votes the user is not permitted to cast,
+	// rather than letting the server quietly ignore them.
+	for _, err := range gerrit.CheckVotes(old.ChangeInfo, review.Labels) {
+		fmt.Fprintf(&errbuf, "%v\n", err)
+		delete(review.Labels, err.Label)
 	}
 
-	review.Message = comment
-
-	if *flagN {
-		fmt.Fprintf(&errbuf, "publish review: %s\n", js(review))
-		return nil
+	review.Message = clComment(sdata)
+	for _, r := range behalf {
+		r.Notify = review.Notify
 	}
 
 	err := client.SetReview(old.ChangeInfo.ID, old.ChangeInfo.CurrentRevision, &review)
@@ -164,13 +192,324 @@ func writeCL(old *CL, updated []byte) (xerr error) {
 		fmt.Fprintf(&errbuf, "error publishing review: %v\n", err)
 	}
 
+	// Posting on behalf of another user requires the labelAs permission.
+	// If the caller does not have it, Gerrit rejects the whole request,
+	// so report each user separately.
+	for _, r := range behalf {
+		err := client.SetReview(old.ChangeInfo.ID, old.ChangeInfo.CurrentRevision, r)
+		if err != nil {
+			fmt.Fprintf(&errbuf, "error publishing review on behalf of %s: %v\n", r.OnBehalfOf, err)
+		}
+	}
+
+	if newMsg != "" {
+		if err := client.SetCommitMessage(old.ChangeInfo.ID, newMsg); err != nil {
+			fmt.Fprintf(&errbuf, "error setting commit message: %v\n", err)
+		}
+	}
+
+	if *flagN {
+		// Report the dry run as an error so that the edits stay on screen.
+		fmt.Fprintf(&errbuf, "dry run: nothing sent to the server\n")
+	}
+	return nil
+}
+
+// addReviewers adds the people listed in value, the text of
+// the Reviewers or CC summary line, to the change in the given state,
+// recording them in kept. The list holds the people already in that state;
+// anyone else is added or, if in the other state, moved.
+func addReviewers(old *CL, state string, list []*gerrit.AccountInfo, value string, kept map[string]bool, errbuf *bytes.Buffer) {
+	have := make(map[string]string)
+	for _, r := range list {
+		have[shortEmail(r.Email)] = r.Email
+		have[r.Email] = r.Email
+	}
+	for _, f := range strings.Fields(value) {
+		if have[f] != "" {
+			kept[have[f]] = true
+			continue
+		}
+		best := findAccount(old, f, errbuf)
+		if best == "" {
+			continue
+		}
+		what := "reviewer"
+		if state == "CC" {
+			what = "CC"
+		}
+		in := &gerrit.ReviewerInput{Reviewer: best}
+		if state == "CC" {
+			in.State = state
+		}
+		if _, err := client.AddReviewer(old.ChangeInfo.ID, in); err != nil {
+			fmt.Fprintf(errbuf, "adding %s %s: %v\n", what, best, err)
+			continue
+		}
+		kept[best] = true
+	}
+}
+
+// deleteReviewers removes the people in list who are not in kept
+// from the change.
+func deleteReviewers(old *CL, list []*gerrit.AccountInfo, kept map[string]bool, errbuf *bytes.Buffer) {
+	for _, r := range list {
+		if kept[r.Email] {
+			continue
+		}
+		if err := client.DeleteReviewer(old.ChangeInfo.ID, r.Email); err != nil {
+			fmt.Fprintf(errbuf, "removing reviewer %s: %v\n", r.Email, err)
+		}
+	}
+}
+
+// editedCommitMessage returns the commit message text,
+// still indented, from the text of a CL window:
+// the text between the blank line after the "Patch Set" line
+// and the "Author:" line.
+func editedCommitMessage(text string) (string, bool) {
+	i := strings.Index(text, "\nPatch Set ")
+	if i < 0 {
+		return "", false
+	}
+	text = text[i+1:]
+	i = strings.Index(text, "\n\n")
+	if i < 0 {
+		return "", false
+	}
+	text = text[i+2:]
+	i = strings.Index(text, "\tAuthor: ")
+	if i < 0 {
+		return "", false
+	}
+	return text[:i], true
+}
+
+// indent returns the commit message msg with a tab
+// added to the start of each line, as shown in a CL window.
+func indent(msg string) string {
+	return "\t" + strings.Replace(strings.TrimRight(msg, "\n"), "\n", "\n\t", -1) + "\n"
+}
+
+// unindent removes a leading tab from each line of the indented
+// commit message msg, returning a message ending in a newline.
+func unindent(msg string) string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n\t "), "\n") {
+		out = append(out, strings.TrimPrefix(line, "\t"))
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// checkChangeID checks that the edited commit message msg
+// keeps the Change-Id footer of the original message old,
+// without which Gerrit would not associate the commit with the change.
+func checkChangeID(old, msg string) error {
+	for _, line := range strings.Split(old, "\n") {
+		if strings.HasPrefix(line, "Change-Id: ") {
+			for _, l := range strings.Split(msg, "\n") {
+				if strings.TrimSpace(l) == strings.TrimSpace(line) {
+					return nil
+				}
+			}
+			return fmt.Errorf("edited commit message must keep %s", strings.TrimSpace(line))
+		}
+	}
 	return nil
 }
 
+// onBehalfVoteRE matches a vote like +2(alice@example.com)
+// in a label line, meaning +2 on behalf of alice@example.com.
+var onBehalfVoteRE = regexp.MustCompile(`^([+-]?[0-9]+)\((.+)\)$`)
+
+// voteRE matches a vote in a label line.
+var voteRE = regexp.MustCompile(`^[+-]?[0-9]+$`)
+
+// checkVote checks that vote is one of the values defined
+// for the label named key, returning the vote as an integer.
+// If the change does not list the label's values,
+// checkVote uses the project's label definition.
+// If the label's values are unknown, checkVote accepts any vote
+// and leaves the final decision to the server.
+func checkVote(old *CL, key, vote string) (int, error) {
+	n, err := strconv.Atoi(vote)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vote %s%s", key, vote)
+	}
+	values := old.ChangeInfo.Labels[key].Values
+	allowed := old.ChangeInfo.Labels[key].AllowedValues()
+	if len(allowed) == 0 {
+		if l := projectLabel(old.ChangeInfo.Project, key); l != nil {
+			values = l.Values
+			allowed = l.AllowedValues()
+		}
+	}
+	if len(allowed) == 0 {
+		return n, nil
+	}
+	for _, x := range allowed {
+		if x == n {
+			return n, nil
+		}
+	}
+	var list []string
+	for _, x := range allowed {
+		v := formatVote(x)
+		for k, desc := range values {
+			if strings.TrimSpace(k) == v && desc != "" {
+				v += " (" + desc + ")"
+			}
+		}
+		list = append(list, v)
+	}
+	return 0, fmt.Errorf("invalid vote %s%s: allowed values are %s", key, vote, strings.Join(list, ", "))
+}
+
+// projectConfigs caches the project configurations used by projectLabel.
+var projectConfigs struct {
+	sync.Mutex
+	m map[string]*gerrit.ConfigInfo
+}
+
+// projectLabel returns the definition of the label named key
+// in the project's configuration, or nil if it is unavailable.
+func projectLabel(project, key string) *gerrit.LabelTypeInfo {
+	projectConfigs.Lock()
+	defer projectConfigs.Unlock()
+	cfg, ok := projectConfigs.m[project]
+	if !ok {
+		// Remember failures too, so as not to ask again.
+		cfg, _ = client.GetProjectConfig(project)
+		if projectConfigs.m == nil {
+			projectConfigs.m = make(map[string]*gerrit.ConfigInfo)
+		}
+		projectConfigs.m[project] = cfg
+	}
+	if cfg == nil {
+		return nil
+	}
+	return cfg.Labels[key]
+}
+
+// formatVote formats the vote n as Gerrit does: -1, 0, +1.
+func formatVote(n int) string {
+	if n == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%+d", n)
+}
+
+// clComment returns the review comment in the text of a CL window:
+// the text between the summary lines at the top and the "Patch Set" line.
+func clComment(text string) string {
+	off := 0
+	for _, origLine := range strings.SplitAfter(text, "\n") {
+		line := strings.TrimSpace(origLine)
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.Contains(line, ":") {
+			break
+		}
+		off += len(origLine)
+	}
+
+	marker := "\nPatch Set "
+	var comment string
+	if i := strings.Index(text, marker); i >= off {
+		comment = strings.TrimSpace(text[off:i])
+	}
+
+	if comment == "<optional comment here>" {
+		comment = ""
+	}
+	return comment
+}
+
+// findAccount resolves the name f, as typed in a review window,
+// to the email address of a single account that can review old.
+// If f cannot be resolved, findAccount reports the problem to errbuf
+// and returns the empty string.
+func findAccount(old *CL, f string, errbuf *bytes.Buffer) string {
+	q := f
+	if !strings.Contains(q, "@") {
+		q += "@"
+	}
+	if len(q) == 2 {
+		q += "go"
+	}
+	opt := gerrit.SuggestReviewersOpt{ExcludeGroups: true}
+	acct, err := client.SuggestReviewers(old.ChangeInfo.ID, q, 10, opt)
+	if (err != nil || len(acct) == 0) && q != f && len(f) >= 3 {
+		// The query f@ only matches the start of email addresses.
+		// Try f alone, which also matches names.
+		acct, err = client.SuggestReviewers(old.ChangeInfo.ID, f, 10, opt)
+	}
+	if err != nil || len(acct) == 0 {
+		// People who have never been involved with the project
+		// may not be suggested; look for them directly.
+		list, err := client.QueryAccounts(f, 10)
+		if err != nil || len(list) == 0 {
+			fmt.Fprintf(errbuf, "unknown reviewer: %s\n", f)
+			return ""
+		}
+		acct = nil
+		for _, a := range list {
+			acct = append(acct, &gerrit.SuggestedReviewerInfo{Account: a})
+		}
+	}
+	// An exact match for the address or the user name wins outright.
+	// Matches for the part of the address before the @
+	// take precedence over looser matches.
+	var exact []*gerrit.SuggestedReviewerInfo
+	for _, r := range acct {
+		if a := r.Account; a != nil && a.Email != "" {
+			if a.Email == f || a.Username == f {
+				return a.Email
+			}
+			if strings.HasPrefix(a.Email, f+"@") {
+				exact = append(exact, r)
+			}
+		}
+	}
+	if len(exact) > 0 {
+		acct = exact
+	}
+	n := 0
+	var best string
+	for _, r := range acct {
+		if r.Account == nil {
+			continue
+		}
+		email := r.Account.Email
+		if best == "" {
+			best = email
+		}
+		if strings.HasSuffix(email, "@golang.org") || strings.HasSuffix(email, "@google.com") {
+			n++
+			best = email
+		}
+	}
+	if n > 1 || n == 0 && len(acct) > 1 {
+		fmt.Fprintf(errbuf, "ambiguous reviewer %q:", f)
+		for _, r := range acct {
+			if r.Account == nil {
+				continue
+			}
+			email := r.Account.Email
+			fmt.Fprintf(errbuf, " %s", email)
+		}
+		fmt.Fprintf(errbuf, "\n")
+		return ""
+	}
+	return best
+}
+
 var inlineCommentRE = regexp.MustCompile(`^[^ ]+ \([A-Z][a-z]{2} +[0-9]+ [0-9]+:[0-9]{2}:[0-9]{2}\):`)
 var diffHunkRE = regexp.MustCompile(`^@@ -([0-9]+),([0-9]+) \+([0-9]+),([0-9]+) @@`)
 
-func writePatchSet(old *CL, updated []byte) (xerr error) {
+// writePatchSet saves the draft comments in the text of a patch set window.
+// If the byte offsets q0 < q1 in updated select diff lines,
+// a new comment written just after the last selected line
+// is saved with the selection as its range.
+func writePatchSet(old *CL, updated []byte, q0, q1 int) (xerr error) {
 	var errbuf bytes.Buffer
 	defer func() {
 		if errbuf.Len() > 0 {
@@ -183,6 +522,10 @@ func writePatchSet(old *CL, updated []byte) (xerr error) {
 		drafts[c.ID] = c
 	}
 
+	// unsaved is set when some comment text cannot be saved.
+	// That text may be an edited draft, so then no drafts are deleted.
+	unsaved := false
+
 	var inReplyTo *gerrit.CommentInfo
 	currentFile := ""
 	side := 0
@@ -190,48 +533,105 @@ func writePatchSet(old *CL, updated []byte) (xerr error) {
 	top := false
 	lineNew := -1
 	lineOld := -1
+	kind := "" // diff line prefix: " ", "+", "-", or "!" (see formatSideBySide)
+	cont := 0  // number of continuation rows since the last side-by-side diff row
+	offs := make([]int, len(lines))
+	for i := 1; i < len(lines); i++ {
+		offs[i] = offs[i-1] + len(lines[i-1])
+	}
+	var selStart *rangeEnd       // start of selection, if seen in current file
+	var sel *gerrit.CommentRange // range for a comment on the current diff line
 	for i := 0; i < len(lines); i++ {
 		line := lines[i]
 		if i == 0 && strings.HasPrefix(line, "CL ") {
 			continue
 		}
+		if currentFile == "" && strings.HasPrefix(line, "Parent: ") {
+			continue
+		}
 		if strings.HasPrefix(line, "File ") {
-			currentFile = strings.TrimSpace(line[5:])
+			currentFile = fileLineName(line)
 			lineNew = -1
 			lineOld = -1
+			kind = ""
 			top = true
+			selStart = nil
+			sel = nil
 			continue
 		}
 		if strings.HasPrefix(line, DiffPrefix) {
 			top = false
 			inReplyTo = nil
 			line = strings.TrimPrefix(line, DiffPrefix)
+			if old.SideBySide > 0 && strings.HasPrefix(line, ".") {
+				// Continuation of a long side-by-side row.
+				cont++
+			} else {
+				cont = 0
+				kind = ""
+				if line != "" {
+					kind = line[:1]
+				}
+				sel = nil
+			}
 			if m := diffHunkRE.FindStringSubmatch(line); m != nil {
 				lineOld, _ = strconv.Atoi(m[1])
 				lineNew, _ = strconv.Atoi(m[3])
 			} else if lineNew >= 1 && lineOld >= 1 {
-				if strings.HasPrefix(line, "+") {
-					lineNew++
-					side = +1
-				} else if strings.HasPrefix(line, "-") {
-					lineOld++
-					side = -1
-				} else {
-					lineNew++
-					lineOld++
-					side = 0
+				if cont == 0 {
+					switch kind {
+					case "+":
+						lineNew++
+						side = +1
+					case "-":
+						lineOld++
+						side = -1
+					case "!":
+						// Side-by-side row showing old and new lines;
+						// comments go on the new line.
+						lineNew++
+						lineOld++
+						side = +1
+					default:
+						lineNew++
+						lineOld++
+						side = 0
+					}
+				}
+				if q0 < q1 {
+					end := offs[i] + len(lines[i])
+					if offs[i] <= q0 && q0 < end {
+						selStart = old.rangeEndAt(currentFile, lines[i], q0-offs[i], lineOld, lineNew, kind, cont)
+					}
+					if offs[i] < q1 && q1 <= end && selStart != nil {
+						selEnd := old.rangeEndAt(currentFile, lines[i], q1-offs[i], lineOld, lineNew, kind, cont)
+						var err error
+						sel, err = selRange(selStart, selEnd)
+						if err != nil {
+							fmt.Fprintf(&errbuf, "%v\n", err)
+						} else {
+							// The comment goes on the side holding the selection,
+							// which in a side-by-side row may be either one.
+							side = selEnd.side
+						}
+					}
 				}
 			}
 			continue
 		}
 		if m := inlineCommentRE.FindStringSubmatch(line); m != nil {
-			inReplyTo = findComment(old, m[0], currentFile, side, lineOld, lineNew)
+			inReplyTo = findComment(old, m[0], currentFile, kind, lineOld, lineNew)
+			if inReplyTo != nil && inReplyTo.Side == "PARENT" && (kind == " " || kind == "!") {
+				// Reply on the old line, next to the comment.
+				side = -1
+			}
+			sel = nil
 			for i+1 < len(lines) && isCont(lines[i+1]) {
 				i++
 			}
 			continue
 		}
-		if strings.TrimSpace(line) == "" {
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == draftHeader {
 			continue
 		}
 
@@ -244,23 +644,29 @@ func writePatchSet(old *CL, updated []byte) (xerr error) {
 			i++
 		}
 		c.Message = strings.Join(lines[start:i+1], "")
+		c.Message, c.Unresolved = parseResolution(c.Message)
 
 		if currentFile == "" {
 			fmt.Fprintf(&errbuf, "unexpected comment before first file:\n\t%s\n", wrap(c.Message, "\t"))
+			unsaved = true
 			continue
 		}
 		c.Path = currentFile
 
 		switch {
-		case top:
-			// per-file comment
+		case top || lineNew < 1:
+			// per-file comment, or comment on a binary file
 		case side < 0:
 			// comment on old file
 			if old.Base == "" {
 				c.Side = "PARENT"
 				c.PatchSet = old.PatchRev.PatchSetNumber
-			} else {
+			} else if old.BaseRev != nil {
 				c.PatchSet = old.BaseRev.PatchSetNumber
+			} else {
+				fmt.Fprintf(&errbuf, "cannot comment on base commit %s:\n\t%s\n", old.Base, wrap(c.Message, "\t"))
+				unsaved = true
+				continue
 			}
 			c.Line = lineOld - 1
 		case side >= 0:
@@ -269,26 +675,34 @@ func writePatchSet(old *CL, updated []byte) (xerr error) {
 			c.Line = lineNew - 1
 		}
 
+		if !top && sel != nil {
+			c.Range = sel
+			sel = nil
+		}
+
 		if inReplyTo != nil {
 			c.InReplyTo = inReplyTo.ID
+			if c.Range == nil {
+				// Replies belong to the same range as the comment.
+				c.Range = inReplyTo.Range
+			}
 		}
 
 		for _, c0 := range drafts {
-			if c0.Path == c.Path && c0.Side == c.Side && c0.Line == c.Line && c0.PatchSet == c.PatchSet && c0.InReplyTo == c.InReplyTo {
+			if c0.SameLocation(&c) {
 				c.ID = c0.ID
+				if c.Range == nil {
+					c.Range = c0.Range
+				}
 				delete(drafts, c0.ID)
 			}
 		}
 
-		if *flagN {
-			fmt.Fprintf(&errbuf, "add draft: %s\n", js(c))
-		} else {
-			revID := old.patchSetRevID(c.PatchSet)
-			c.PatchSet = 0
-			_, err := client.CreateDraft(old.ChangeInfo.ID, revID, &c)
-			if err != nil {
-				fmt.Fprintf(&errbuf, "saving draft: %v\n\t%s\n", err, wrap(c.Message, "\t"))
-			}
+		revID := old.patchSetRevID(c.PatchSet)
+		c.PatchSet = 0
+		_, err := client.UpsertDraft(old.ChangeInfo.ID, revID, &c)
+		if err != nil {
+			fmt.Fprintf(&errbuf, "saving draft: %v\n\t%s\n", err, wrap(c.Message, "\t"))
 		}
 	}
 
@@ -296,20 +710,122 @@ func writePatchSet(old *CL, updated []byte) (xerr error) {
 		if drafts[c.ID] != c {
 			continue
 		}
-		if *flagN {
-			fmt.Fprintf(&errbuf, "delete draft: %s\n", js(c))
-		} else {
-			revID := old.patchSetRevID(c.PatchSet)
-			c.PatchSet = 0
-			if err := client.DeleteDraft(old.ChangeInfo.ID, revID, c.ID); err != nil {
-				fmt.Fprintf(&errbuf, "deleting draft: %v\n\t%s\n", err, wrap(c.Message, "\t"))
-			}
+		if unsaved {
+			fmt.Fprintf(&errbuf, "not deleting drafts because of unsaved comments\n")
+			break
+		}
+		revID := old.patchSetRevID(c.PatchSet)
+		c.PatchSet = 0
+		if err := client.DeleteDraft(old.ChangeInfo.ID, revID, c.ID); err != nil {
+			fmt.Fprintf(&errbuf, "deleting draft: %v\n\t%s\n", err, wrap(c.Message, "\t"))
 		}
 	}
 
+	if *flagN {
+		fmt.Fprintf(&errbuf, "dry run: nothing sent to the server\n")
+	}
 	return nil
 }
 
+// A rangeEnd is one end of a selection in a patch set window:
+// the old and new line numbers of the diff line holding it,
+// the diff side of that line (-1, 0, +1),
+// and the character position within the line.
+type rangeEnd struct {
+	lineOld int
+	lineNew int
+	side    int
+	char    int
+}
+
+// selRange returns the comment range for the selection from start to end.
+// The range is on the side of the file shown by the end line.
+func selRange(start, end *rangeEnd) (*gerrit.CommentRange, error) {
+	if end.side < 0 && start.side > 0 || end.side >= 0 && start.side < 0 {
+		return nil, fmt.Errorf("selection covers both old and new lines; saving comment without range")
+	}
+	if end.side < 0 {
+		return &gerrit.CommentRange{StartLine: start.lineOld, StartChar: start.char, EndLine: end.lineOld, EndChar: end.char}, nil
+	}
+	return &gerrit.CommentRange{StartLine: start.lineNew, StartChar: start.char, EndLine: end.lineNew, EndChar: end.char}, nil
+}
+
+// lineChar returns the character position in the file line
+// shown by the diff line text, given a byte offset i in text.
+func lineChar(text string, i int) int {
+	n := len(DiffPrefix) + 1 // prefix and +/-/space
+	if i <= n {
+		return 0
+	}
+	text = strings.TrimSuffix(text[n:i], "\n")
+	// Intraline edit marks are not part of the file line.
+	return utf8.RuneCountInString(text) - strings.Count(text, editStart) - strings.Count(text, editEnd)
+}
+
+// rangeEndAt returns the selection end at byte offset i
+// in the diff line text, which has the given kind (see writePatchSet)
+// and shows lines lineOld-1 and lineNew-1 of the old and new files.
+// In a side-by-side diff, the column holding the offset picks the file,
+// and cont is the number of continuation rows before text.
+// An offset in the empty column of a row showing only one file
+// is taken as the start of that file's line.
+func (cl *CL) rangeEndAt(file, text string, i, lineOld, lineNew int, kind string, cont int) *rangeEnd {
+	e := &rangeEnd{lineOld: lineOld - 1, lineNew: lineNew - 1}
+	switch kind {
+	case "+":
+		e.side = +1
+	case "-":
+		e.side = -1
+	}
+	if cl.SideBySide == 0 {
+		e.char = lineChar(text, i)
+		return e
+	}
+
+	cw := sideBySideColumn(cl.SideBySide)
+	col := lineChar(text, i)
+	right := col >= cw
+	if right {
+		col -= cw + utf8.RuneCountInString(sideBySideSep)
+		if col < 0 {
+			col = 0
+		}
+	}
+	switch kind {
+	case " ", "!":
+		if !right {
+			e.side = -1
+		} else if kind == "!" {
+			e.side = +1
+		}
+	case "+":
+		if !right {
+			return e
+		}
+	case "-":
+		if right {
+			return e
+		}
+	}
+	line := cl.diffLine(file, e.side, e.lineOld, e.lineNew)
+	e.char = expandedChar(line, cont*cw+col)
+	return e
+}
+
+// diffLine returns the text of line lineOld of the old file (if side < 0)
+// or line lineNew of the new file (otherwise) shown in the diff of file.
+func (cl *CL) diffLine(file string, side, lineOld, lineNew int) string {
+	for _, l := range cl.Lines[file] {
+		if l.Prefix == "" {
+			continue
+		}
+		if side < 0 && l.Old == lineOld || side >= 0 && l.New == lineNew {
+			return l.Text
+		}
+	}
+	return ""
+}
+
 func (cl *CL) patchSetRevID(id int) string {
 	for revID, rev := range cl.ChangeInfo.Revisions {
 		if rev.PatchSetNumber == id {
@@ -319,6 +835,38 @@ func (cl *CL) patchSetRevID(id int) string {
 	return ""
 }
 
+// parseResolution removes a trailing resolution directive line
+// from the draft comment text msg, returning the remaining text
+// and the resolution state set by the directive (nil if none).
+func parseResolution(msg string) (string, *bool) {
+	text := strings.TrimRight(msg, "\n")
+	i := strings.LastIndex(text, "\n") + 1
+	var unresolved bool
+	switch strings.TrimSpace(text[i:]) {
+	default:
+		return msg, nil
+	case resolvedDirective:
+		unresolved = false
+	case unresolvedDirective:
+		unresolved = true
+	}
+	return text[:i], &unresolved
+}
+
+// fileLineName returns the file name shown in a "File" line
+// of a patch set window. For a renamed or copied file,
+// shown as "File old => new (renamed)", it returns the new name.
+func fileLineName(line string) string {
+	name := strings.TrimSpace(strings.TrimPrefix(line, "File "))
+	name = strings.TrimSuffix(name, " (reviewed)")
+	if i := strings.LastIndex(name, " => "); i >= 0 {
+		name = name[i+len(" => "):]
+		name = strings.TrimSuffix(name, " (renamed)")
+		name = strings.TrimSuffix(name, " (copied)")
+	}
+	return name
+}
+
 func isCont(text string) bool {
 	return strings.HasPrefix(text, "\t") || strings.TrimSpace(text) == ""
 }
@@ -326,22 +874,26 @@ func isCont(text string) bool {
 func isDraftLine(line string) bool {
 	return !strings.HasPrefix(line, "File ") &&
 		!strings.HasPrefix(line, DiffPrefix) &&
+		strings.TrimSpace(line) != draftHeader &&
 		!inlineCommentRE.MatchString(line)
 }
 
-func findComment(cl *CL, hdr, file string, side, lineOld, lineNew int) *gerrit.CommentInfo {
+// findComment returns the comment with header hdr shown in file
+// after the diff line with the given kind (see writePatchSet)
+// and line numbers.
+func findComment(cl *CL, hdr, file, kind string, lineOld, lineNew int) *gerrit.CommentInfo {
 	for _, c := range cl.Comments[file] {
 		line := lineNew - 1
-		if side < 0 {
+		if kind == "-" || (kind == " " || kind == "!") && c.Side == "PARENT" {
 			line = lineOld - 1
 		}
 		if line < 0 {
 			line = 0
 		}
-		if c.Line == line && commentHeader(c) == hdr {
+		if c.Line == line && inlineCommentRE.FindString(commentHeader(c)) == hdr {
 			return c
 		}
 	}
-	fmt.Fprintf(os.Stderr, "CANNOT FIND %q %q %q %d %d in %s\n", hdr, file, side, lineOld, lineNew, js(cl.Comments))
+	fmt.Fprintf(os.Stderr, "CANNOT FIND %q %q %q %d %d in %s\n", hdr, file, kind, lineOld, lineNew, js(cl.Comments))
 	return nil
 }
@@ -0,0 +1,182 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"rsc.io/gerrit/internal/gerrit"
+)
+
+// A testRequest is a request received by a test server.
+type testRequest struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// useTestServer points client at a test server for the duration of the test
+// and returns a function reporting the requests the server has received.
+// The server replies to each request with reply(req), or with an empty JSON
+// object if reply is nil or returns "".
+func useTestServer(t *testing.T, reply func(req testRequest) string) func() []testRequest {
+	var mu sync.Mutex
+	var reqs []testRequest
+	old := client
+	client = gerrit.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := testRequest{r.Method, r.URL.EscapedPath(), string(body)}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		js := ""
+		if reply != nil {
+			js = reply(req)
+		}
+		if js == "" {
+			js = "{}"
+		}
+		fmt.Fprintf(w, ")]}'\n%s\n", js)
+	}))
+	t.Cleanup(func() { client = old })
+	return func() []testRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]testRequest(nil), reqs...)
+	}
+}
+
+// patchSetText returns the text of a patch set window showing
+// the unified diff of file, followed by comment typed
+// just after the diff line starting with after.
+func patchSetText(file string, diff *gerrit.DiffInfo, after, comment string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CL 1 Patch Set 1\n\nFile %s\n\n", file)
+	for _, line := range formatUnifiedDiff(diff, file, 3) {
+		fmt.Fprintf(&b, "%s%s%s\n", DiffPrefix, line.Prefix, line.Text)
+		if line.Prefix+line.Text == after {
+			fmt.Fprintf(&b, "\n%s\n\n", comment)
+		}
+	}
+	return b.String()
+}
+
+var writePatchSetTests = []struct {
+	name  string
+	diff  *gerrit.DiffInfo
+	after string
+	side  string
+	line  int
+}{
+	{
+		name:  "added",
+		diff:  &gerrit.DiffInfo{Content: []*gerrit.DiffContent{{B: []string{"one", "two", "three"}}}},
+		after: "+two",
+		line:  2,
+	},
+	{
+		name:  "deleted",
+		diff:  &gerrit.DiffInfo{Content: []*gerrit.DiffContent{{A: []string{"one", "two", "three"}}}},
+		after: "-three",
+		side:  "PARENT",
+		line:  3,
+	},
+	{
+		name: "modified",
+		diff: &gerrit.DiffInfo{Content: []*gerrit.DiffContent{
+			{AB: []string{"one"}},
+			{A: []string{"two"}, B: []string{"2"}},
+			{AB: []string{"three"}},
+		}},
+		after: "+2",
+		line:  2,
+	},
+}
+
+func TestWritePatchSetLines(t *testing.T) {
+	for _, tt := range writePatchSetTests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs := useTestServer(t, nil)
+			cl := &CL{
+				ChangeInfo: &gerrit.ChangeInfo{
+					ID:        "p~master~I1",
+					Revisions: map[string]*gerrit.RevisionInfo{"abc": {PatchSetNumber: 1}},
+				},
+				PatchID:  "abc",
+				PatchRev: &gerrit.RevisionInfo{PatchSetNumber: 1},
+			}
+			text := patchSetText("f.go", tt.diff, tt.after, "A comment.")
+			if err := writePatchSet(cl, []byte(text), 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			list := reqs()
+			if len(list) != 1 {
+				t.Fatalf("sent %d requests, want 1:\n%s", len(list), text)
+			}
+			req := list[0]
+			if req.Method != "PUT" || req.Path != "/changes/p~master~I1/revisions/abc/drafts" {
+				t.Fatalf("sent %s %s, want PUT to drafts", req.Method, req.Path)
+			}
+			var c gerrit.CommentInfo
+			if err := json.Unmarshal([]byte(req.Body), &c); err != nil {
+				t.Fatal(err)
+			}
+			if c.Path != "f.go" || c.Side != tt.side || c.Line != tt.line {
+				t.Errorf("draft at %s side %q line %d, want f.go side %q line %d\n%s", c.Path, c.Side, c.Line, tt.side, tt.line, text)
+			}
+		})
+	}
+}
+
+func TestEditCommitMessage(t *testing.T) {
+	long := "Reviewed-on: https://go-review.googlesource.com/c/go/+/123456789012345678901234567890123456789012345678901234567890"
+	msg := "review: fix the thing\n\nThe thing was broken.\n\n\tindented code\n\n" + long + "\nChange-Id: I0123456789abcdef0123456789abcdef01234567\n"
+	text := "CL 1 fix\n\nPatch Set 1 (1.1)\n\n" + indent(msg) + "\tAuthor: A <a@example.com> Jan 1 00:00:00\n"
+
+	got, ok := editedCommitMessage(text)
+	if !ok {
+		t.Fatalf("editedCommitMessage did not find message in:\n%s", text)
+	}
+	if unindent(got) != msg {
+		t.Errorf("unedited message round trip:\n%s\nwant:\n%s", unindent(got), msg)
+	}
+
+	edited := strings.Replace(text, "was broken", "was very broken", 1)
+	got, _ = editedCommitMessage(edited)
+	want := strings.Replace(msg, "was broken", "was very broken", 1)
+	if unindent(got) != want {
+		t.Errorf("edited message:\n%s\nwant:\n%s", unindent(got), want)
+	}
+}
+
+func TestWritePatchSetKeepsDraftsOnError(t *testing.T) {
+	reqs := useTestServer(t, nil)
+	cl := &CL{
+		ChangeInfo: &gerrit.ChangeInfo{
+			ID:        "p~master~I1",
+			Revisions: map[string]*gerrit.RevisionInfo{"abc": {PatchSetNumber: 1}},
+		},
+		PatchID:  "abc",
+		PatchRev: &gerrit.RevisionInfo{PatchSetNumber: 1},
+		Base:     "0123456789abcdef0123456789abcdef01234567",
+		Drafts: []*gerrit.CommentInfo{
+			{ID: "d1", Path: "f.go", Side: "PARENT", Line: 3, Message: "An old draft."},
+		},
+	}
+	diff := &gerrit.DiffInfo{Content: []*gerrit.DiffContent{{A: []string{"one", "two", "three"}}}}
+	text := patchSetText("f.go", diff, "-three", "An edited draft.")
+	if err := writePatchSet(cl, []byte(text), 0, 0); err == nil {
+		t.Errorf("writePatchSet succeeded commenting on a base commit")
+	}
+	for _, req := range reqs() {
+		t.Errorf("sent %s %s, want nothing", req.Method, req.Path)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"rsc.io/gerrit/internal/gerrit"
+)
+
+const (
+	followInterval    = 10 * time.Second // time between polls
+	followMaxInterval = 5 * time.Minute  // longest time between polls when the server is busy
+	followBacklog     = 5                // number of old messages to print at start
+)
+
+// followMode implements "review -f N", which prints
+// the new messages and patch sets on change N as they appear,
+// polling the server until interrupted.
+func followMode(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: review -f N\n")
+		os.Exit(2)
+	}
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		log.Fatalf("invalid change %s", args[0])
+	}
+	id := args[0]
+
+	// Ctrl-C cancels ctx, which stops the loop between polls
+	// and also cancels any request in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	setContext(client, ctx)
+
+	// started records whether the header has been printed.
+	// It is separate from first, because the first poll may fail.
+	started := false
+	seen := make(map[string]bool)
+	status := ""
+	patchSet := 0
+	interval := followInterval
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+
+		chs, err := client.QueryChanges("change:"+id, gerrit.QueryChangesOpt{
+			Fields: []string{"CURRENT_REVISION"},
+		})
+		var msgs []*gerrit.ChangeMessageInfo
+		if err == nil && len(chs) == 0 {
+			log.Fatalf("unknown change %s", id)
+		}
+		if err == nil {
+			msgs, err = client.ListChangeMessages(chs[0].ID)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if gerrit.IsTooManyRequests(err) {
+			if interval *= 2; interval > followMaxInterval {
+				interval = followMaxInterval
+			}
+			continue
+		}
+		if err != nil {
+			if first {
+				log.Fatal(err)
+			}
+			log.Print(err)
+			continue
+		}
+		interval = followInterval
+
+		ch := chs[0]
+		if !started {
+			fmt.Printf("%d %s\n", ch.ChangeNumber, ch.Subject)
+			if len(msgs) > followBacklog {
+				for _, m := range msgs[:len(msgs)-followBacklog] {
+					seen[m.ID] = true
+				}
+			}
+		}
+		for _, m := range msgs {
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			who := "Gerrit"
+			if m.Author != nil {
+				who = shortEmail(m.Author.Email)
+			}
+			fmt.Printf("%s %s (patch set %d):\n\t%s\n", shortTime(m.Time), who, m.RevisionNumber, wrap(m.Message, "\t"))
+		}
+		if rev := ch.Revisions[ch.CurrentRevision]; rev != nil && rev.PatchSetNumber != patchSet {
+			if started {
+				fmt.Printf("%s patch set %d is now current\n", shortTime(ch.Updated), rev.PatchSetNumber)
+			}
+			patchSet = rev.PatchSetNumber
+		}
+		if ch.Status != status {
+			if started || ch.Status != "NEW" {
+				fmt.Printf("%s status %s\n", shortTime(ch.Updated), ch.Status)
+			}
+			status = ch.Status
+		}
+		started = true
+	}
+}
+
+// setContext makes c send each request with context ctx,
+// so that cancelling ctx cancels any request c has in flight.
+func setContext(c *gerrit.Client, ctx context.Context) {
+	hc := http.DefaultClient
+	if c.HTTPClient != nil {
+		hc = c.HTTPClient
+	}
+	rt := hc.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	nc := *hc
+	nc.Transport = contextTransport{ctx, rt}
+	c.HTTPClient = &nc
+}
+
+// A contextTransport sends each request with context ctx
+// using the underlying transport rt.
+type contextTransport struct {
+	ctx context.Context
+	rt  http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.rt.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rsc.io/gerrit/internal/gerrit"
+)
+
+func TestSetContextCancelsRequest(t *testing.T) {
+	started := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c := gerrit.NewClient(srv.URL, gerrit.NoAuth)
+	ctx, cancel := context.WithCancel(context.Background())
+	setContext(c, ctx)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.ListChangeMessages("1234")
+		errc <- err
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("cancelled request succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("cancelling the context did not cancel the request")
+	}
+}
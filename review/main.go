@@ -2,17 +2,14 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// TODO: Cache loaded information except on Get.
-// TODO: Expand clicks like on 1234.4
 // TODO: Set up plumbing rules for issues.
-// TODO: Some kind of config file [sic]?
 
 // TODO: Writing comments.
-// TODO: Show drafts.
 
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,8 +17,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"rsc.io/gerrit/internal/gerrit"
 )
@@ -29,183 +27,549 @@ import (
 var client *gerrit.Client
 
 var flagA = flag.Bool("a", false, "acme mode")
+var flagColor = flag.String("color", "auto", "color patch set diffs `when`: auto, always, or never")
+var flagContext = flag.Int("context", 3, "show `n` lines of context in patch set diffs")
+var flagDB = flag.String("db", "", "read code reviews from reviewdb database `file` instead of the server")
+var flagE = flag.Bool("e", false, "edit the review in $VISUAL or $EDITOR")
+var flagF = flag.Bool("f", false, "follow the review, printing new activity as it happens")
+var flagIgnoreWS = flag.Bool("ignore-ws", false, "ignore whitespace changes in patch set diffs")
+var flagIntraline = flag.Bool("intraline", false, "mark changes within lines in patch set diffs")
+var flagJSON = flag.Bool("json", false, "print code review summaries as JSON")
+var flagH = flag.String("h", "go-review.googlesource.com", "Gerrit server `host`, with an optional path, as in host/gerrit")
+var flagLimit = flag.Int("limit", 0, "show at most `n` code reviews from a search (0 for all)")
 var flagN = flag.Bool("n", false, "print but do not execute Gerrit write operations")
+var flagProject = flag.String("project", "", "show only code reviews in `project`")
+var flagReverse = flag.Bool("reverse", false, "reverse the sort order")
+var flagShowWS = flag.Bool("show-ws", false, "show tabs, trailing spaces, and carriage returns in patch set diffs")
+var flagSide = flag.Bool("side", false, "show patch set diffs side by side")
+var flagSince = flag.String("since", "", "show only code reviews updated within the last `duration`, such as 3d or 12h")
+var flagSort = flag.String("sort", "subject", "sort code reviews by `key`: number, subject, or updated")
+var flagV = flag.Bool("v", false, "log server requests, with their results and timing, to standard error")
+var flagWeb = flag.Bool("web", false, "open the code review or patch set in a web browser")
+
+// server is the host name of the Gerrit server, from the -h flag,
+// followed by the path at which the server is hosted, if any,
+// as in "gerrit.example.com/gerrit".
+var server string
+
+// readOnly explains why review cannot change code reviews on the server,
+// or is empty if it can. It is set when no credentials were found
+// for the server, so that commands that would change code reviews
+// fail with a clear message instead of Gerrit's 403 Forbidden.
+var readOnly string
+
+// since is the duration from the -since flag, or 0 if it is not set.
+var since time.Duration
 
 func main() {
 	flag.Parse()
+	switch *flagSort {
+	case "number", "subject", "updated":
+	default:
+		log.Fatalf("invalid -sort %s: want number, subject, or updated", *flagSort)
+	}
+	if *flagSince != "" {
+		d, err := parseSince(*flagSince)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid -since %s: want duration like 3d or 12h", *flagSince)
+		}
+		since = d
+	}
+	switch *flagColor {
+	case "auto", "always", "never":
+	default:
+		log.Fatalf("invalid -color %s: want auto, always, or never", *flagColor)
+	}
+	if *flagLimit < 0 {
+		log.Fatalf("invalid -limit %d: must not be negative", *flagLimit)
+	}
+	if *flagContext < 0 {
+		log.Fatalf("invalid -context %d: must not be negative", *flagContext)
+	}
+	readConfig(configFile())
 
-	client = gerrit.NewClient("https://go-review.googlesource.com", loadAuth("go-review.googlesource.com"))
+	server = strings.TrimSuffix(strings.TrimPrefix(*flagH, "https://"), "/")
+	host := serverHost()
+	auth := gerrit.HostAuth(host)
+	if auth == gerrit.NoAuth {
+		readOnly = "read-only: no credentials found for " + host
+	}
+	client = gerrit.NewClient("https://"+server, auth)
+	client.AccountCacheSize = 1000
+	client.MaxRetries = 3
+	if *flagV {
+		client.Logf = log.Printf
+	}
+	src = liveSource{client}
+	if *flagDB != "" {
+		db, err := openDB(*flagDB, server)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src = db
+		// The database is only a copy: never write to the server.
+		*flagN = true
+	}
+	setDryRun(*flagN)
 
 	if *flagA {
 		acmeMode()
 		return
 	}
 
-	/*
-		chs, err := client.QueryChanges("is:open -project:scratch -message:do-not-review reviewer:rsc", gerrit.QueryChangesOpt{})
-		if err != nil {
+	if *flagE {
+		editMode(flag.Args())
+		return
+	}
+
+	if *flagF {
+		followMode(flag.Args())
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "branches":
+		branches(flag.Args()[1:])
+		return
+	case "download":
+		download(flag.Args()[1:])
+		return
+	case "discard":
+		discard(flag.Args()[1:])
+		return
+	case "publish":
+		publish(flag.Args()[1:])
+		return
+	case "queue":
+		queue(flag.Args()[1:])
+		return
+	case "whoami":
+		whoami(flag.Args()[1:])
+		return
+	case "whois":
+		whois(flag.Args()[1:])
+		return
+	}
+
+	arg := strings.Join(flag.Args(), " ")
+	id, base, patch, ok := parseChangeArg(arg)
+	if !ok {
+		if *flagJSON {
+			all, err := searchIssues(arg, *flagLimit)
+			if err != nil {
+				log.Fatal(err)
+			}
+			list := []*clSummary{}
+			for _, ch := range sortChanges(all) {
+				list = append(list, summarize(ch))
+			}
+			fmt.Printf("%s\n", js(list))
+			return
+		}
+		if *flagWeb {
+			log.Fatalf("-web requires a code review N, N/P, or N/B/P")
+		}
+		if err := showQuery(os.Stdout, arg); err != nil {
 			log.Fatal(err)
 		}
+		return
+	}
 
-		for _, ch := range chs {
-			fmt.Printf("%d\t%s\n", ch.ChangeNumber, ch.Subject)
+	if *flagWeb {
+		if err := openBrowser(webURL(id, base, patch)); err != nil {
+			log.Fatal(err)
 		}
-	*/
-
-	//showCL(os.Stdout, 13975)
-	//return
-
-	ch, err := client.GetChangeDetail(flag.Arg(0), gerrit.QueryChangesOpt{
-		Fields: []string{
-			"ALL_REVISIONS",
-			"DETAILED_ACCOUNTS",
-			"DETAILED_LABELS",
-			"ALL_COMMITS",
-			"ALL_FILES",
-			"MESSAGES",
-		},
-	})
+		return
+	}
+
+	var cl *CL
+	var err error
+	var buf bytes.Buffer
+	if patch == 0 {
+		cl, err = showCL(&buf, id, wrapWidth)
+	} else {
+		view := flagDiffView()
+		view.color = useColor()
+		cl, err = showPatchSet(&buf, id, base, patch, view)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	if true {
-		fmt.Printf("%s\n", js(ch))
+	if *flagJSON {
+		fmt.Printf("%s\n", js(summarize(cl.ChangeInfo)))
 		return
 	}
+	os.Stdout.Write(buf.Bytes())
+}
 
-	if false {
-		fmt.Printf("query: %s\n", flag.Arg(0))
-		acct, err := client.SuggestReviewers(ch.ID, flag.Arg(0), 10)
-		if err != nil {
-			log.Fatal(err)
-		}
-		js, err := json.MarshalIndent(acct, "", "\t")
-		if err != nil {
-			log.Print(err)
-			return
+// flagDiffView returns the view of patch set diffs
+// printed to the terminal, as set by the command-line flags.
+// The width of side-by-side diffs is taken from $COLUMNS, defaulting to 160.
+func flagDiffView() diffView {
+	view := diffView{context: *flagContext, ignoreWS: *flagIgnoreWS, intraline: *flagIntraline, showWS: *flagShowWS, wrap: wrapWidth}
+	if *flagSide {
+		view.width = 160
+		if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+			view.width = n
 		}
-		fmt.Printf("%s\n", js)
-		return
 	}
+	return view
+}
 
-	showPatchSet(os.Stdout, ch.ChangeNumber, 0, 2)
-	return
+// useColor reports whether to color patch set diffs printed to standard output,
+// as directed by the -color flag. With -color=auto, the default,
+// review colors diffs only on a terminal, and not if $NO_COLOR is set.
+func useColor() bool {
+	switch *flagColor {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-	revID := ch.CurrentRevision
-	rev := ch.Revisions[revID]
-
-	var files []string
-	for file := range rev.Files {
-		files = append(files, file)
-	}
-	sort.Strings(files)
-
-	for _, filePath := range files {
-		diff, err := client.GetDiff(ch.ID, revID, filePath, gerrit.GetDiffOpt{
-			// We use the full file context even to prepare shorter diff views.
-			// The Gerrit server seems to send full context no matter what,
-			// so this line is not strictly necessary, but in case that apparent
-			// bug gets fixed, ask for full context explicitly.
-			Context: -1,
-		})
+// parseSince parses the -since duration, which is either
+// a Go duration like "12h" or a number of days like "3d",
+// because the Go syntax has no unit longer than an hour.
+func parseSince(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
 		if err != nil {
-			log.Print(err)
-			continue
+			return 0, err
 		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
 
-		const maxContext = 3
-		fmt.Printf("File %s\n\n", filePath)
-		for _, line := range diff.DiffHeader {
-			fmt.Printf("\t%s\n", line)
+// parseChangeArg parses a command-line argument of the form
+// N, N/P, or N/B/P, naming change N, patch set P, and base B.
+// Dots can be used in place of the slashes.
+// If the argument is only N, patch is 0.
+func parseChangeArg(arg string) (id int, base string, patch int, ok bool) {
+	f := strings.FieldsFunc(arg, func(r rune) bool { return r == '/' || r == '.' })
+	if len(f) < 1 || len(f) > 3 {
+		return 0, "", 0, false
+	}
+	id, err := strconv.Atoi(f[0])
+	if err != nil {
+		return 0, "", 0, false
+	}
+	if len(f) >= 2 {
+		patch, err = strconv.Atoi(f[len(f)-1])
+		if err != nil {
+			return 0, "", 0, false
 		}
-		for _, c := range diff.Content {
-			if c.AB != nil {
-				if len(c.AB) > 2*maxContext+3 {
-					for _, line := range c.AB[:maxContext] {
-						fmt.Printf("\t %s\n", line)
-					}
-					fmt.Printf("\t...\n")
-					for _, line := range c.AB[len(c.AB)-maxContext:] {
-						fmt.Printf("\t %s\n", line)
-					}
-				} else {
-					for _, line := range c.AB {
-						fmt.Printf("\t %s\n", line)
-					}
-				}
-			} else {
-				for _, line := range c.A {
-					fmt.Printf("\t-%s\n", line)
-				}
-				for _, line := range c.B {
-					fmt.Printf("\t+%s\n", line)
-				}
+	}
+	if len(f) == 3 {
+		base = f[1]
+	}
+	return id, base, patch, true
+}
+
+// download implements "review download N[/P] [file]",
+// which writes patch set P of change N (by default, the current patch set)
+// to file (by default, N.P.patch) in mailbox format.
+func download(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "usage: review download N[/P] [file]\n")
+		os.Exit(2)
+	}
+	f := strings.FieldsFunc(args[0], func(r rune) bool { return r == '/' || r == '.' })
+	if len(f) < 1 || len(f) > 2 {
+		log.Fatalf("invalid change %s", args[0])
+	}
+	ch, err := client.GetChangeDetail(f[0], gerrit.QueryChangesOpt{
+		Fields: []string{"ALL_REVISIONS"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	revID := ch.CurrentRevision
+	if len(f) == 2 {
+		revID = ""
+		for id, rev := range ch.Revisions {
+			if fmt.Sprint(rev.PatchSetNumber) == f[1] {
+				revID = id
 			}
 		}
-		fmt.Printf("\n")
-		if true {
-			js, err := json.MarshalIndent(diff, "", "\t")
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-			fmt.Printf("%s %s\n%s\n", revID, filePath, js)
+		if revID == "" {
+			log.Fatalf("unknown patch set %s", args[0])
 		}
 	}
-	return
-}
-
-func loadAuth(host string) gerrit.Auth {
-	// First look in Git's http.cookiefile, which is where Gerrit
-	// now tells users to store this information.
-	if cookieFile, _ := trimErr(cmdOutputDirErr(".", "git", "config", "http.cookiefile")); cookieFile != "" {
-		data, _ := ioutil.ReadFile(cookieFile)
-		maxMatch := -1
-		var cookieName, cookieValue string
-		for _, line := range lines(string(data)) {
-			f := strings.Split(line, "\t")
-			if len(f) >= 7 && (f[0] == host || strings.HasPrefix(f[0], ".") && strings.HasSuffix(host, f[0])) {
-				if len(f[0]) > maxMatch {
-					cookieName = f[5]
-					cookieValue = f[6]
-					maxMatch = len(f[0])
-				}
+	patch, err := client.GetPatch(ch.ID, revID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	file := fmt.Sprintf("%d.%d.patch", ch.ChangeNumber, ch.Revisions[revID].PatchSetNumber)
+	if len(args) == 2 {
+		file = args[1]
+	}
+	if err := ioutil.WriteFile(file, patch, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serverHost returns the host name of the Gerrit server,
+// without the path at which the server is hosted, if any.
+func serverHost() string {
+	host := server
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// checkWritable exits with the readOnly message
+// if review cannot change code reviews on the server.
+// With -n, review changes nothing, so it can always proceed.
+func checkWritable() {
+	if readOnly != "" && !*flagN {
+		log.Fatal(readOnly)
+	}
+}
+
+// dryRunOut prints the report of a write skipped during a dry run.
+// The acme interface sends it to the +Errors window instead of standard output.
+var dryRunOut = func(s string) { fmt.Print(s) }
+
+// setDryRun sets *flagN to on and makes the client
+// report its write requests instead of sending them, or stop doing so.
+func setDryRun(on bool) {
+	*flagN = on
+	client.DryRun = nil
+	if on {
+		client.DryRun = reportDryRun
+	}
+}
+
+// reportDryRun reports a write request that the client did not send
+// because of -n: the method and URL, followed by the JSON body, if any.
+func reportDryRun(method, url string, body []byte) {
+	s := fmt.Sprintf("%s %s\n", method, url)
+	if body != nil {
+		s += string(body) + "\n"
+	}
+	dryRunOut(s)
+}
+
+// editMode implements "review -e N[/P]" and "review -e N/B/P",
+// which edits change N (or its patch set P, against base B)
+// in a text editor and then applies the changes made in the editor.
+func editMode(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: review -e N[/P] or N/B/P\n")
+		os.Exit(2)
+	}
+	id, base, patch, ok := parseChangeArg(args[0])
+	if !ok {
+		log.Fatalf("invalid change %s", args[0])
+	}
+	checkWritable()
+
+	var buf bytes.Buffer
+	var cl *CL
+	var err error
+	if patch == 0 {
+		cl, err = showCL(&buf, id, wrapWidth)
+	} else {
+		cl, err = showPatchSet(&buf, id, base, patch, flagDiffView())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempFile("", "review-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := tmp.Name()
+	_, err = tmp.Write(buf.Bytes())
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(name)
+		log.Fatal(err)
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "ed"
+	}
+	// $EDITOR may include arguments, as in "code -w".
+	ed := strings.Fields(editor)
+	cmd := exec.Command(ed[0], append(ed[1:], name)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(name)
+		log.Fatalf("running editor: %v", err)
+	}
+
+	updated, err := ioutil.ReadFile(name)
+	if err != nil {
+		os.Remove(name)
+		log.Fatal(err)
+	}
+	if bytes.Equal(updated, buf.Bytes()) {
+		os.Remove(name)
+		fmt.Fprintf(os.Stderr, "no changes\n")
+		return
+	}
+	if patch == 0 {
+		err = writeCL(cl, updated)
+	} else {
+		err = writePatchSet(cl, updated, 0, 0)
+	}
+	if err != nil {
+		// Keep the edited text so that the work is not lost.
+		log.Fatalf("%v\nedited text saved in %s", err, name)
+	}
+	os.Remove(name)
+}
+
+// publish implements "review publish N [message]",
+// which publishes all draft comments on change N,
+// along with the message, if any.
+func publish(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "usage: review publish N [message]\n")
+		os.Exit(2)
+	}
+	checkWritable()
+	review := &gerrit.ReviewInput{Drafts: "PUBLISH_ALL_REVISIONS"}
+	if len(args) == 2 {
+		review.Message = args[1]
+	}
+	if err := client.SetReview(args[0], gerrit.CurrentRevision, review); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// discard implements "review discard N",
+// which deletes all draft comments on change N.
+func discard(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: review discard N\n")
+		os.Exit(2)
+	}
+	checkWritable()
+	ch, err := client.GetChangeDetail(args[0], gerrit.QueryChangesOpt{
+		Fields: []string{"ALL_REVISIONS"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	revIDs := make(map[int]string)
+	for revID, rev := range ch.Revisions {
+		revIDs[rev.PatchSetNumber] = revID
+	}
+	drafts, err := client.ListChangeDrafts(ch.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	for file, list := range drafts {
+		for _, c := range list {
+			revID := revIDs[c.PatchSet]
+			if revID == "" {
+				log.Printf("deleting draft on %s:%d: unknown patch set %d", file, c.Line, c.PatchSet)
+				failed = true
+				continue
 			}
-		}
-		if maxMatch > 0 && cookieName == "o" {
-			i := strings.Index(cookieValue, "=")
-			if i >= 0 {
-				return gerrit.BasicAuth(cookieValue[:i], cookieValue[i+1:])
+			if err := client.DeleteDraft(ch.ID, revID, c.ID); err != nil {
+				log.Printf("deleting draft on %s:%d: %v", file, c.Line, err)
+				failed = true
 			}
 		}
 	}
-
-	// If not there, then look in $HOME/.netrc, which is where Gerrit
-	// used to tell users to store the information, until the passwords
-	// got so long that old versions of curl couldn't handle them.
-	data, _ := ioutil.ReadFile(os.Getenv("HOME") + "/.netrc")
-	for _, line := range lines(string(data)) {
-		if i := strings.Index(line, "#"); i >= 0 {
-			line = line[:i]
-		}
-		f := strings.Fields(line)
-		if len(f) >= 6 && f[0] == "machine" && f[1] == host && f[2] == "login" && f[4] == "password" {
-			return gerrit.BasicAuth(f[3], f[5])
-		}
+	if failed {
+		os.Exit(1)
 	}
+}
 
-	return gerrit.NoAuth
+// branches implements "review branches <project>",
+// which prints the branches and tags of project.
+func branches(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: review branches <project>\n")
+		os.Exit(2)
+	}
+	list, err := client.ListBranches(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	tags, err := client.ListTags(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, b := range list {
+		fmt.Printf("%s %s\n", b.Revision, b.Ref)
+	}
+	for _, t := range tags {
+		fmt.Printf("%s %s\n", t.Revision, t.Ref)
+	}
 }
 
-// trim is shorthand for strings.TrimSpace.
-func trim(text string) string {
-	return strings.TrimSpace(text)
+// whoami implements "review whoami",
+// which prints the account that review authenticates as,
+// to check that the credentials for the server are set up correctly.
+func whoami(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "usage: review whoami\n")
+		os.Exit(2)
+	}
+	if readOnly != "" {
+		log.Fatalf("no credentials found for %s in $HOME/.gitcookies or $HOME/.netrc", serverHost())
+	}
+	a, err := client.GetAccountInfo("self")
+	if gerrit.IsUnauthorized(err) || gerrit.IsForbidden(err) {
+		log.Fatalf("credentials for %s rejected: %v", serverHost(), err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s <%s>", a.Name, a.Email)
+	if a.Username != "" {
+		fmt.Printf(" (%s)", a.Username)
+	}
+	fmt.Printf("\n")
 }
 
-// trimErr applies strings.TrimSpace to the result of cmdOutput(Dir)Err,
-// passing the error along unmodified.
-func trimErr(text string, err error) (string, error) {
-	return strings.TrimSpace(text), err
+// whois implements "review whois <name>",
+// which prints the accounts matching name.
+func whois(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: review whois <name>\n")
+		os.Exit(2)
+	}
+	list, err := client.QueryAccounts(args[0], 25)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(list) == 0 {
+		log.Fatalf("no accounts matching %s", args[0])
+	}
+	for _, a := range list {
+		fmt.Printf("%s <%s>", a.Name, a.Email)
+		if a.Username != "" {
+			fmt.Printf(" (%s)", a.Username)
+		}
+		fmt.Printf("\n")
+		if a.MoreAccounts {
+			fmt.Printf("...\n")
+		}
+	}
 }
 
 // lines returns the lines in text.
@@ -218,17 +582,6 @@ func lines(text string) []string {
 	return out
 }
 
-// cmdOutputDirErr runs the command line in dir, returning its output
-// and any error results.
-func cmdOutputDirErr(dir, command string, args ...string) (string, error) {
-	cmd := exec.Command(command, args...)
-	if dir != "." {
-		cmd.Dir = dir
-	}
-	b, err := cmd.CombinedOutput()
-	return string(b), err
-}
-
 func js(x interface{}) string {
 	enc, err := json.MarshalIndent(x, "", "\t")
 	if err != nil {
@@ -0,0 +1,16 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import "errors"
+
+// openDB reports that the -db flag is unavailable:
+// reading the SQLite database written by reviewdb needs cgo.
+func openDB(file, host string) (reviewSource, error) {
+	return nil, errors.New("-db requires a review binary built with cgo")
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A queueState records the result of a query, for comparing against later runs.
+type queueState struct {
+	Time    time.Time
+	Changes map[int]queueChange // keyed by change number
+}
+
+type queueChange struct {
+	Project string
+	Subject string
+	Updated time.Time
+}
+
+// queueFile returns the name of the file holding the saved queue states.
+func queueFile() string {
+	return os.Getenv("HOME") + "/.reviewqueue"
+}
+
+// queue implements "review queue <query>", which runs the query
+// and reports how its results have changed since the last time
+// the same query was run: which changes are new, which have been
+// updated, which are still waiting, and which have been resolved.
+func queue(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: review queue <query>\n")
+		os.Exit(2)
+	}
+	q := strings.Join(args, " ")
+
+	states := make(map[string]*queueState)
+	file := queueFile()
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			log.Fatalf("reading %s: %v", file, err)
+		}
+	}
+
+	chs, err := searchIssues(q, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Sort(clsBySubject(chs))
+
+	now := &queueState{
+		Time:    time.Now(),
+		Changes: make(map[int]queueChange),
+	}
+	for _, ch := range chs {
+		now.Changes[ch.ChangeNumber] = queueChange{
+			Project: ch.Project,
+			Subject: ch.Subject,
+			Updated: ch.Updated.Time(),
+		}
+	}
+
+	old := states[q]
+	if old == nil {
+		fmt.Printf("First run of query.\n")
+		old = &queueState{}
+	} else {
+		fmt.Printf("Since %s:\n", old.Time.Format(time.Stamp))
+	}
+
+	var added, updated, waiting, resolved []int
+	for _, ch := range chs {
+		c, ok := old.Changes[ch.ChangeNumber]
+		switch {
+		case !ok:
+			added = append(added, ch.ChangeNumber)
+		case !c.Updated.Equal(ch.Updated.Time()):
+			updated = append(updated, ch.ChangeNumber)
+		default:
+			waiting = append(waiting, ch.ChangeNumber)
+		}
+	}
+	for n := range old.Changes {
+		if _, ok := now.Changes[n]; !ok {
+			resolved = append(resolved, n)
+		}
+	}
+	sort.Ints(resolved)
+
+	printQueue("New", added, now)
+	printQueue("Updated", updated, now)
+	printQueue("Waiting", waiting, now)
+	printQueue("Resolved", resolved, old)
+
+	states[q] = now
+	data, err = json.MarshalIndent(states, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printQueue(title string, list []int, state *queueState) {
+	if len(list) == 0 {
+		return
+	}
+	fmt.Printf("\n%s:\n", title)
+	for _, n := range list {
+		c := state.Changes[n]
+		fmt.Printf("%d\t%s\t%s\n", n, c.Project, c.Subject)
+	}
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"path"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"rsc.io/gerrit/internal/gerrit"
 )
@@ -13,50 +17,190 @@ import (
 type CL struct {
 	ChangeInfo *gerrit.ChangeInfo
 	Reviewers  []*gerrit.AccountInfo
+	CCs        []*gerrit.AccountInfo // nil if reviewer states are unknown
 	Comments   map[string][]*gerrit.CommentInfo
 	PatchID    string
 	PatchRev   *gerrit.RevisionInfo
 	Base       string
 	BaseRev    *gerrit.RevisionInfo
 	Drafts     []*gerrit.CommentInfo
+	Reviewed   map[string]bool   // files marked reviewed in PatchRev
+	SideBySide int               // width of side-by-side diffs, or 0 for unified diffs
+	Lines      map[string][]Line // unified diff lines shown for each file
+	Wrap       int               // width text is wrapped to (see wrapAt)
 }
 
 func showQuery(w io.Writer, q string) error {
-	all, err := searchIssues(q)
+	var all []*gerrit.ChangeInfo
+	var more bool
+	err := searchIssuesPages(q, *flagLimit, func(chs []*gerrit.ChangeInfo, m bool) {
+		all, more = chs, m
+	})
 	if err != nil {
 		return err
 	}
-	sort.Sort(clsBySubject(all))
+	n := printQuery(w, all)
+	if *flagLimit > 0 {
+		fmt.Fprintf(w, "\n%s\n", querySummary(n, more))
+	}
+	return nil
+}
+
+// querySummary returns the line summarizing a list of n code reviews,
+// noting whether more code reviews match than were fetched.
+// The line begins with a word, not the count, so that it cannot
+// be taken for a code review line, which begins with a number.
+func querySummary(n int, more bool) string {
+	plural := "s"
+	if n == 1 {
+		plural = ""
+	}
+	if more {
+		return fmt.Sprintf("showing %d code review%s; more match (use -limit 0 for all)", n, plural)
+	}
+	return fmt.Sprintf("showing %d code review%s", n, plural)
+}
 
+// printQuery prints the list of changes, sorted and filtered by sortChanges,
+// and returns the number printed.
+// Each line has tab-separated columns: number, project, subject, owner,
+// size, Code-Review votes, and status, so that acme windows can align them.
+func printQuery(w io.Writer, all []*gerrit.ChangeInfo) int {
+	all = sortChanges(all)
+	var accounts []*gerrit.AccountInfo
 	for _, ch := range all {
-		suffix := " ["
-		suffix += shortEmail(ch.Owner.Email)
-		suffix += fmt.Sprintf(", +%d-%d", ch.Insertions, ch.Deletions)
-		label, ok := ch.Labels["Code-Review"]
-		if ok {
-			for _, vote := range label.All {
-				if vote.Value != 0 {
-					suffix += fmt.Sprintf(", %s%+d", shortEmail(vote.Email), vote.Value)
-				}
-			}
+		accounts = append(accounts, changeAccounts(ch)...)
+	}
+	fillAccounts(accounts)
+	for _, ch := range all {
+		s := summarize(ch)
+		var votes []string
+		for _, vote := range s.Labels["Code-Review"] {
+			votes = append(votes, fmt.Sprintf("%s%+d", shortEmail(vote.Who), vote.Value))
+		}
+		var status []string
+		switch s.Review {
+		case "approved":
+			status = append(status, "+2")
+		case "rejected":
+			status = append(status, "-2")
+		}
+		if s.Submittable {
+			status = append(status, "\u2713")
+		}
+		if s.Starred {
+			status = append(status, "\u2606")
 		}
-		suffix += "]"
-		if ch.Starred {
-			suffix += " \u2606"
+		if s.New {
+			status = append(status, "NEW")
 		}
-		if !ch.Reviewed {
-			suffix += " NEW"
+		if s.WIP {
+			status = append(status, "WIP")
 		}
-		fmt.Fprintf(w, "%d\t%s\t%s%s\n", ch.ChangeNumber, ch.Project, ch.Subject, suffix)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t+%d-%d\t%s\t%s\n", s.Number, s.Project, s.Subject, shortEmail(s.Owner),
+			s.Insertions, s.Deletions, strings.Join(votes, " "), strings.Join(status, " "))
 	}
-	return nil
+	return len(all)
+}
+
+// A clSummary is the summary of a change shown in a query result.
+// Review -json prints clSummary values as JSON, so the JSON form
+// is part of review's interface and should only grow, not change.
+type clSummary struct {
+	Number      int               `json:"number"`
+	Project     string            `json:"project"`
+	Branch      string            `json:"branch"`
+	Subject     string            `json:"subject"`
+	Status      string            `json:"status"`
+	Owner       string            `json:"owner"` // email address, if known
+	Insertions  int               `json:"insertions"`
+	Deletions   int               `json:"deletions"`
+	Labels      map[string][]vote `json:"labels,omitempty"` // non-zero votes, by label name
+	Review      string            `json:"review,omitempty"` // "approved" or "rejected", from Code-Review
+	Updated     time.Time         `json:"updated"`
+	Submittable bool              `json:"submittable,omitempty"`
+	Starred     bool              `json:"starred,omitempty"`
+	New         bool              `json:"new,omitempty"` // awaiting the caller's attention (see selfID)
+	WIP         bool              `json:"wip,omitempty"`
+}
+
+// A vote is a single vote on a label, in a clSummary.
+type vote struct {
+	Who   string `json:"who"` // email address, if known
+	Value int    `json:"value"`
+}
+
+var selfOnce sync.Once
+var self string
+
+// selfID returns the numeric account ID of the caller, as a string,
+// for finding the caller in attention sets.
+// It returns "" if the server predates attention sets (Gerrit 3.3)
+// or the caller is unknown, as when reading offline or without credentials.
+func selfID() string {
+	selfOnce.Do(func() {
+		if _, live := src.(liveSource); !live || readOnly != "" {
+			return
+		}
+		if ok, _ := client.ServerVersionAtLeast(3, 3); !ok {
+			return
+		}
+		if a, err := client.GetAccountInfo("self"); err == nil && a.NumericID != 0 {
+			self = fmt.Sprint(a.NumericID)
+		}
+	})
+	return self
+}
+
+// summarize returns the summary of the change ch.
+func summarize(ch *gerrit.ChangeInfo) *clSummary {
+	s := &clSummary{
+		Number:      ch.ChangeNumber,
+		Project:     ch.Project,
+		Branch:      ch.Branch,
+		Subject:     ch.Subject,
+		Status:      ch.Status,
+		Owner:       accountEmail(ch.Owner),
+		Insertions:  ch.Insertions,
+		Deletions:   ch.Deletions,
+		Updated:     ch.Updated.Time(),
+		Submittable: ch.Submittable,
+		Starred:     ch.Starred,
+		New:         !ch.Reviewed,
+		WIP:         ch.WorkInProgress,
+	}
+	// Where there are attention sets, they say who is expected
+	// to act next, which Reviewed only approximates.
+	if self := selfID(); self != "" {
+		_, s.New = ch.AttentionSet[self]
+	}
+	if label, ok := ch.Labels["Code-Review"]; ok {
+		switch {
+		case label.Rejected != nil:
+			s.Review = "rejected"
+		case label.Approved != nil:
+			s.Review = "approved"
+		}
+	}
+	for name, label := range ch.Labels {
+		for _, v := range label.All {
+			if v.Value != 0 {
+				if s.Labels == nil {
+					s.Labels = make(map[string][]vote)
+				}
+				s.Labels[name] = append(s.Labels[name], vote{Who: accountEmail(&v.AccountInfo), Value: v.Value})
+			}
+		}
+	}
+	return s
 }
 
-func searchIssues(q string) ([]*gerrit.ChangeInfo, error) {
-	chs, err := client.QueryChanges("is:open -project:scratch -message:do-not-review "+q, gerrit.QueryChangesOpt{
-		Fields: []string{
-			"DETAILED_ACCOUNTS",
-		},
+// searchIssues returns the changes matching the query q,
+// or, if limit is positive, at most limit of them.
+func searchIssues(q string, limit int) ([]*gerrit.ChangeInfo, error) {
+	var chs []*gerrit.ChangeInfo
+	err := searchIssuesPages(q, limit, func(all []*gerrit.ChangeInfo, more bool) {
+		chs = all
 	})
 	if err != nil {
 		return nil, err
@@ -64,6 +208,82 @@ func searchIssues(q string) ([]*gerrit.ChangeInfo, error) {
 	return chs, nil
 }
 
+// searchPageSize is the number of changes requested at a time by searchIssuesPages.
+const searchPageSize = 100
+
+// searchIssuesPages runs the query q (or the saved query named q),
+// restricted by the implicit filter, one page at a time,
+// calling page with all the changes found so far after each page arrives.
+// If limit is positive, searchIssuesPages stops after limit changes,
+// and the final call to page reports whether more changes match
+// than were fetched.
+func searchIssuesPages(q string, limit int, page func(all []*gerrit.ChangeInfo, more bool)) error {
+	if *flagDB != "" {
+		return fmt.Errorf("cannot search database")
+	}
+	var all []*gerrit.ChangeInfo
+	for {
+		n := searchPageSize
+		if limit > 0 && limit-len(all) < n {
+			n = limit - len(all)
+		}
+		chs, err := client.QueryChanges(strings.TrimSpace(queryFilter()+" "+expandQuery(q)), gerrit.QueryChangesOpt{
+			N:     n,
+			Start: len(all),
+			Fields: []string{
+				"DETAILED_ACCOUNTS",
+				"DETAILED_LABELS",
+				"SUBMITTABLE",
+			},
+		})
+		if err != nil {
+			return err
+		}
+		all = append(all, chs...)
+		more := len(chs) > 0 && chs[len(chs)-1].MoreChanges
+		if !more || limit > 0 && len(all) >= limit {
+			page(all, more)
+			return nil
+		}
+		page(all, false)
+	}
+}
+
+// sortChanges returns the changes in all that match the -project flag
+// and were updated within the -since duration,
+// sorted as directed by the -sort and -reverse flags.
+// It sorts all in place.
+func sortChanges(all []*gerrit.ChangeInfo) []*gerrit.ChangeInfo {
+	var x sort.Interface
+	switch *flagSort {
+	default: // "subject"
+		x = clsBySubject(all)
+	case "number":
+		x = clsByNumber(all)
+	case "updated":
+		x = clsByUpdated(all)
+	}
+	if *flagReverse {
+		x = sort.Reverse(x)
+	}
+	sort.Sort(x)
+
+	if *flagProject == "" && since == 0 {
+		return all
+	}
+	var out []*gerrit.ChangeInfo
+	for _, ch := range all {
+		if *flagProject != "" && ch.Project != *flagProject {
+			continue
+		}
+		if since > 0 && time.Since(ch.Updated.Time()) > since {
+			continue
+		}
+		out = append(out, ch)
+	}
+	return out
+}
+
 type clsBySubject []*gerrit.ChangeInfo
 
 func (x clsBySubject) Len() int      { return len(x) }
@@ -78,7 +298,35 @@ func (x clsBySubject) Less(i, j int) bool {
 	return x[i].ChangeNumber < x[j].ChangeNumber
 }
 
+// clsByNumber sorts by decreasing change number, like the acme Sort command.
+type clsByNumber []*gerrit.ChangeInfo
+
+func (x clsByNumber) Len() int           { return len(x) }
+func (x clsByNumber) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x clsByNumber) Less(i, j int) bool { return x[i].ChangeNumber > x[j].ChangeNumber }
+
+// clsByUpdated sorts by decreasing update time: most recently updated first.
+type clsByUpdated []*gerrit.ChangeInfo
+
+func (x clsByUpdated) Len() int      { return len(x) }
+func (x clsByUpdated) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x clsByUpdated) Less(i, j int) bool {
+	if ti, tj := x[i].Updated.Time(), x[j].Updated.Time(); !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+	return x[i].ChangeNumber > x[j].ChangeNumber
+}
+
+// shortEmail returns the name to show for the email address x.
+// By default that is the local part of the address,
+// but the configuration file can change that.
 func shortEmail(x string) string {
+	if nick := config.nick[x]; nick != "" {
+		return nick
+	}
+	if config.email == "full" {
+		return x
+	}
 	i := strings.Index(x, "@")
 	if i >= 0 {
 		return x[:i]
@@ -86,71 +334,283 @@ func shortEmail(x string) string {
 	return x
 }
 
+// accountName returns a short name for the account a.
+// It uses the email address when known (with DETAILED_ACCOUNTS,
+// or after fillAccounts) and otherwise falls back to the numeric account ID,
+// or "unknown" if a is nil (for example, for a deleted account).
+func accountName(a *gerrit.AccountInfo) string {
+	switch {
+	case a == nil:
+		return "unknown"
+	case a.Email != "":
+		return shortEmail(a.Email)
+	case a.NumericID != 0:
+		return fmt.Sprint(a.NumericID)
+	}
+	return "unknown"
+}
+
+// changeAccounts returns the accounts named in ch:
+// its owner, assignee, reviewers, attention set, voters, and message authors.
+func changeAccounts(ch *gerrit.ChangeInfo) []*gerrit.AccountInfo {
+	list := []*gerrit.AccountInfo{ch.Owner, ch.Assignee}
+	for _, rs := range ch.Reviewers {
+		list = append(list, rs...)
+	}
+	for _, a := range ch.AttentionSet {
+		list = append(list, a.Account)
+	}
+	for _, label := range ch.Labels {
+		for _, v := range label.All {
+			list = append(list, &v.AccountInfo)
+		}
+	}
+	for _, m := range ch.Messages {
+		list = append(list, m.Author)
+	}
+	return list
+}
+
+// fillAccounts fills in the email addresses missing from the accounts
+// in list (nil entries are allowed), looking them all up at once with
+// LookupAccounts, so that showing them takes one or two queries
+// instead of a call for each account.
+// Offline, or if the lookup fails, the accounts are left as they are.
+func fillAccounts(list []*gerrit.AccountInfo) {
+	if _, live := src.(liveSource); !live {
+		return
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, a := range list {
+		if a != nil && a.Email == "" && a.NumericID != 0 {
+			id := fmt.Sprint(a.NumericID)
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	found, err := client.LookupAccounts(ids)
+	if err != nil {
+		return
+	}
+	for _, a := range list {
+		if a != nil && a.Email == "" && a.NumericID != 0 {
+			if info := found[fmt.Sprint(a.NumericID)]; info != nil {
+				a.Email = info.Email
+				if a.Name == "" {
+					a.Name = info.Name
+				}
+			}
+		}
+	}
+}
+
+// accountEmail returns the email address of the account a,
+// or, if that is not known, accountName(a).
+func accountEmail(a *gerrit.AccountInfo) string {
+	if a != nil && a.Email != "" {
+		return a.Email
+	}
+	return accountName(a)
+}
+
 func shortTime(t gerrit.TimeStamp) string {
 	return t.Time().Format(time.Stamp)
 }
 
+// wrapWidth is the width text is wrapped to by default.
+const wrapWidth = 80
+
+// wrap returns t wrapped to wrapWidth columns,
+// with prefix inserted after each newline.
 func wrap(t string, prefix string) string {
-	const max = 80
-	out := ""
+	return wrapAt(t, prefix, wrapWidth)
+}
+
+// wrapAt returns t wrapped to max columns (or wrapWidth, if max <= 0),
+// with prefix inserted after each newline.
+// Long lines are broken after the last space that fits,
+// or else at the last character that fits.
+func wrapAt(t string, prefix string, max int) string {
+	if max <= 0 {
+		max = wrapWidth
+	}
+	var out strings.Builder
 	t = strings.Replace(t, "\r\n", "\n", -1)
 	lines := strings.Split(t, "\n")
 	for i, line := range lines {
 		if i > 0 {
-			out += "\n" + prefix
+			out.WriteString("\n" + prefix)
 		}
 		s := line
-		for len(s) > max {
-			i := strings.LastIndex(s[:max], " ")
-			if i < 0 {
-				i = max - 1
+		for textWidth(s) > max {
+			// Find the end of the text that fits
+			// and the last space in it.
+			fit, space, w := 0, -1, 0
+			for j := 0; j < len(s); {
+				r, size := utf8.DecodeRuneInString(s[j:])
+				if w += runeWidth(r); w > max {
+					break
+				}
+				if r == ' ' {
+					space = j
+				}
+				j += size
+				fit = j
 			}
-			i++
-			out += s[:i] + "\n" + prefix
+			i := fit
+			if space >= 0 {
+				i = space + 1
+			}
+			if i == 0 {
+				// A single character too wide to fit.
+				_, i = utf8.DecodeRuneInString(s)
+				if i == len(s) {
+					break
+				}
+			}
+			out.WriteString(s[:i] + "\n" + prefix)
 			s = s[i:]
 		}
-		out += s
+		out.WriteString(s)
 	}
-	return out
+	return out.String()
 }
 
-func showCL(w io.Writer, id int) (*CL, error) {
+// textWidth returns the number of columns needed to display s.
+func textWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// runeWidth returns the number of columns needed to display r:
+// 2 for wide characters, like those of Chinese, Japanese, and Korean
+// and most emoji, and 1 for all others.
+// It is only an approximation of the Unicode East Asian Width property.
+func runeWidth(r rune) int {
+	switch {
+	case 0x1100 <= r && r <= 0x115F, // Hangul Jamo
+		0x2E80 <= r && r <= 0x303E, // CJK radicals, punctuation
+		0x3041 <= r && r <= 0x33FF, // kana, CJK symbols
+		0x3400 <= r && r <= 0x4DBF, // CJK extension A
+		0x4E00 <= r && r <= 0x9FFF, // CJK unified ideographs
+		0xA000 <= r && r <= 0xA4CF, // Yi
+		0xAC00 <= r && r <= 0xD7A3, // Hangul syllables
+		0xF900 <= r && r <= 0xFAFF, // CJK compatibility ideographs
+		0xFE30 <= r && r <= 0xFE4F, // CJK compatibility forms
+		0xFF00 <= r && r <= 0xFF60, // fullwidth forms
+		0xFFE0 <= r && r <= 0xFFE6,
+		0x1F300 <= r && r <= 0x1F64F, // emoji
+		0x1F900 <= r && r <= 0x1F9FF,
+		0x20000 <= r && r <= 0x3FFFD: // CJK extensions B and later
+		return 2
+	}
+	return 1
+}
+
+// submitBlockers returns descriptions of the submit requirements
+// that ch does not meet, such as "Code-Review (UNSATISFIED)".
+// It uses the submit requirements from newer Gerrit servers
+// or the legacy requirements from older ones.
+func submitBlockers(ch *gerrit.ChangeInfo) []string {
+	var blocked []string
+	for _, r := range ch.SubmitRequirements {
+		if r.Status.Blocking() {
+			blocked = append(blocked, fmt.Sprintf("%s (%s)", r.Name, r.Status))
+		}
+	}
+	if ch.SubmitRequirements == nil {
+		for _, r := range ch.Requirements {
+			if r.Status != "OK" {
+				blocked = append(blocked, fmt.Sprintf("%s (%s)", r.FallbackText, r.Status))
+			}
+		}
+	}
+	return blocked
+}
+
+func showCL(w io.Writer, id, width int) (*CL, error) {
 	var cl CL
-	ch, err := client.GetChangeDetail(fmt.Sprint(id), gerrit.QueryChangesOpt{
-		Fields: []string{
-			"ALL_REVISIONS",
-			"DETAILED_ACCOUNTS",
-			"DETAILED_LABELS",
-			"ALL_COMMITS",
-			"ALL_FILES",
-			"MESSAGES",
-		},
-	})
+	cl.Wrap = width
+	ch, err := src.ChangeDetail(id)
 	if err != nil {
 		return nil, err
 	}
 	cl.ChangeInfo = ch
 
-	reviewers, err := client.ListReviewers(ch.ID)
-	if err != nil {
-		return nil, err
+	// The detail says who is a reviewer and who is only copied,
+	// except on old servers and offline.
+	if ch.Reviewers != nil {
+		cl.Reviewers = ch.Reviewers["REVIEWER"]
+		cl.CCs = ch.Reviewers["CC"]
+		if cl.CCs == nil {
+			cl.CCs = []*gerrit.AccountInfo{}
+		}
+	} else {
+		reviewers, err := src.ListReviewers(ch.ID)
+		if err != nil {
+			return nil, err
+		}
+		cl.Reviewers = reviewers
 	}
-	cl.Reviewers = reviewers
+	fillAccounts(append(append(changeAccounts(ch), cl.Reviewers...), cl.CCs...))
 
 	fmt.Fprintf(w, "# Project: %s\n", ch.Project)
 	fmt.Fprintf(w, "# Branch: %s\n", ch.Branch)
 	fmt.Fprintf(w, "# Created: %s\n", shortTime(ch.Created))
 	fmt.Fprintf(w, "# Updated: %s\n", shortTime(ch.Updated))
-	fmt.Fprintf(w, "# URL: https://go-review.googlesource.com/%v\n", ch.ChangeNumber)
+	fmt.Fprintf(w, "# URL: https://%s/%v\n", server, ch.ChangeNumber)
+	if len(ch.AttentionSet) > 0 {
+		var names []string
+		for _, a := range ch.AttentionSet {
+			names = append(names, accountName(a.Account))
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "# Attention: %s\n", strings.Join(names, " "))
+	}
+	if ch.Status == "NEW" {
+		if blocked := submitBlockers(ch); len(blocked) > 0 {
+			fmt.Fprintf(w, "# Not submittable: %s\n", strings.Join(blocked, ", "))
+		}
+	}
+	if ch.Status == "MERGED" {
+		// Best effort: the list is missing offline, for example.
+		if in, err := src.GetIncludedIn(ch.ID); err == nil {
+			list := append(in.Branches[:len(in.Branches):len(in.Branches)], in.Tags...)
+			if len(list) > 0 {
+				fmt.Fprintf(w, "# Included in: %s\n", strings.Join(list, " "))
+			}
+		}
+	}
 	fmt.Fprintf(w, "\n")
-	fmt.Fprintf(w, "Owner: %s\n", shortEmail(ch.Owner.Email))
+	fmt.Fprintf(w, "Owner: %s\n", accountName(ch.Owner))
 	fmt.Fprintf(w, "Reviewers:")
-	for _, r := range reviewers {
+	for _, r := range cl.Reviewers {
 		if !r.Equal(ch.Owner) {
 			fmt.Fprintf(w, " %s", shortEmail(r.Email))
 		}
 	}
 	fmt.Fprintf(w, "\n")
+	if cl.CCs != nil {
+		fmt.Fprintf(w, "CC:")
+		for _, r := range cl.CCs {
+			fmt.Fprintf(w, " %s", shortEmail(r.Email))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	// Newer servers have no assignees, so show the line
+	// only when there is one. Typing the line in sets one.
+	if ch.Assignee != nil {
+		fmt.Fprintf(w, "Assignee: %s\n", shortEmail(ch.Assignee.Email))
+	}
 	for name, label := range ch.Labels {
 		fmt.Fprintf(w, "%s: ", name)
 		for _, vote := range label.All {
@@ -166,7 +626,9 @@ func showCL(w io.Writer, id int) (*CL, error) {
 	fmt.Fprintf(w, "<optional comment here>\n\n")
 	fmt.Fprintf(w, "Patch Set %d (%d.%d)\n\n", rev.PatchSetNumber, ch.ChangeNumber, rev.PatchSetNumber)
 	c := rev.Commit
-	fmt.Fprintf(w, "\t%s\n", wrap(c.Message, "\t"))
+	// The commit message is shown as is, not wrapped,
+	// so that editing it changes only what the user changed.
+	fmt.Fprint(w, indent(c.Message))
 	fmt.Fprintf(w, "\tAuthor: %s <%s> %s\n", c.Author.Name, c.Author.Email, shortTime(c.Author.Date))
 	fmt.Fprintf(w, "\tCommitter: %s <%s> %s\n\n", c.Committer.Name, c.Committer.Email, shortTime(c.Committer.Date))
 	for name, file := range rev.Files {
@@ -174,13 +636,13 @@ func showCL(w io.Writer, id int) (*CL, error) {
 	}
 	fmt.Fprintf(w, "\n")
 
-	msgs, err := client.ListChangeComments(ch.ID)
+	msgs, err := src.ListChangeComments(ch.ID)
 	if err != nil {
 		return nil, err
 	}
 	cl.Comments = msgs
 
-	drafts, err := client.ListChangeDrafts(ch.ID)
+	drafts, err := src.ListChangeDrafts(ch.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -200,13 +662,13 @@ func showCL(w io.Writer, id int) (*CL, error) {
 			who = shortEmail(m.Author.Email)
 		}
 		fmt.Fprintf(w, "Comment by %s (%s)\n", who, shortTime(m.Time))
-		fmt.Fprintf(w, "\n\t%s\n", wrap(m.Message, "\t"))
+		fmt.Fprintf(w, "\n\t%s\n", wrapAt(m.Message, "\t", cl.Wrap))
 		fmt.Fprintf(w, "\n")
 		for _, file := range files {
 			kept := msgs[file][:0]
 			for _, msg := range msgs[file] {
 				if msg.Author != nil && msg.Author.Equal(m.Author) && msg.Updated.Time().Equal(m.Time.Time()) {
-					fmt.Fprintf(w, "\t> %s:%d\n\n\t%s\n\n", file, msg.Line, wrap(msg.Message, "\t"))
+					fmt.Fprintf(w, "\t> %s:%d\n\n\t%s\n\n", file, msg.Line, wrapAt(msg.Message, "\t", cl.Wrap))
 				} else {
 					kept = append(kept, msg)
 				}
@@ -215,35 +677,68 @@ func showCL(w io.Writer, id int) (*CL, error) {
 		}
 	}
 
-	/*
-		for _, file := range files {
-			for _, m := range msgs[file] {
-				fmt.Fprintf(w, "Comment by %s (%s)\n\n", shortEmail(m.Author.Email), shortTime(*m.Updated))
-				fmt.Fprintf(w, "\t> %s:%d\n\n\t%s\n\n", file, m.Line, wrap(m.Message, "\t"))
+	// Show the caller's unsent drafts, which match no message.
+	for _, file := range files {
+		for _, m := range drafts[file] {
+			fmt.Fprintf(w, "%s\n\n", draftHeader)
+			if m.Line == 0 {
+				fmt.Fprintf(w, "\t> %s (patch set %d)\n\n", file, m.PatchSet)
+			} else {
+				fmt.Fprintf(w, "\t> %s:%d (patch set %d)\n\n", file, m.Line, m.PatchSet)
 			}
+			fmt.Fprintf(w, "\t%s\n\n", wrapAt(m.Message, "\t", cl.Wrap))
 		}
-	*/
+	}
 	return &cl, nil
 }
 
 const DiffPrefix = "\u22ee"
 
-func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
+// commitRE matches a full or abbreviated commit ID.
+var commitRE = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// A diffView says how showPatchSet shows diffs.
+type diffView struct {
+	context   int  // lines of context around each change
+	width     int  // width of side-by-side rows (see formatSideBySide), or 0 for unified diffs
+	ignoreWS  bool // ignore changes in whitespace
+	intraline bool // mark changes within lines (unified diffs only)
+	showWS    bool // make tabs, trailing spaces, and carriage returns visible
+	wrap      int  // width comments are wrapped to (see wrapAt)
+	color     bool // color diffs with ANSI escapes (terminal output only)
+}
+
+// diffJobs is the number of file diffs showPatchSet fetches at once.
+// It is kept small to avoid tripping the server's rate limits.
+const diffJobs = 8
+
+// showPatchSet shows patch set patch of change id,
+// formatting the diffs as described by view.
+// If base is not empty, the diffs are against base,
+// which is either the number of another patch set
+// or the (possibly abbreviated) ID of an arbitrary commit.
+// If patch is 0, showPatchSet shows the current patch set.
+func showPatchSet(w io.Writer, id int, base string, patch int, view diffView) (*CL, error) {
+	if *flagDB != "" {
+		// The database has no diffs, so a patch set view
+		// would be nothing but errors.
+		return nil, fmt.Errorf("cannot show patch set %d.%d: the database has no diffs", id, patch)
+	}
 	var cl CL
-	ch, err := client.GetChangeDetail(fmt.Sprint(id), gerrit.QueryChangesOpt{
-		Fields: []string{
-			"ALL_REVISIONS",
-			"DETAILED_ACCOUNTS",
-			"DETAILED_LABELS",
-			"ALL_COMMITS",
-			"ALL_FILES",
-		},
-	})
+	cl.SideBySide = view.width
+	cl.Wrap = view.wrap
+	cl.Lines = make(map[string][]Line)
+	ch, err := src.ChangeDetail(id)
 	if err != nil {
 		return nil, err
 	}
 	cl.ChangeInfo = ch
 
+	if patch == 0 {
+		if rev := ch.Revisions[ch.CurrentRevision]; rev != nil {
+			patch = rev.PatchSetNumber
+		}
+	}
 	patchID := ""
 	var patchRev *gerrit.RevisionInfo
 	for revID, rev := range ch.Revisions {
@@ -266,25 +761,45 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 		// bug gets fixed, ask for full context explicitly.
 		Context: -1,
 	}
-	if base != 0 {
+	if view.ignoreWS {
+		opt.IgnoreWhitespace = "ALL"
+	}
+	opt.Intraline = view.intraline
+	if base != "" {
 		for revID, rev := range ch.Revisions {
-			if rev.PatchSetNumber == base {
+			if fmt.Sprint(rev.PatchSetNumber) == base || len(base) >= 7 && strings.HasPrefix(revID, base) {
 				opt.Base = revID
 				cl.Base = opt.Base
 				cl.BaseRev = rev
 				goto FoundBase
 			}
 		}
-		return nil, fmt.Errorf("unknown patch set base %d", base)
+		if !commitRE.MatchString(base) {
+			return nil, fmt.Errorf("unknown patch set base %s", base)
+		}
+		// Not a patch set of this change: pass the commit to Gerrit as is.
+		opt.Base = base
+		cl.Base = opt.Base
 	FoundBase:
 	}
 
-	msgs, err := client.ListRevisionComments(ch.ID, patchID)
+	msgs, err := src.ListRevisionComments(ch.ID, patchID)
 	if err != nil {
 		return nil, err
 	}
 	cl.Comments = msgs
-	drafts, err := client.ListRevisionDrafts(ch.ID, patchID)
+	// Servers without robot comments answer 404, and robot comments
+	// are only extra information, so show the patch set without them
+	// if they cannot be had.
+	robots, _ := src.ListRevisionRobotComments(ch.ID, patchID)
+	robot := make(map[*gerrit.CommentInfo]*gerrit.RobotCommentInfo)
+	for file, list := range robots {
+		for _, rc := range list {
+			robot[&rc.CommentInfo] = rc
+			msgs[file] = append(msgs[file], &rc.CommentInfo)
+		}
+	}
+	drafts, err := src.ListRevisionDrafts(ch.ID, patchID)
 	if err != nil {
 		return nil, err
 	}
@@ -292,7 +807,9 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 		msgs[file] = append(msgs[file], list...)
 	}
 
-	if opt.Base != "" {
+	if cl.Base != "" {
+		// Comments on the parent are placed by the parent's line numbers,
+		// which do not match the old side of a diff against another base.
 		for file, list := range msgs {
 			out := list[:0]
 			for _, m := range list {
@@ -302,12 +819,13 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 			}
 			msgs[file] = out
 		}
-
-		msgsBase, err := client.ListRevisionComments(ch.ID, opt.Base)
+	}
+	if cl.BaseRev != nil {
+		msgsBase, err := src.ListRevisionComments(ch.ID, opt.Base)
 		if err != nil {
 			return nil, err
 		}
-		drafts, err := client.ListRevisionDrafts(ch.ID, patchID)
+		drafts, err := src.ListRevisionDrafts(ch.ID, patchID)
 		if err != nil {
 			return nil, err
 		}
@@ -324,23 +842,94 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 	}
 
 	baseStr := ""
-	if base != 0 {
-		baseStr = fmt.Sprintf(" (against base patch set %d)", base)
+	if cl.BaseRev != nil {
+		baseStr = fmt.Sprintf(" (against base patch set %d)", cl.BaseRev.PatchSetNumber)
+	} else if cl.Base != "" {
+		baseStr = fmt.Sprintf(" (against base commit %s)", cl.Base)
 	}
 	fmt.Fprintf(w, "CL %d Patch Set %d%s\n", id, patch, baseStr)
+	commit := patchRev.Commit
+	if commit == nil || len(commit.Parents) == 0 {
+		// The parents are only informational: if the commit
+		// cannot be had (say, from a database synced without it),
+		// leave out the Parent lines rather than the whole patch set.
+		if c, err := src.GetCommit(ch.ID, patchID); err == nil {
+			commit = c
+		}
+	}
+	if commit != nil {
+		for _, p := range commit.Parents {
+			fmt.Fprintf(w, "Parent: %.8s (%s)\n", p.CommitID, p.Subject)
+		}
+	}
 	fmt.Fprintf(w, "\n")
 
+	if patchRev.Files == nil {
+		patchRev.Files, err = src.ListFiles(ch.ID, patchID, gerrit.ListFilesOpt{Base: opt.Base})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Anonymous users have no reviewed files, and the server
+	// refuses to list them, so treat any error as none reviewed.
+	reviewed, _ := src.ListReviewedFiles(ch.ID, patchID)
+	cl.Reviewed = make(map[string]bool)
+	for _, file := range reviewed {
+		cl.Reviewed[file] = true
+	}
+
 	var files []string
 	for file := range patchRev.Files {
 		files = append(files, file)
 	}
 	sort.Strings(files)
 
-	for _, file := range files {
-		const maxContext = 3
-		fmt.Fprintf(w, "File %s\n\n", file)
+	// Fetch the diffs using up to diffJobs workers,
+	// so that a code review touching many files does not
+	// wait for one round trip after another,
+	// and then show them in file order.
+	type result struct {
+		diff *gerrit.DiffInfo
+		err  error
+	}
+	diffs := make([]result, len(files))
+	work := make(chan int)
+	done := make(chan bool)
+	for i := 0; i < diffJobs; i++ {
+		go func() {
+			for j := range work {
+				diff, err := src.GetDiff(ch.ID, patchID, files[j], opt)
+				diffs[j] = result{diff, err}
+			}
+			done <- true
+		}()
+	}
+	for j := range files {
+		work <- j
+	}
+	close(work)
+	for i := 0; i < diffJobs; i++ {
+		<-done
+	}
+
+	for j, file := range files {
+		diff, err := diffs[j].diff, diffs[j].err
+		fi := patchRev.Files[file]
 
-		diff, err := client.GetDiff(ch.ID, patchID, file, opt)
+		// Show a renamed or copied file's old name too,
+		// so that it does not look like a new file.
+		header := file
+		if oldPath, how := renamedFrom(fi, diff); oldPath != "" {
+			header = fmt.Sprintf("%s => %s (%s)", oldPath, file, how)
+		}
+		if cl.Reviewed[file] {
+			header += " (reviewed)"
+		}
+		if view.color {
+			fmt.Fprintf(w, "%sFile %s%s\n\n", ansiBold, header, ansiReset)
+		} else {
+			fmt.Fprintf(w, "File %s\n\n", header)
+		}
 
 		var oldMsgs, newMsgs []*gerrit.CommentInfo
 		for _, m := range msgs[file] {
@@ -353,27 +942,56 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 		sort.Sort(msgsByDisplay(oldMsgs))
 		sort.Sort(msgsByDisplay(newMsgs))
 
+		// A binary file has no lines to diff or to anchor comments to,
+		// so all its comments are shown after the summary.
+		binary := fi != nil && fi.Binary || err == nil && diff.Binary
+		if err != nil && binary {
+			diff, err = nil, nil
+		}
+
 		sep := ""
 		if err != nil {
 			fmt.Fprintf(w, "ERROR: %v\n", err)
 		} else {
-			udiff := formatUnifiedDiff(diff)
+			var udiff []Line
+			if binary {
+				showBinary(w, file, fi, diff)
+				sep = "\n"
+			} else {
+				udiff = formatUnifiedDiff(diff, file, view.context)
+				if view.showWS {
+					udiff = showWhitespace(udiff)
+				}
+				cl.Lines[file] = udiff
+				if view.width > 0 {
+					udiff = formatSideBySide(udiff, view.width)
+				}
+			}
 			printMsg := func(m *gerrit.CommentInfo, isNew bool) {
 				if m.IsDraft() {
-					fmt.Fprintf(w, "%s%s\n\n", sep, m.Message)
+					fmt.Fprintf(w, "%s%s\n%s\n\n", sep, draftHeader, draftText(m))
 					m.Side = ""
 					if isNew {
 						m.PatchSet = patchRev.PatchSetNumber
-					} else if base != 0 {
-						m.PatchSet = base
+					} else if cl.BaseRev != nil {
+						m.PatchSet = cl.BaseRev.PatchSetNumber
 					} else {
 						m.PatchSet = 0
 						m.Side = "PARENT"
 					}
 					cl.Drafts = append(cl.Drafts, m)
+				} else if rc := robot[m]; rc != nil {
+					fmt.Fprintf(w, "%s%s\n\n", sep, commentHeader(m))
+					fmt.Fprintf(w, "\t[robot %s] %s\n\n", rc.RobotID, wrapAt(m.Message, "\t", cl.Wrap))
+					if rc.URL != "" {
+						fmt.Fprintf(w, "\t%s\n\n", rc.URL)
+					}
+					for _, fix := range rc.FixSuggestions {
+						fmt.Fprintf(w, "\tSuggested fix: %s\n\n", wrapAt(fix.Description, "\t", cl.Wrap))
+					}
 				} else {
 					fmt.Fprintf(w, "%s%s\n\n", sep, commentHeader(m))
-					fmt.Fprintf(w, "\t%s\n\n", wrap(m.Message, "\t"))
+					fmt.Fprintf(w, "\t%s\n\n", wrapAt(m.Message, "\t", cl.Wrap))
 				}
 				sep = ""
 			}
@@ -386,7 +1004,11 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 				newMsgs = newMsgs[1:]
 			}
 			for _, line := range udiff {
-				fmt.Fprintf(w, "%s%s%s\n", DiffPrefix, line.Prefix, line.Text)
+				if c := diffColor(line); view.color && c != "" {
+					fmt.Fprintf(w, "%s%s%s%s%s\n", c, DiffPrefix, line.Prefix, markEdits(line.Text, line.Edits), ansiReset)
+				} else {
+					fmt.Fprintf(w, "%s%s%s\n", DiffPrefix, line.Prefix, markEdits(line.Text, line.Edits))
+				}
 				sep = "\n"
 				for len(oldMsgs) > 0 && oldMsgs[0].Line <= line.Old {
 					printMsg(oldMsgs[0], false)
@@ -409,6 +1031,60 @@ func showPatchSet(w io.Writer, id, base, patch int) (*CL, error) {
 	return &cl, nil
 }
 
+// renamedFrom returns the old name of a file renamed or copied
+// by a patch set, along with "renamed" or "copied",
+// using the file's info fi or, if that is missing, its diff.
+// If the file was neither renamed nor copied, renamedFrom returns "", "".
+func renamedFrom(fi *gerrit.FileInfo, diff *gerrit.DiffInfo) (oldPath, how string) {
+	if fi != nil && fi.OldPath != "" {
+		switch fi.Status {
+		case "R":
+			return fi.OldPath, "renamed"
+		case "C":
+			return fi.OldPath, "copied"
+		}
+	}
+	if diff != nil && diff.MetaA != nil {
+		switch diff.ChangeType {
+		case "RENAMED":
+			return diff.MetaA.Name, "renamed"
+		case "COPIED":
+			return diff.MetaA.Name, "copied"
+		}
+	}
+	return "", ""
+}
+
+// showBinary shows the summary of the changes to the binary file,
+// which replaces the diff in a patch set window,
+// followed by any links to views of the file on other sites, like image viewers.
+// The file info fi and diff may be nil if not known.
+func showBinary(w io.Writer, file string, fi *gerrit.FileInfo, diff *gerrit.DiffInfo) {
+	if fi != nil {
+		fmt.Fprintf(w, "%sBinary file %s changed (%+d bytes)\n", DiffPrefix, file, fi.SizeDelta)
+	} else {
+		fmt.Fprintf(w, "%sBinary file %s changed\n", DiffPrefix, file)
+	}
+	if diff == nil {
+		return
+	}
+	links := diff.WebLinks
+	if diff.MetaA != nil {
+		links = append(links, diff.MetaA.WebLinks...)
+	}
+	if diff.MetaB != nil {
+		links = append(links, diff.MetaB.WebLinks...)
+	}
+	seen := make(map[string]bool)
+	for _, link := range links {
+		if link.URL == "" || seen[link.URL] {
+			continue
+		}
+		seen[link.URL] = true
+		fmt.Fprintf(w, "%s%s: %s\n", DiffPrefix, link.Name, link.URL)
+	}
+}
+
 type msgsByDisplay []*gerrit.CommentInfo
 
 func (x msgsByDisplay) Len() int      { return len(x) }
@@ -428,18 +1104,52 @@ type Line struct {
 	Text   string
 	Old    int
 	New    int
+	Edits  [][2]int // character spans of Text changed within the line
+}
+
+// ANSI terminal escapes for coloring diffs.
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiDim   = "\x1b[2m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+)
+
+// diffColor returns the ANSI escape for coloring the diff line,
+// or "" to leave it uncolored: green for insertions, red for deletions,
+// dim for context, and bold for hunk headers.
+func diffColor(line Line) string {
+	switch line.Prefix {
+	case "+":
+		return ansiGreen
+	case "-":
+		return ansiRed
+	case " ":
+		return ansiDim
+	case "":
+		if strings.HasPrefix(line.Text, "@@ ") {
+			return ansiBold
+		}
+	}
+	return ""
 }
 
-func formatUnifiedDiff(diff *gerrit.DiffInfo) []Line {
+// formatUnifiedDiff formats diff as a unified diff
+// with maxContext lines of context around each change.
+// The diff must have full context, so that any amount can be shown.
+// The name of the diffed file decides how the hunk headers
+// find the declaration enclosing each hunk.
+func formatUnifiedDiff(diff *gerrit.DiffInfo, file string, maxContext int) []Line {
+	isDecl := declFunc(file)
 	var out []Line
 	for _, line := range diff.DiffHeader {
 		out = append(out, Line{Text: line})
 	}
 
-	content := diff.Content
+	content := commonContent(diff.Content)
 	oldLine := 1
 	newLine := 1
-	const maxContext = 3
 	decl := ""
 	for len(content) > 0 {
 		// Leading common chunk always included.
@@ -474,7 +1184,7 @@ func formatUnifiedDiff(diff *gerrit.DiffInfo) []Line {
 					skip := len(c.AB) - maxContext
 					for _, line := range c.AB[:skip] {
 						if isDecl(line) {
-							decl = " " + line
+							decl = " " + strings.TrimLeft(line, " \t")
 							startDecl = decl
 						}
 					}
@@ -491,19 +1201,21 @@ func formatUnifiedDiff(diff *gerrit.DiffInfo) []Line {
 					oldLine++
 					newLine++
 					if isDecl(line) {
-						decl = " " + line
+						decl = " " + strings.TrimLeft(line, " \t")
 					}
 				}
 			} else {
-				for _, line := range c.A {
-					chunk = append(chunk, Line{Prefix: "-", Text: line, Old: oldLine, New: 0})
+				editsA := intralineEdits(c.A, c.EditA)
+				editsB := intralineEdits(c.B, c.EditB)
+				for i, line := range c.A {
+					chunk = append(chunk, Line{Prefix: "-", Text: line, Old: oldLine, New: 0, Edits: editsA[i]})
 					oldLine++
 				}
-				for _, line := range c.B {
-					chunk = append(chunk, Line{Prefix: "+", Text: line, Old: 0, New: newLine})
+				for i, line := range c.B {
+					chunk = append(chunk, Line{Prefix: "+", Text: line, Old: 0, New: newLine, Edits: editsB[i]})
 					newLine++
 					if isDecl(line) {
-						decl = " " + line
+						decl = " " + strings.TrimLeft(line, " \t")
 					}
 				}
 			}
@@ -527,14 +1239,348 @@ func formatUnifiedDiff(diff *gerrit.DiffInfo) []Line {
 	return out
 }
 
+// Intraline edits are shown by bracketing the changed text
+// with editStart and editEnd.
+const (
+	editStart = "\u27e6"
+	editEnd   = "\u27e7"
+)
+
+// intralineEdits returns, for each of the lines,
+// the character spans within it changed by the intraline edits.
+// The edits measure characters across all the lines,
+// counting a newline at the end of each,
+// so an edit may span several lines; its part in each is returned.
+func intralineEdits(lines []string, edits gerrit.DiffIntralineInfo) [][][2]int {
+	out := make([][][2]int, len(lines))
+	if len(edits) == 0 {
+		return out
+	}
+	i := 0    // index of current line
+	base := 0 // character offset of start of lines[i]
+	pos := 0  // character offset of end of last edit
+	for _, e := range edits {
+		if len(e) != 2 {
+			continue
+		}
+		start := pos + e[0]
+		end := start + e[1]
+		pos = end
+		for ; i < len(lines); i++ {
+			n := utf8.RuneCountInString(lines[i])
+			s, t := start-base, end-base
+			if s < 0 {
+				s = 0
+			}
+			if t > n {
+				t = n
+			}
+			if s < t {
+				out[i] = append(out[i], [2]int{s, t})
+			}
+			if end <= base+n+1 {
+				// The edit ends in this line (or its newline);
+				// the next edit may start in it too.
+				break
+			}
+			base += n + 1
+		}
+	}
+	return out
+}
+
+// markEdits returns text with the character spans in edits
+// bracketed by editStart and editEnd.
+func markEdits(text string, edits [][2]int) string {
+	if len(edits) == 0 {
+		return text
+	}
+	var buf strings.Builder
+	n := 0
+	for _, r := range text {
+		for _, e := range edits {
+			if e[0] == n {
+				buf.WriteString(editStart)
+			}
+		}
+		buf.WriteRune(r)
+		n++
+		for _, e := range edits {
+			if e[1] == n {
+				buf.WriteString(editEnd)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// showWhitespace returns a copy of the diff lines udiff
+// with the tabs, trailing spaces, and carriage returns in the file lines
+// replaced by visible characters. Each character is replaced by one other,
+// so that character positions in the lines are unchanged.
+func showWhitespace(udiff []Line) []Line {
+	out := make([]Line, len(udiff))
+	for i, line := range udiff {
+		if line.Prefix != "" {
+			text := []rune(line.Text)
+			trailing := true
+			for j := len(text) - 1; j >= 0; j-- {
+				switch text[j] {
+				case ' ':
+					if trailing {
+						text[j] = '\u00b7' // ·
+					}
+				case '\t':
+					text[j] = '\u2192' // →
+				case '\r':
+					text[j] = '\u240d' // ␍
+				default:
+					trailing = false
+				}
+			}
+			line.Text = string(text)
+		}
+		out[i] = line
+	}
+	return out
+}
+
+// commonContent returns content with each region that differs
+// only in ignored whitespace (see gerrit.DiffContent.Common)
+// made into common lines, showing the new text,
+// and merged with the common lines around it.
+// It does not modify content.
+func commonContent(content []*gerrit.DiffContent) []*gerrit.DiffContent {
+	var out []*gerrit.DiffContent
+	for _, c := range content {
+		if c.Common && len(c.A) == len(c.B) {
+			c = &gerrit.DiffContent{AB: c.B}
+		}
+		if n := len(out); n > 0 && len(c.AB) > 0 && len(out[n-1].AB) > 0 {
+			ab := append(out[n-1].AB[:len(out[n-1].AB):len(out[n-1].AB)], c.AB...)
+			out[n-1] = &gerrit.DiffContent{AB: ab}
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// sideBySideSep separates the old and new columns of a side-by-side diff.
+const sideBySideSep = " \u2502 "
+
+// tabWidth is the spacing of the tab stops used to expand tabs
+// in side-by-side diffs, so that the columns line up.
+const tabWidth = 4
+
+// sideBySideColumn returns the width of each column
+// in a side-by-side diff width characters wide.
+func sideBySideColumn(width int) int {
+	cw := (width - utf8.RuneCountInString(DiffPrefix) - 1 - utf8.RuneCountInString(sideBySideSep)) / 2
+	if cw < 10 {
+		cw = 10
+	}
+	return cw
+}
+
+// formatSideBySide lays out the unified diff lines udiff
+// in two columns, old lines on the left and new lines on the right,
+// in rows width characters wide (including DiffPrefix).
+// The Prefix of each row is " " for a common line, "-" for a deleted line,
+// "+" for an inserted line, "!" for a deleted line beside the inserted line
+// replacing it, and "." for the continuation of lines too long for their columns.
+// The line numbers Old and New are set only in the last row for each line,
+// so that the comments shown after that row follow the whole line.
+// Header lines are copied unchanged.
+func formatSideBySide(udiff []Line, width int) []Line {
+	cw := sideBySideColumn(width)
+	var out []Line
+	row := func(prefix string, old, new *Line) {
+		var left, right []rune
+		var last Line
+		if old != nil {
+			left = []rune(expandTabs(old.Text))
+			last.Old = old.Old
+		}
+		if new != nil {
+			right = []rune(expandTabs(new.Text))
+			last.New = new.New
+		}
+		for i := 0; i == 0 || i < len(left) || i < len(right); i += cw {
+			l := runeSlice(left, i, i+cw)
+			r := runeSlice(right, i, i+cw)
+			text := l + strings.Repeat(" ", cw-utf8.RuneCountInString(l)) + sideBySideSep + r
+			out = append(out, Line{Prefix: prefix, Text: strings.TrimRight(text, " ")})
+			prefix = "."
+		}
+		out[len(out)-1].Old = last.Old
+		out[len(out)-1].New = last.New
+	}
+
+	for i := 0; i < len(udiff); {
+		line := &udiff[i]
+		switch line.Prefix {
+		case "":
+			out = append(out, *line)
+			i++
+		case " ":
+			row(" ", line, line)
+			i++
+		case "+":
+			row("+", nil, line)
+			i++
+		case "-":
+			// Pair the run of deleted lines
+			// with the run of inserted lines following it.
+			j := i
+			for j < len(udiff) && udiff[j].Prefix == "-" {
+				j++
+			}
+			k := j
+			for k < len(udiff) && udiff[k].Prefix == "+" {
+				k++
+			}
+			for n := 0; n < j-i || n < k-j; n++ {
+				switch {
+				case n < j-i && n < k-j:
+					row("!", &udiff[i+n], &udiff[j+n])
+				case n < j-i:
+					row("-", &udiff[i+n], nil)
+				default:
+					row("+", nil, &udiff[j+n])
+				}
+			}
+			i = k
+		}
+	}
+	return out
+}
+
+// runeSlice returns the string holding r[i:j],
+// clipping i and j to the length of r.
+func runeSlice(r []rune, i, j int) string {
+	if j > len(r) {
+		j = len(r)
+	}
+	if i > j {
+		i = j
+	}
+	return string(r[i:j])
+}
+
+// expandTabs returns text with its tabs expanded to spaces.
+func expandTabs(text string) string {
+	if !strings.Contains(text, "\t") {
+		return text
+	}
+	var buf []rune
+	for _, r := range text {
+		if r == '\t' {
+			buf = append(buf, ' ')
+			for len(buf)%tabWidth != 0 {
+				buf = append(buf, ' ')
+			}
+			continue
+		}
+		buf = append(buf, r)
+	}
+	return string(buf)
+}
+
+// expandedChar returns the number of characters of text
+// shown before column col once its tabs are expanded.
+func expandedChar(text string, col int) int {
+	n, c := 0, 0
+	for _, r := range text {
+		if c >= col {
+			break
+		}
+		if r == '\t' {
+			c += tabWidth - c%tabWidth
+		} else {
+			c++
+		}
+		n++
+	}
+	return n
+}
+
+// declFunc returns the function that reports whether
+// a line of file begins a declaration, which names the hunks
+// in the file's unified diff, as in diff -p.
+func declFunc(file string) func(string) bool {
+	switch path.Ext(file) {
+	case ".py":
+		return isPythonDecl
+	case ".md", ".markdown":
+		return isMarkdownHeading
+	case ".yaml", ".yml":
+		return isYAMLKey
+	}
+	return isDecl
+}
+
+// isDecl reports whether x is unindented, like a declaration
+// in C, Go, and many other languages.
 func isDecl(x string) bool {
 	return len(x) > 0 && x[0] != '\n' && x[0] != ' ' && x[0] != '\t' && x[0] != '\r'
 }
 
+// isPythonDecl reports whether x is a Python def or class line,
+// which may be indented.
+func isPythonDecl(x string) bool {
+	x = strings.TrimLeft(x, " \t")
+	return strings.HasPrefix(x, "def ") || strings.HasPrefix(x, "async def ") || strings.HasPrefix(x, "class ")
+}
+
+// isMarkdownHeading reports whether x is a Markdown heading.
+func isMarkdownHeading(x string) bool {
+	return strings.HasPrefix(x, "#")
+}
+
+// isYAMLKey reports whether x is a top-level key in a YAML file.
+func isYAMLKey(x string) bool {
+	return isDecl(x) && x[0] != '#' && x[0] != '-' && strings.Contains(x, ":")
+}
+
 func commentHeader(c *gerrit.CommentInfo) string {
-	who := "draft xxx"
+	who := "draft"
 	if c.Author != nil {
 		who = shortEmail(c.Author.Email)
 	}
-	return fmt.Sprintf("%s (%s):", who, shortTime(*c.Updated))
+	hdr := fmt.Sprintf("%s (%s):", who, shortTime(*c.Updated))
+	if r := c.Range; r != nil && r.StartLine != r.EndLine {
+		hdr += fmt.Sprintf(" (lines %d-%d)", r.StartLine, r.EndLine)
+	}
+	if c.Unresolved != nil && *c.Unresolved {
+		hdr += " (unresolved)"
+	}
+	return hdr
+}
+
+// draftHeader is the line shown before each unsent draft comment.
+// In a patch set window, the text after it can be edited.
+const draftHeader = "Draft (unsent):"
+
+// Directive lines at the end of a draft comment
+// set whether the comment thread is resolved.
+const (
+	resolvedDirective   = "[resolved]"
+	unresolvedDirective = "[unresolved]"
+)
+
+// draftText returns the text to show for the draft comment c,
+// including a resolution directive if needed to round-trip
+// the draft's resolution state.
+func draftText(c *gerrit.CommentInfo) string {
+	switch {
+	case c.Unresolved == nil:
+		return c.Message
+	case *c.Unresolved:
+		return strings.TrimRight(c.Message, "\n") + "\n" + unresolvedDirective
+	case c.InReplyTo != "":
+		// Only needed for replies; false is the default for new threads.
+		return strings.TrimRight(c.Message, "\n") + "\n" + resolvedDirective
+	}
+	return c.Message
 }
@@ -0,0 +1,134 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"rsc.io/gerrit/internal/gerrit"
+)
+
+// useLiveSource makes src read from client for the duration of the test.
+func useLiveSource(t *testing.T) {
+	old := src
+	src = liveSource{client}
+	t.Cleanup(func() { src = old })
+}
+
+func TestPrintQueryLooksUpAccountsAtOnce(t *testing.T) {
+	reqs := useTestServer(t, func(req testRequest) string {
+		switch req.Path {
+		case "/accounts/":
+			return `[
+				{"_account_id": 1001, "email": "ann@golang.org"},
+				{"_account_id": 1002, "email": "bob@golang.org"}
+			]`
+		case "/config/server/version":
+			return `"2.16"`
+		}
+		return ""
+	})
+	useLiveSource(t)
+
+	chs := []*gerrit.ChangeInfo{
+		{ChangeNumber: 1234, Subject: "a", Owner: &gerrit.AccountInfo{NumericID: 1001}},
+		{ChangeNumber: 1235, Subject: "b", Owner: &gerrit.AccountInfo{NumericID: 1002}},
+		{ChangeNumber: 1236, Subject: "c", Owner: &gerrit.AccountInfo{NumericID: 1001}},
+	}
+	var buf bytes.Buffer
+	printQuery(&buf, chs)
+	out := buf.String()
+	for _, who := range []string{"ann", "bob"} {
+		if !strings.Contains(out, "\t"+who+"\t") {
+			t.Errorf("printQuery output does not name %s:\n%s", who, out)
+		}
+	}
+	n := 0
+	for _, req := range reqs() {
+		if strings.HasPrefix(req.Path, "/accounts/") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("printQuery made %d account requests, want 1", n)
+	}
+}
+
+func TestPrintQueryWithoutOwner(t *testing.T) {
+	useTestServer(t, nil)
+	useLiveSource(t)
+
+	chs := []*gerrit.ChangeInfo{
+		{ChangeNumber: 1234, Subject: "orphan"},
+		{ChangeNumber: 1235, Subject: "numbered", Owner: &gerrit.AccountInfo{NumericID: 1001}},
+	}
+	var buf bytes.Buffer
+	printQuery(&buf, chs)
+	out := buf.String()
+	if !strings.Contains(out, "\torphan\tunknown\t") {
+		t.Errorf("printQuery output does not show unknown owner:\n%s", out)
+	}
+	if !strings.Contains(out, "\tnumbered\t1001\t") {
+		t.Errorf("printQuery output does not show numeric owner:\n%s", out)
+	}
+}
+
+var textWidthTests = []struct {
+	s string
+	n int
+}{
+	{"", 0},
+	{"hello", 5},
+	{"héllo", 5},
+	{"世界", 4},
+	{"Go 言語", 7},
+	{"한국어", 6},
+	{"カタカナ", 8},
+	{"ｆｕｌｌ", 8},
+	{"🙂 ok", 5},
+	{"🤖", 2},
+	{"\t", 1},
+}
+
+func TestTextWidth(t *testing.T) {
+	for _, tt := range textWidthTests {
+		if n := textWidth(tt.s); n != tt.n {
+			t.Errorf("textWidth(%q) = %d, want %d", tt.s, n, tt.n)
+		}
+	}
+}
+
+var wrapAtTests = []struct {
+	s   string
+	max int
+	out string
+}{
+	{"short line", 20, "short line"},
+	{"the quick brown fox", 10, "the quick \n>brown fox"},
+	{"abcdefghij", 4, "abcd\n>efgh\n>ij"},
+	{"one\ntwo three", 5, "one\n>two \n>three"},
+	{"crlf\r\nline", 10, "crlf\n>line"},
+
+	// Wide characters count two columns each.
+	{"世界你好", 4, "世界\n>你好"},
+	{"世界你好", 5, "世界\n>你好"},
+	{"Go 言語です", 6, "Go \n>言語で\n>す"},
+	{"🙂🙂🙂", 4, "🙂🙂\n>🙂"},
+
+	// A single wide character wider than max stands alone on its line.
+	{"世", 1, "世"},
+	{"世界", 1, "世\n>界"},
+	{"a世", 1, "a\n>世"},
+}
+
+func TestWrapAt(t *testing.T) {
+	for _, tt := range wrapAtTests {
+		if out := wrapAt(tt.s, ">", tt.max); out != tt.out {
+			t.Errorf("wrapAt(%q, %d) = %q, want %q", tt.s, tt.max, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "rsc.io/gerrit/internal/gerrit"
+
+// A reviewSource provides the code review data shown by showCL and showPatchSet.
+// The live source is the Gerrit server; with the -db flag,
+// the data comes instead from a database maintained by reviewdb.
+type reviewSource interface {
+	ChangeDetail(id int) (*gerrit.ChangeInfo, error)
+	ListReviewers(changeID string) ([]*gerrit.AccountInfo, error)
+	ListChangeComments(changeID string) (map[string][]*gerrit.CommentInfo, error)
+	ListChangeDrafts(changeID string) (map[string][]*gerrit.CommentInfo, error)
+	ListRevisionComments(changeID, revID string) (map[string][]*gerrit.CommentInfo, error)
+	ListRevisionRobotComments(changeID, revID string) (map[string][]*gerrit.RobotCommentInfo, error)
+	ListRevisionDrafts(changeID, revID string) (map[string][]*gerrit.CommentInfo, error)
+	GetCommit(changeID, revID string) (*gerrit.CommitInfo, error)
+	ListFiles(changeID, revID string, opts ...gerrit.ListFilesOpt) (map[string]*gerrit.FileInfo, error)
+	ListReviewedFiles(changeID, revID string) ([]string, error)
+	GetDiff(changeID, revID, filePath string, opts ...gerrit.GetDiffOpt) (*gerrit.DiffInfo, error)
+	GetIncludedIn(changeID string) (*gerrit.IncludedInInfo, error)
+}
+
+// src is the source of code review data.
+var src reviewSource
+
+// A liveSource is a reviewSource reading from the Gerrit server.
+type liveSource struct {
+	*gerrit.Client
+}
+
+func (s liveSource) ChangeDetail(id int) (*gerrit.ChangeInfo, error) {
+	return getChangeDetail(id)
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// webURL returns the URL of change id in the Gerrit web interface:
+// the change itself if patch is 0, or else the diffs in patch set patch,
+// against base if base is the number of another patch set.
+// The web interface cannot show diffs against arbitrary commits,
+// so a base commit ID is ignored.
+func webURL(id int, base string, patch int) string {
+	u := fmt.Sprintf("https://%s/c/%d", server, id)
+	if patch == 0 {
+		return u
+	}
+	if commitRE.MatchString(base) || base == "" {
+		return fmt.Sprintf("%s/%d", u, patch)
+	}
+	return fmt.Sprintf("%s/%s..%d", u, base, patch)
+}
+
+// openBrowser opens url in a web browser, using the command in $BROWSER
+// if it is set, or else the usual command for opening URLs on this system.
+// It does not wait for the browser to exit.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	if b := os.Getenv("BROWSER"); b != "" {
+		// $BROWSER may include arguments, as in "firefox --new-tab".
+		f := strings.Fields(b)
+		cmd = exec.Command(f[0], append(f[1:], url)...)
+	} else {
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.Command("open", url)
+		case "windows":
+			// The empty argument is the title of the new window,
+			// so that start does not take the URL to be the title.
+			cmd = exec.Command("cmd", "/c", "start", "", url)
+		default:
+			cmd = exec.Command("xdg-open", url)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -30,6 +30,7 @@ const (
 	opUpload
 	opMerge
 	opAbandon
+	opRestore
 )
 
 type clState struct {
@@ -41,9 +42,8 @@ type clState struct {
 	hardCloseTime string
 }
 
-func dashActions(host string) ([]action, int) {
-	var actions []action
-	var maxCL int64
+// readHistory calls f for each History row for host, in insertion order.
+func readHistory(host string, f func(History)) {
 	var last int64
 	for {
 		var all []History
@@ -54,26 +54,36 @@ func dashActions(host string) ([]action, int) {
 			break
 		}
 		for _, h := range all {
-			if maxCL < h.Number {
-				maxCL = h.Number
-			}
-			switch h.Action {
-			case "create":
-				actions = append(actions, action{h.Time, opCreate, int(h.Number), h.Who})
-			case "upload":
-				actions = append(actions, action{h.Time, opUpload, int(h.Number), h.Text})
-			case "comment":
-				actions = append(actions, action{h.Time, opComment, int(h.Number), h.Text})
-			case "reply":
-				actions = append(actions, action{h.Time, opReply, int(h.Number), h.Text})
-			case "merge":
-				actions = append(actions, action{h.Time, opMerge, int(h.Number), h.Text})
-			case "abandon":
-				actions = append(actions, action{h.Time, opAbandon, int(h.Number), h.Text})
-			}
+			f(h)
 			last = h.RowID
 		}
 	}
+}
+
+func dashActions(host string) ([]action, int) {
+	var actions []action
+	var maxCL int64
+	readHistory(host, func(h History) {
+		if maxCL < h.Number {
+			maxCL = h.Number
+		}
+		switch h.Action {
+		case "create":
+			actions = append(actions, action{h.Time, opCreate, int(h.Number), h.Who})
+		case "upload":
+			actions = append(actions, action{h.Time, opUpload, int(h.Number), h.Text})
+		case "comment":
+			actions = append(actions, action{h.Time, opComment, int(h.Number), h.Text})
+		case "reply":
+			actions = append(actions, action{h.Time, opReply, int(h.Number), h.Text})
+		case "merge":
+			actions = append(actions, action{h.Time, opMerge, int(h.Number), h.Text})
+		case "abandon":
+			actions = append(actions, action{h.Time, opAbandon, int(h.Number), h.Text})
+		case "restore":
+			actions = append(actions, action{h.Time, opRestore, int(h.Number), h.Text})
+		}
+	})
 	sort.Stable(actionsByTime(actions))
 	return actions, int(maxCL)
 }
@@ -134,6 +144,8 @@ func plot(actions []action, maxCL int, emit func([]clState, string)) {
 			}
 		case opMerge, opAbandon:
 			s.hardCloseTime = a.time
+		case opRestore:
+			s.hardCloseTime = ""
 		}
 	}
 	if lastTime != "" {
@@ -141,42 +153,78 @@ func plot(actions []action, maxCL int, emit func([]clState, string)) {
 	}
 }
 
-const dashMinDate = "12016-04-01"
+// dashMinDate is the default start date for the dashboard charts.
+const dashMinDate = "2016-04-01"
 
-func dash(host, minDate string) {
+// dashAges is the default list of age buckets for the dashboard, in days.
+const dashAges = "365,180,90,60,30,14,7,1"
+
+// dash prints the dashboard chart data for host, covering the time
+// from minDate (YYYY-MM-DD) until now. The age chart counts the open
+// changes older than each of the ages, a comma-separated list of days.
+func dash(host, minDate, ages string) {
+	if _, err := time.Parse("2006-01-02", minDate); err != nil {
+		log.Fatalf("invalid dash start date %q: want YYYY-MM-DD", minDate)
+	}
+	cutoffs, err := parseAges(ages)
+	if err != nil {
+		log.Fatal(err)
+	}
 	actions, maxCL := dashActions(host)
-	plotAge(actions, maxCL, minDate)
-	plotActivity(host)
+	plotAge(actions, maxCL, minDate, cutoffs)
+	plotActivity(host, minDate)
 }
 
-func plotAge(actions []action, maxCL int, minDate string) {
-	const day = 24 * time.Hour
-	var cutoffs = [...]time.Duration{
-		365 * day,
-		180 * day,
-		90 * day,
-		60 * day,
-		30 * day,
-		14 * day,
-		7 * day,
-		1 * day,
-		0,
+// parseAges parses a comma-separated list of ages in days,
+// returning the corresponding durations, longest first,
+// followed by a final 0 for the bucket holding all changes.
+func parseAges(ages string) ([]time.Duration, error) {
+	var days []int
+	for _, f := range strings.Split(ages, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid age %q: want positive number of days", f)
+		}
+		days = append(days, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	var cutoffs []time.Duration
+	for _, n := range days {
+		cutoffs = append(cutoffs, time.Duration(n)*24*time.Hour)
 	}
+	return append(cutoffs, 0), nil
+}
+
+func plotAge(actions []action, maxCL int, minDate string, cutoffs []time.Duration) {
 	var buf bytes.Buffer
 
 	fmt.Fprintf(&buf, "var clAgeData = [\n")
-	fmt.Fprintf(&buf, "  ['Date', '\\u2265 365d', '\\u2265 180d', '\\u2265 90d', '\\u2265 60d', '\\u2265 30d', '\\u2265 14d', '\\u2265 7d', '\\u2265 1d', 'all']\n")
+	fmt.Fprintf(&buf, "  ['Date'")
+	for _, d := range cutoffs {
+		if d == 0 {
+			fmt.Fprintf(&buf, ", 'all'")
+		} else {
+			fmt.Fprintf(&buf, ", '\\u2265 %dd'", d/(24*time.Hour))
+		}
+	}
+	fmt.Fprintf(&buf, "]\n")
 
 	plot(actions, maxCL, func(cls []clState, tm string) {
+		if tm < minDate {
+			return
+		}
 		now, err := time.Parse(time.RFC3339[:10], tm)
 		if err != nil {
 			log.Fatal(err)
 		}
-		var counts [len(cutoffs)]int
+		counts := make([]int, len(cutoffs))
 		for clnum, cl := range cls {
 			if cl.createTime == "" || cl.closeTime != "" || cl.hardCloseTime != "" {
 				continue
 			}
+			if cl.createTime < minDate {
+				continue
+			}
 			t, err := time.Parse(time.RFC3339, cl.createTime)
 			if err != nil {
 				log.Fatal(err)
@@ -184,8 +232,8 @@ func plotAge(actions []action, maxCL int, minDate string) {
 			dt := now.Sub(t)
 			for i, d := range cutoffs {
 				if dt >= d {
-					if i == 0 {
-						println("OLD", clnum)
+					if i == 0 && *verbose {
+						log.Printf("%s: CL %d is in the oldest age bucket", tm, clnum)
 					}
 					counts[i]++
 				}
@@ -201,8 +249,8 @@ func plotAge(actions []action, maxCL int, minDate string) {
 	os.Stdout.Write(buf.Bytes())
 }
 
-func plotActivity(host string) {
-	rows, err := db.Query("select Who, count(*) from History where Time >= '2016-04-05' and Host = ? group by Who", host)
+func plotActivity(host, minDate string) {
+	rows, err := db.Query("select Who, count(*) from History where Time >= ? and Host = ? group by Who", minDate, host)
 	if err != nil {
 		log.Fatalf("sql activity: %v", err)
 	}
@@ -211,7 +259,7 @@ func plotActivity(host string) {
 		var who string
 		var count int
 		if err := rows.Scan(&who, &count); err != nil {
-			log.Fatal("sql scan counts: %v", err)
+			log.Fatalf("sql scan counts: %v", err)
 		}
 		totalWho[who] += count
 	}
@@ -232,9 +280,9 @@ func plotActivity(host string) {
 	if len(allWho) > 40 {
 		allWho = allWho[:40]
 	}
-	plotActivityCounts(host, "GerritActivityData", "", allWho)
-	for _, action := range []string{"abandon", "comment", "create", "merge", "reply", "upload"} {
-		plotActivityCounts(host, "GerritActivityData_"+action, " and Action = '"+action+"'", allWho)
+	plotActivityCounts(host, minDate, "GerritActivityData", "", allWho)
+	for _, action := range []string{"abandon", "comment", "create", "merge", "reply", "restore", "upload"} {
+		plotActivityCounts(host, minDate, "GerritActivityData_"+action, " and Action = '"+action+"'", allWho)
 	}
 }
 
@@ -243,8 +291,8 @@ type weekActivity struct {
 	count map[string]int
 }
 
-func plotActivityCounts(host, name, cond string, allWho []string) {
-	rows, err := db.Query("select strftime('%Y-%W', Time) as Week, Who, count(*) as N from History where Time >= '2016-08-01' and Host = ? "+cond+" group by Week, Who order by Week, Who", host)
+func plotActivityCounts(host, minDate, name, cond string, allWho []string) {
+	rows, err := db.Query("select strftime('%Y-%W', Time) as Week, Who, count(*) as N from History where Time >= ? and Host = ? "+cond+" group by Week, Who order by Week, Who", minDate, host)
 	if err != nil {
 		log.Fatalf("sql activity counts: %v", err)
 	}
@@ -0,0 +1,69 @@
+// Copyright 2016 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// export writes the History rows for host with times at or after minDate
+// to standard output, in time order, as CSV or, if -json is given,
+// as newline-delimited JSON.
+// It orders the rows the same way dash does:
+// by time, and by insertion order for equal times.
+func export(host, minDate string) {
+	// Sort with actionsByTime, as dash does, using number
+	// to hold each row's index in rows.
+	var rows []History
+	var order []action
+	readHistory(host, func(h History) {
+		if h.Time >= minDate {
+			order = append(order, action{time: h.Time, number: len(rows)})
+			rows = append(rows, h)
+		}
+	})
+	sort.Stable(actionsByTime(order))
+	hist := make([]History, len(order))
+	for i, a := range order {
+		hist[i] = rows[a.number]
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if *jsonOut {
+		enc := json.NewEncoder(w)
+		for _, h := range hist {
+			row := struct {
+				Host   string
+				Number int64
+				Time   string
+				Who    string
+				Action string
+				Text   string
+			}{h.Host, h.Number, h.Time, h.Who, h.Action, h.Text}
+			if err := enc.Encode(&row); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Host", "Number", "Time", "Who", "Action", "Text"})
+		for _, h := range hist {
+			cw.Write([]string{h.Host, strconv.FormatInt(h.Number, 10), h.Time, h.Who, h.Action, h.Text})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("writing output: %v", err)
+	}
+}
@@ -2,32 +2,27 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// TODO: http 429 means slow down
-
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/build/gerrit"
 
 	"rsc.io/dbstore"
+	gerritclient "rsc.io/gerrit/internal/gerrit"
 	_ "rsc.io/sqlite"
 )
 
-// TODO: pragma journal_mode=WAL
-
 // Database tables. DO NOT CHANGE.
 
 type ProjectSync struct {
@@ -57,20 +52,35 @@ type History struct {
 
 var (
 	file    = flag.String("f", os.Getenv("HOME")+"/gerritreview.db", "database `file` to use")
+	jsonOut = flag.Bool("json", false, "print query and export results as JSON")
+	ages    = flag.String("ages", dashAges, "dash age buckets, a comma-separated list of `days`")
+	verbose = flag.Bool("v", false, "log server requests and progress")
+	jobs    = flag.Int("j", 8, "fetch comments for up to `n` changes at once during sync")
 	storage = new(dbstore.Storage)
 	db      *sql.DB
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, `usage: reviewdb [-f db] command [args]
+	fmt.Fprintf(os.Stderr, `usage: reviewdb [-f db] [-j n] [-json] [-v] command [args]
 
 Commands are:
 
 	init (initialize new database)
 	add <host> (add new repository)
 	sync (sync repositories)
+	refill [-all] [host] (update history for changes synced since last refill;
+		-all rebuilds the history for every change)
+	query [predicates...] (print matching changes from the database;
+		predicates are host:, owner:, project:, status:, after:, before:)
+	export [host [YYYY-MM-DD]] (print history since the date as CSV,
+		or as newline-delimited JSON with -json)
+	dash [host [YYYY-MM-DD]] (print dashboard chart data since the date,
+		with -ages setting the age buckets)
 
 The default database is $HOME/gerritreview.db.
+
+Sync uses the credentials for each host stored in Git's
+http.cookiefile (usually $HOME/.gitcookies) or in $HOME/.netrc.
 `)
 	os.Exit(2)
 }
@@ -89,6 +99,9 @@ func main() {
 	if len(args) == 0 {
 		usage()
 	}
+	if *jobs < 1 {
+		log.Fatalf("invalid -j %d: must be at least 1", *jobs)
+	}
 
 	if args[0] == "init" {
 		if len(args) != 1 {
@@ -104,11 +117,7 @@ func main() {
 			log.Fatalf("creating database: %v", err)
 		}
 		defer db.Close()
-		rows, err := db.Query("pragma journal_mode=wal")
-		if err != nil {
-			log.Fatal(err)
-		}
-		rows.Close()
+		setWAL(db)
 		if err := storage.CreateTables(db); err != nil {
 			log.Fatalf("initializing database: %v", err)
 		}
@@ -126,6 +135,7 @@ func main() {
 	defer db.Close()
 
 	db.Exec("pragma busy_timeout = 1000")
+	setWAL(db)
 
 	// TODO: Remove or deal with better.
 	// This is here so that if we add new tables they get created in old databases.
@@ -157,16 +167,42 @@ func main() {
 		if err := storage.Select(db, &projects, ""); err != nil {
 			log.Fatalf("reading projects: %v", err)
 		}
+		failed := false
 		for _, proj := range projects {
-			doSync(&proj)
+			if err := doSync(&proj); err != nil {
+				log.Printf("syncing %s: %v", proj.Host, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
 		}
 
 	case "refill":
+		full := false
+		if len(args) > 1 && args[1] == "-all" {
+			full = true
+			args = args[1:]
+		}
 		host := "go-review.googlesource.com"
 		if len(args) > 1 {
 			host = args[1]
 		}
-		refill(host)
+		refill(host, full)
+
+	case "query":
+		query(args[1:])
+
+	case "export":
+		host := "go-review.googlesource.com"
+		if len(args) > 1 {
+			host = args[1]
+		}
+		minDate := ""
+		if len(args) > 2 {
+			minDate = args[2]
+		}
+		export(host, minDate)
 
 	case "dash":
 		host := "go-review.googlesource.com"
@@ -177,24 +213,124 @@ func main() {
 		if len(args) > 2 {
 			minDate = args[2]
 		}
-		dash(host, minDate)
+		dash(host, minDate, *ages)
+	}
+}
+
+// setWAL puts db into write-ahead logging mode,
+// so that readers, such as review -db, do not block a running sync
+// and vice versa. If the driver refuses, setWAL logs a warning
+// and leaves db in its current journal mode.
+func setWAL(db *sql.DB) {
+	var mode string
+	if err := db.QueryRow("pragma journal_mode=wal").Scan(&mode); err != nil {
+		log.Printf("warning: setting journal_mode=wal: %v", err)
+		return
+	}
+	if !strings.EqualFold(mode, "wal") {
+		log.Printf("warning: setting journal_mode=wal: database is still in %s mode", mode)
 	}
 }
 
-func doSync(proj *ProjectSync) {
-	syncChangeInfo(proj)
-	syncComments(proj)
+// doSync brings the database copy of proj up to date.
+// It builds a single client for proj and uses it for every request,
+// so that the host's credentials are looked up only once per sync.
+func doSync(proj *ProjectSync) error {
+	c := newClient(proj)
+	if err := syncChangeInfo(proj, c); err != nil {
+		return err
+	}
+	return syncComments(proj, c)
 }
 
-func syncChangeInfo(proj *ProjectSync) {
-	query := "after:1970-01-01"
+// newClient returns a new Gerrit client for proj's server,
+// using the credentials stored for the host (see gerritclient.HostAuth).
+// The ProjectSync table cannot record a separate authentication host,
+// so the credentials are always those for proj.Host.
+// HostAuth runs git config and reads the cookie and netrc files,
+// so callers should build one client per sync, not one per request.
+func newClient(proj *ProjectSync) *gerritclient.Client {
+	c := gerritclient.NewClient("https://"+proj.Host, gerritclient.HostAuth(proj.Host))
+	if *verbose {
+		c.Logf = log.Printf
+	}
+	return c
+}
+
+// progress logs, if -v was given, that done of total items
+// have been processed. A negative total means the total is unknown.
+func progress(what string, done, total int) {
+	if !*verbose {
+		return
+	}
+	if total < 0 {
+		log.Printf("%s: %d", what, done)
+		return
+	}
+	log.Printf("%s: %d/%d", what, done, total)
+}
+
+// gerritTime is the layout of Gerrit timestamps, as stored in ProjectSync.Date.
+const gerritTime = "2006-01-02 15:04:05.999999999"
+
+// syncChangeInfo fetches the changes updated since proj.Date.
+//
+// Gerrit returns query results newest first, so a single query
+// cannot be saved part way through: the changes not yet fetched
+// are the oldest ones, and recording the newest time seen would
+// skip them. Instead, syncChangeInfo walks forward through time
+// in windows, committing each window's changes together with
+// the advanced proj.Date, so that an interrupted sync resumes
+// at the start of the window it was working on.
+// Windows grow while they are empty and shrink when they
+// hold more than one page of results.
+func syncChangeInfo(proj *ProjectSync, c *gerritclient.Client) error {
+	lo := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 	if proj.Date != "" {
-		query = `after:"` + proj.Date + `"`
+		t, err := time.Parse(gerritTime, proj.Date)
+		if err != nil {
+			return fmt.Errorf("invalid sync date %q: %v", proj.Date, err)
+		}
+		lo = t
+	}
+
+	window := 24 * time.Hour
+	for {
+		hi := lo.Add(window)
+		last := !hi.Before(time.Now())
+		query := `after:"` + lo.Format(gerritTime) + `"`
+		if !last {
+			query += ` before:"` + hi.Format(gerritTime) + `"`
+		}
+		n, pages, err := syncChangeWindow(proj, c, query, hi, last)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		lo = hi
+		switch {
+		case n == 0:
+			window *= 2
+		case pages > 1 && window > time.Minute:
+			window /= 2
+		}
 	}
+}
 
+// syncChangeWindow fetches the changes matching query,
+// stores them, and advances proj.Date, all in one transaction.
+// If last is false, the query covers the time up to hi,
+// and proj.Date advances to hi. If last is true, the query
+// is open-ended, and proj.Date advances to the newest update seen.
+// It returns the number of changes and pages fetched.
+// If syncChangeWindow returns an error, the transaction is rolled back,
+// leaving both the stored changes and proj.Date as they were.
+func syncChangeWindow(proj *ProjectSync, c *gerritclient.Client, query string, hi time.Time, last bool) (n, pages int, err error) {
 	tx, err := db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, err
 	}
 	defer tx.Rollback()
 
@@ -215,36 +351,20 @@ func syncChangeInfo(proj *ProjectSync) {
 			"start": {fmt.Sprint(start)},
 		}
 
-	Again:
-		urlStr := "https://" + proj.Host + "/changes/?" + values.Encode()
-		resp, err := http.Get(urlStr)
-		println("URL:", urlStr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		resp.Body.Close()
-		if resp.StatusCode == 429 {
-			time.Sleep(1 * time.Minute)
-			goto Again
-		}
-		if resp.StatusCode != 200 {
-			log.Fatalf("%s\n%s", resp.Status, data)
-		}
-		i := bytes.IndexByte(data, '\n')
-		if i < 0 {
-			log.Fatalf("json too short: %s", data)
-		}
-		data = data[i:]
-
 		var all []json.RawMessage
-		if err := json.Unmarshal(data, &all); err != nil {
-			log.Fatalf("parsing body: %v", err)
+		for {
+			err := c.GetJSON(&all, "/changes/", values)
+			if gerritclient.IsTooManyRequests(err) {
+				log.Printf("%s: server busy; waiting", proj.Host)
+				time.Sleep(1 * time.Minute)
+				continue
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			break
 		}
-		println("GOT", len(all), "messages")
+		pages++
 
 		var more bool
 		for _, m := range all {
@@ -255,15 +375,14 @@ func syncChangeInfo(proj *ProjectSync) {
 				Updated string `json:"updated"`
 			}
 			if err := json.Unmarshal(m, &meta); err != nil {
-				log.Fatalf("parsing entry: %v\n%s", err, m)
+				return 0, 0, fmt.Errorf("parsing entry: %v\n%s", err, m)
 			}
 			if meta.ID == "" || meta.Number == 0 {
-				log.Fatalf("parsing entry: missing ID or change number:\n%s", m)
+				return 0, 0, fmt.Errorf("parsing entry: missing ID or change number:\n%s", m)
 			}
 			if recent < meta.Updated {
 				recent = meta.Updated
 			}
-			println("META:", meta.Number, meta.ID, meta.Updated, meta.More)
 			more = meta.More
 			var raw RawJSON
 			raw.Host = proj.Host
@@ -273,98 +392,151 @@ func syncChangeInfo(proj *ProjectSync) {
 			raw.NeedComments = true
 			raw.NeedIndex = true
 			if err := storage.Insert(tx, &raw); err != nil {
-				log.Fatal(err)
+				return 0, 0, err
 			}
 		}
+		n += len(all)
 		start += len(all)
+		progress(proj.Host+": changes since "+query, n, -1)
 		if !more {
 			break
 		}
 	}
-	if recent != "" {
-		proj.Date = recent
+
+	// Advance the cursor, never moving it backward.
+	date := recent
+	if !last {
+		date = hi.Format(gerritTime)
+	}
+	if date != "" && date > proj.Date {
+		proj.Date = date
 		if err := storage.Write(tx, proj, "Date"); err != nil {
-			log.Fatal(err)
+			return 0, 0, err
 		}
 	}
 	if err := tx.Commit(); err != nil {
-		log.Fatal(err)
+		return 0, 0, err
 	}
+	return n, pages, nil
 }
 
-func syncComments(proj *ProjectSync) {
+// syncComments fetches the comments for the changes marked as needing them.
+// Each change's comments are stored as they arrive,
+// so an error loses only the work still in progress.
+func syncComments(proj *ProjectSync, c *gerritclient.Client) error {
 	rows, err := db.Query("select Number from RawJSON where Host == ? and NeedComments == ?", proj.Host, true)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	var numbers []int64
 	for rows.Next() {
 		var x int64
 		if err := rows.Scan(&x); err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return err
 		}
 		numbers = append(numbers, x)
 	}
 	err = rows.Err()
+	rows.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	rows.Close()
 
-	for _, x := range numbers {
-		syncComment(proj, x)
-	}
+	return fetchAllComments(c, proj, numbers, *jobs, func(raw *RawJSON) error {
+		return storage.Write(db, raw, "Comments", "NeedComments")
+	})
 }
 
-func syncComment(proj *ProjectSync, number int64) {
-	urlStr := "https://" + proj.Host + "/changes/" + fmt.Sprint(number) + "/comments"
-Again:
-	resp, err := http.Get(urlStr)
-	println("URL:", urlStr)
-	if err != nil {
-		log.Fatalf("fetching %s: %v", urlStr, err)
+// fetchAllComments fetches the comments for the given change numbers
+// using up to jobs workers and calls store with each result.
+// The workers only talk to the server; store is called
+// from fetchAllComments's goroutine, one result at a time.
+// After an error, fetchAllComments stops handing out work,
+// waits for the requests already in flight to finish,
+// and returns the first error.
+func fetchAllComments(c *gerritclient.Client, proj *ProjectSync, numbers []int64, jobs int, store func(*RawJSON) error) error {
+	type result struct {
+		raw *RawJSON
+		err error
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("reading %s: %v", urlStr, err)
-	}
-	resp.Body.Close()
-	if resp.StatusCode == 429 {
-		println("SLEEP for", urlStr, time.Now().Format(time.Stamp))
-		time.Sleep(1 * time.Minute)
-		goto Again
+	work := make(chan int64)
+	results := make(chan result)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for x := range work {
+				raw, err := fetchComments(c, proj, x)
+				results <- result{raw, err}
+			}
+		}()
 	}
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 404 {
-			var raw RawJSON
-			raw.Host = proj.Host
-			raw.Number = number
-			raw.NeedComments = false
-			if err := storage.Write(db, &raw, "Comments", "NeedComments"); err != nil {
-				log.Fatal(err)
+	go func() {
+		defer close(work)
+		for _, x := range numbers {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			select {
+			case work <- x:
+			case <-done:
+				return
 			}
-			return
 		}
-		log.Fatalf("fetching %s: %s\n%s", urlStr, resp.Status, data)
-	}
-	i := bytes.IndexByte(data, '\n')
-	if i < 0 {
-		log.Fatalf("json too short: %s", data)
-	}
-	data = data[i:]
-
-	var js json.RawMessage
-	if err := json.Unmarshal(data, &js); err != nil {
-		log.Fatalf("parsing body: %v", err)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	n := 0
+	for r := range results {
+		n++
+		progress(proj.Host+": comments", n, len(numbers))
+		if firstErr != nil {
+			continue
+		}
+		err := r.err
+		if err == nil {
+			err = store(r.raw)
+		}
+		if err != nil {
+			firstErr = err
+			close(done)
+		}
 	}
+	return firstErr
+}
 
-	var raw RawJSON
-	raw.Host = proj.Host
-	raw.Number = number
-	raw.NeedComments = false
-	raw.Comments = js
-	if err := storage.Write(db, &raw, "Comments", "NeedComments"); err != nil {
-		log.Fatal(err)
+// fetchComments fetches the comments for the given change number
+// and returns the RawJSON update recording them.
+// If the server is busy, fetchComments waits and tries again.
+func fetchComments(c *gerritclient.Client, proj *ProjectSync, number int64) (*RawJSON, error) {
+	raw := &RawJSON{Host: proj.Host, Number: number}
+	path := "/changes/" + fmt.Sprint(number) + "/comments"
+	for {
+		var js json.RawMessage
+		err := c.GetJSON(&js, path, nil)
+		if gerritclient.IsTooManyRequests(err) {
+			log.Printf("%s%s: server busy; waiting", proj.Host, path)
+			time.Sleep(1 * time.Minute)
+			continue
+		}
+		if gerritclient.IsNotFound(err) {
+			// Change is gone; stop asking.
+			return raw, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", path, err)
+		}
+		raw.Comments = js
+		return raw, nil
 	}
 }
 
@@ -376,12 +548,18 @@ func js(x interface{}) string {
 	return string(data)
 }
 
-func refill(host string) {
-	if _, err := db.Exec("delete from History where Host = ?", host); err != nil {
-		log.Fatal(err)
-	}
-	if _, err := db.Exec("update RawJSON set NeedIndex = ? where Host = ?", true, host); err != nil {
-		log.Fatal(err)
+// refill updates the History table for host.
+// Sync marks each change it stores as needing indexing (RawJSON.NeedIndex),
+// and refill reprocesses only those changes, replacing their History rows.
+// If full is true, refill instead rebuilds the History for every change.
+func refill(host string, full bool) {
+	if full {
+		if _, err := db.Exec("delete from History where Host = ?", host); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := db.Exec("update RawJSON set NeedIndex = ? where Host = ?", true, host); err != nil {
+			log.Fatal(err)
+		}
 	}
 	for {
 		var all []RawJSON
@@ -391,12 +569,16 @@ func refill(host string) {
 		if len(all) == 0 {
 			break
 		}
-		println("GOT", len(all), all[0].Number, all[len(all)-1].Number)
+		progress(fmt.Sprintf("%s: refill changes %d-%d", host, all[0].Number, all[len(all)-1].Number), len(all), -1)
 		tx, err := db.Begin()
 		if err != nil {
 			log.Fatal(err)
 		}
 		for _, m := range all {
+			// Discard the history derived from an older copy of the change.
+			if _, err := tx.Exec("delete from History where Host = ? and Number = ?", m.Host, m.Number); err != nil {
+				log.Fatal(err)
+			}
 			var ch gerrit.ChangeInfo
 			if err := json.Unmarshal(m.ChangeInfo, &ch); err != nil {
 				log.Printf("unmarshal: %v\n%s", err, m.ChangeInfo)
@@ -425,8 +607,10 @@ func refill(host string) {
 			}
 			h.RowID = 0
 			hstart := h
-			sawAbandon := false
-			for _, m := range ch.Messages {
+			tags := messageTags(m.ChangeInfo)
+			abandoned := false
+			lastRev := 0
+			for i, m := range ch.Messages {
 				h.Time = m.Time.Time().UTC().Format(time.RFC3339)
 				if m.Author == nil {
 					h.Who = "Gerrit"
@@ -434,27 +618,33 @@ func refill(host string) {
 					h.Who = m.Author.Email
 				}
 				h.Text = m.Message
-				if strings.HasPrefix(h.Text, "Uploaded") || strings.HasSuffix(h.Text, ": Commit message was updated.") {
-					h.Action = "upload"
+				tag := ""
+				if i < len(tags) {
+					tag = tags[i]
+				}
+				h.Action = classifyMessage(&ch, &m, tag, lastRev)
+				if h.Action == "upload" {
 					for _, rev := range ch.Revisions {
 						if rev.PatchSetNumber == m.RevisionNumber {
 							h.Text += "\n" + rev.Commit.Message
 						}
 					}
-				} else if h.Who == ch.Owner.Email {
-					h.Action = "reply"
-				} else {
-					h.Action = "comment"
+				}
+				if lastRev < m.RevisionNumber {
+					lastRev = m.RevisionNumber
+				}
+				switch h.Action {
+				case "abandon":
+					abandoned = true
+				case "restore":
+					abandoned = false
 				}
 				if err := storage.Insert(tx, &h); err != nil {
 					log.Fatal(err)
 				}
-				if strings.HasPrefix(h.Text, "Abandoned") {
-					sawAbandon = true
-				}
 				h.RowID = 0
 			}
-			if ch.Status == "ABANDONED" && !sawAbandon {
+			if ch.Status == "ABANDONED" && !abandoned {
 				h = hstart
 				h.Action = "abandon"
 				h.Text = ""
@@ -486,3 +676,64 @@ func refill(host string) {
 		}
 	}
 }
+
+// messageTags returns the tags of the messages in the JSON-encoded
+// ChangeInfo data, in message order. Gerrit tags the messages it
+// generates itself, such as "autogenerated:gerrit:newPatchSet".
+// The ChangeInfo type in golang.org/x/build/gerrit omits the tags,
+// so messageTags decodes them separately.
+func messageTags(data []byte) []string {
+	var ch struct {
+		Messages []struct {
+			Tag string `json:"tag"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(data, &ch)
+	var tags []string
+	for _, m := range ch.Messages {
+		tags = append(tags, m.Tag)
+	}
+	return tags
+}
+
+// classifyMessage returns the History action for the message m on ch:
+// "upload", "abandon", "restore", "reply" (by the owner), or "comment".
+// Tag is the message's tag, and lastRev is the highest patch set
+// number of the messages before m.
+//
+// The classification uses structured signals where possible:
+// Gerrit's message tags, and then a message for a patch set
+// newer than any before it, which must be announcing its upload.
+// Only old messages without those signals fall back to matching
+// Gerrit's English message text.
+func classifyMessage(ch *gerrit.ChangeInfo, m *gerrit.ChangeMessageInfo, tag string, lastRev int) string {
+	switch tag {
+	case "autogenerated:gerrit:newPatchSet", "autogenerated:gerrit:newWipPatchSet":
+		return "upload"
+	case "autogenerated:gerrit:abandon":
+		return "abandon"
+	case "autogenerated:gerrit:restore":
+		return "restore"
+	case "autogenerated:gerrit:merged":
+		// Submitting can create a new patch set, but the merge
+		// itself is recorded from the change status.
+		return "comment"
+	}
+	if m.RevisionNumber > lastRev {
+		return "upload"
+	}
+	if tag == "" {
+		switch {
+		case strings.HasPrefix(m.Message, "Uploaded") || strings.HasSuffix(m.Message, ": Commit message was updated."):
+			return "upload"
+		case strings.HasPrefix(m.Message, "Abandoned"):
+			return "abandon"
+		case strings.HasPrefix(m.Message, "Restored"):
+			return "restore"
+		}
+	}
+	if m.Author != nil && ch.Owner != nil && m.Author.Email == ch.Owner.Email {
+		return "reply"
+	}
+	return "comment"
+}
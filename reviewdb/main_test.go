@@ -0,0 +1,314 @@
+// Copyright 2016 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gerritclient "rsc.io/gerrit/internal/gerrit"
+)
+
+func TestFetchAllCommentsLimit(t *testing.T) {
+	const jobs = 4
+	var (
+		mu       sync.Mutex
+		inflight int
+		peak     int
+		full     = make(chan bool)
+		fill     sync.Once
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		if inflight == jobs {
+			fill.Do(func() { close(full) })
+		}
+		mu.Unlock()
+
+		// Hold each request until the pool is full and then a little longer,
+		// so that any extra worker would show up in inflight.
+		select {
+		case <-full:
+		case <-time.After(5 * time.Second):
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		fmt.Fprintf(w, ")]}'\n{%q: []}\n", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	c := gerritclient.NewClient(srv.URL, gerritclient.NoAuth)
+	proj := &ProjectSync{Host: "gerrit.test"}
+	var numbers []int64
+	for i := int64(1); i <= 20; i++ {
+		numbers = append(numbers, i)
+	}
+	var stored []int
+	err := fetchAllComments(c, proj, numbers, jobs, func(raw *RawJSON) error {
+		want := fmt.Sprintf("{%q: []}", fmt.Sprintf("/changes/%d/comments", raw.Number))
+		if string(raw.Comments) != want {
+			t.Errorf("change %d: comments %s, want %s", raw.Number, raw.Comments, want)
+		}
+		stored = append(stored, int(raw.Number))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peak != jobs {
+		t.Errorf("at most %d requests in flight, want %d", peak, jobs)
+	}
+	sort.Ints(stored)
+	if len(stored) != len(numbers) {
+		t.Fatalf("stored %d changes, want %d", len(stored), len(numbers))
+	}
+	for i, n := range stored {
+		if n != i+1 {
+			t.Fatalf("stored changes %v, want 1 through %d", stored, len(numbers))
+		}
+	}
+}
+
+var registerOnce sync.Once
+
+// useTestDB points db at a new, empty database for the duration of the test.
+func useTestDB(t *testing.T) {
+	registerOnce.Do(func() {
+		storage.Register(new(ProjectSync))
+		storage.Register(new(RawJSON))
+		storage.Register(new(History))
+	})
+	tdb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "review.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CreateTables(tdb); err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = tdb
+	t.Cleanup(func() {
+		db = old
+		tdb.Close()
+	})
+}
+
+// A fakeGerrit is a fake Gerrit server holding changes
+// that were last updated at the given times.
+type fakeGerrit struct {
+	mu      sync.Mutex
+	updated map[int64]time.Time
+	queries []string               // q parameters of change queries, in order
+	fail    func(path string) bool // reports whether to fail a request
+}
+
+// gerritStampLayout is the layout of the timestamps Gerrit sends.
+const gerritStampLayout = "2006-01-02 15:04:05.000000000"
+
+var afterBeforeRE = regexp.MustCompile(`^after:"([^"]+)"(?: before:"([^"]+)")?$`)
+
+func (g *fakeGerrit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.fail != nil && g.fail(r.URL.Path) {
+		http.Error(w, "interrupted", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Path != "/changes/" {
+		// Comments on a change.
+		fmt.Fprintf(w, ")]}'\n{}\n")
+		return
+	}
+
+	q := r.FormValue("q")
+	g.queries = append(g.queries, q)
+	m := afterBeforeRE.FindStringSubmatch(q)
+	if m == nil {
+		http.Error(w, "bad query "+q, http.StatusBadRequest)
+		return
+	}
+	after, _ := time.Parse(gerritTime, m[1])
+	before, _ := time.Parse(gerritTime, m[2])
+	type change struct {
+		ID      string `json:"id"`
+		Number  int64  `json:"_number"`
+		Updated string `json:"updated"`
+	}
+	list := []change{}
+	for n, t := range g.updated {
+		if !t.Before(after) && (m[2] == "" || t.Before(before)) {
+			list = append(list, change{fmt.Sprintf("p~master~I%d", n), n, t.Format(gerritStampLayout)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Updated > list[j].Updated })
+	js, _ := json.Marshal(list)
+	fmt.Fprintf(w, ")]}'\n%s\n", js)
+}
+
+// readTestDB returns the sync date stored for host
+// and the stored changes, in order by number.
+func readTestDB(t *testing.T, host string) (string, []RawJSON) {
+	proj := ProjectSync{Host: host}
+	if err := storage.Read(db, &proj); err != nil {
+		t.Fatal(err)
+	}
+	var raws []RawJSON
+	if err := storage.Select(db, &raws, "where Host = ? order by Number", host); err != nil {
+		t.Fatal(err)
+	}
+	return proj.Date, raws
+}
+
+// storedNumbers returns the numbers of the changes in raws
+// for which need(raw) is true, formatted as a string like "1 2 3".
+func storedNumbers(raws []RawJSON, need func(RawJSON) bool) string {
+	var list []string
+	for _, raw := range raws {
+		if need(raw) {
+			list = append(list, strconv.FormatInt(raw.Number, 10))
+		}
+	}
+	return strings.Join(list, " ")
+}
+
+func TestSyncResume(t *testing.T) {
+	useTestDB(t)
+
+	const day = 24 * time.Hour
+	start := time.Now().UTC().Add(-10 * day).Truncate(time.Hour)
+	g := &fakeGerrit{updated: map[int64]time.Time{
+		1: start.Add(1 * time.Hour),
+		2: start.Add(3 * day),
+		3: start.Add(6 * day),
+		4: start.Add(9 * day),
+	}}
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+	c := gerritclient.NewClient(srv.URL, gerritclient.NoAuth)
+
+	const host = "gerrit.test"
+	if err := storage.Insert(db, &ProjectSync{Host: host, Date: start.Format(gerritTime)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// run is doSync, but using c.
+	run := func() error {
+		var proj ProjectSync
+		proj.Host = host
+		if err := storage.Read(db, &proj); err != nil {
+			t.Fatal(err)
+		}
+		if err := syncChangeInfo(&proj, c); err != nil {
+			return err
+		}
+		return syncComments(&proj, c)
+	}
+	all := func(RawJSON) bool { return true }
+	needComments := func(raw RawJSON) bool { return raw.NeedComments }
+
+	// Interrupt the sync in the third window, [start+2d, start+4d).
+	// The first window, holding change 1, has been saved,
+	// and the cursor records that the second, empty window is done too.
+	g.fail = func(path string) bool { return path == "/changes/" && len(g.queries) == 2 }
+	if err := run(); err == nil {
+		t.Fatal("interrupted sync succeeded")
+	}
+	date, raws := readTestDB(t, host)
+	if want := start.Add(2 * day).Format(gerritTime); date != want {
+		t.Errorf("after interrupted sync, date = %s, want %s", date, want)
+	}
+	if got := storedNumbers(raws, all); got != "1" {
+		t.Errorf("after interrupted sync, stored changes %s, want 1", got)
+	}
+
+	// Resume, and interrupt fetching the comments on change 3.
+	n := len(g.queries)
+	g.fail = func(path string) bool { return path == "/changes/3/comments" }
+	if err := run(); err == nil {
+		t.Fatal("interrupted comment sync succeeded")
+	}
+	if q, want := g.queries[n], `after:"`+start.Add(2*day).Format(gerritTime)+`"`; !strings.HasPrefix(q, want) {
+		t.Errorf("resumed sync queried %s, want %s...", q, want)
+	}
+	// The last, open-ended window ran to completion,
+	// advancing the cursor to the newest update seen.
+	date, raws = readTestDB(t, host)
+	if want := g.updated[4].Format(gerritStampLayout); date != want {
+		t.Errorf("after second sync, date = %s, want %s", date, want)
+	}
+	if got := storedNumbers(raws, all); got != "1 2 3 4" {
+		t.Errorf("after second sync, stored changes %s, want 1 2 3 4", got)
+	}
+	if got := storedNumbers(raws, needComments); !strings.Contains(got, "3") {
+		t.Errorf("after second sync, changes needing comments are %q, want 3 among them", got)
+	}
+
+	// Finish.
+	g.fail = nil
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	_, raws = readTestDB(t, host)
+	if got := storedNumbers(raws, all); got != "1 2 3 4" {
+		t.Errorf("after final sync, stored changes %s, want 1 2 3 4", got)
+	}
+	if got := storedNumbers(raws, needComments); got != "" {
+		t.Errorf("after final sync, changes %s still need comments", got)
+	}
+}
+
+func TestFetchAllCommentsStopsAfterError(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		if r.URL.Path == "/changes/1/comments" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		fmt.Fprintf(w, ")]}'\n{}\n")
+	}))
+	defer srv.Close()
+
+	c := gerritclient.NewClient(srv.URL, gerritclient.NoAuth)
+	proj := &ProjectSync{Host: "gerrit.test"}
+	var numbers []int64
+	for i := int64(1); i <= 100; i++ {
+		numbers = append(numbers, i)
+	}
+	err := fetchAllComments(c, proj, numbers, 2, func(*RawJSON) error { return nil })
+	if err == nil {
+		t.Fatal("fetchAllComments succeeded despite error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests > 10 {
+		t.Errorf("sent %d requests, want only those in flight when the first failed", requests)
+	}
+}
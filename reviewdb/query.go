@@ -0,0 +1,158 @@
+// Copyright 2016 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/build/gerrit"
+)
+
+// A changeQuery is a parsed query for the query command.
+// Empty fields match any change.
+type changeQuery struct {
+	host    string
+	owner   string
+	project string
+	status  string
+	after   time.Time
+	before  time.Time
+}
+
+const queryUsage = `usage: reviewdb [-f db] [-json] query [predicates...]
+
+The predicates are:
+
+	host:H (changes on Gerrit server H; default go-review.googlesource.com)
+	owner:X (changes owned by X; an email address or the part before the @)
+	project:P (changes in project P)
+	status:S (changes with status S: open, merged, or abandoned)
+	after:YYYY-MM-DD (changes last updated on or after the date)
+	before:YYYY-MM-DD (changes last updated before the date)
+`
+
+// parseChangeQuery parses the query command's arguments.
+func parseChangeQuery(args []string) (*changeQuery, error) {
+	q := &changeQuery{host: "go-review.googlesource.com"}
+	for _, arg := range args {
+		i := strings.Index(arg, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid predicate %q: want key:value", arg)
+		}
+		key, val := arg[:i], arg[i+1:]
+		switch key {
+		default:
+			return nil, fmt.Errorf("unknown predicate %q", arg)
+		case "host":
+			q.host = val
+		case "owner":
+			q.owner = strings.ToLower(val)
+		case "project":
+			q.project = val
+		case "status":
+			switch strings.ToLower(val) {
+			case "open", "new":
+				q.status = "NEW"
+			case "merged":
+				q.status = "MERGED"
+			case "abandoned":
+				q.status = "ABANDONED"
+			default:
+				return nil, fmt.Errorf("invalid status %q: want open, merged, or abandoned", val)
+			}
+		case "after", "before":
+			t, err := time.Parse("2006-01-02", val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q: want YYYY-MM-DD", val)
+			}
+			if key == "after" {
+				q.after = t
+			} else {
+				q.before = t
+			}
+		}
+	}
+	return q, nil
+}
+
+// match reports whether the change ch matches the query.
+func (q *changeQuery) match(ch *gerrit.ChangeInfo) bool {
+	if q.owner != "" {
+		if ch.Owner == nil {
+			return false
+		}
+		email := strings.ToLower(ch.Owner.Email)
+		if email != q.owner && !strings.HasPrefix(email, q.owner+"@") {
+			return false
+		}
+	}
+	if q.project != "" && ch.Project != q.project {
+		return false
+	}
+	if q.status != "" && ch.Status != q.status {
+		return false
+	}
+	updated := ch.Updated.Time()
+	if !q.after.IsZero() && updated.Before(q.after) {
+		return false
+	}
+	if !q.before.IsZero() && !updated.Before(q.before) {
+		return false
+	}
+	return true
+}
+
+// query prints the stored changes matching the predicates in args,
+// reading only the local database.
+func query(args []string) {
+	q, err := parseChangeQuery(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reviewdb: %v\n%s", err, queryUsage)
+		os.Exit(2)
+	}
+
+	var matches []json.RawMessage
+	var last int64
+	for {
+		var all []RawJSON
+		if err := storage.Select(db, &all, "where Host = ? and Number > ? order by Number asc limit 100", q.host, last); err != nil {
+			log.Fatalf("sql: %v", err)
+		}
+		if len(all) == 0 {
+			break
+		}
+		for _, m := range all {
+			last = m.Number
+			var ch gerrit.ChangeInfo
+			if err := json.Unmarshal(m.ChangeInfo, &ch); err != nil {
+				log.Printf("change %d: unmarshal: %v", m.Number, err)
+				continue
+			}
+			if !q.match(&ch) {
+				continue
+			}
+			if *jsonOut {
+				matches = append(matches, json.RawMessage(m.ChangeInfo))
+				continue
+			}
+			owner := ""
+			if ch.Owner != nil {
+				owner = ch.Owner.Email
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\n", m.Number, ch.Updated.Time().UTC().Format("2006-01-02"), strings.ToLower(ch.Status), owner, ch.Project, ch.Subject)
+		}
+	}
+	if *jsonOut {
+		if matches == nil {
+			matches = []json.RawMessage{}
+		}
+		fmt.Printf("%s\n", js(matches))
+	}
+}